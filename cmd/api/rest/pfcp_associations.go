@@ -7,9 +7,8 @@ import (
 )
 
 type NodeAssociationNoSession struct {
-	ID            string
-	Addr          string
-	NextSessionID uint64
+	ID   string
+	Addr string
 }
 
 type NodeAssociationMapNoSession map[string]NodeAssociationNoSession
@@ -26,9 +25,8 @@ func (h *ApiHandler) listPfcpAssociations(c *gin.Context) {
 	nodeAssociationsNoSession := make(NodeAssociationMapNoSession)
 	for k, v := range h.PfcpSrv.NodeAssociations {
 		nodeAssociationsNoSession[k] = NodeAssociationNoSession{
-			ID:            v.ID,
-			Addr:          v.Addr,
-			NextSessionID: v.NextSessionID,
+			ID:   v.ID,
+			Addr: v.Addr,
 		}
 	}
 	c.IndentedJSON(http.StatusOK, nodeAssociationsNoSession)
@@ -11,31 +11,50 @@ import (
 var v = viper.GetViper()
 
 type UpfConfig struct {
-	InterfaceName           []string `mapstructure:"interface_name" json:"interface_name"`
-	XDPAttachMode           string   `mapstructure:"xdp_attach_mode" validate:"oneof=generic native offload" json:"xdp_attach_mode"`
-	ApiAddress              string   `mapstructure:"api_address" validate:"hostname_port" json:"api_address"`
-	PfcpAddress             string   `mapstructure:"pfcp_address" validate:"hostname_port" json:"pfcp_address"`
-	PfcpNodeId              string   `mapstructure:"pfcp_node_id" validate:"hostname|ip" json:"pfcp_node_id"`
-	PfcpRemoteNode          []string `mapstructure:"pfcp_remote_node" validate:"omitempty,dive,hostname|ip" json:"pfcp_node"`
-	AssociationSetupTimeout uint32   `mapstructure:"association_setup_timeout" json:"association_setup_timeout"`
-	MetricsAddress          string   `mapstructure:"metrics_address" validate:"hostname_port" json:"metrics_address"`
-	N3Address               string   `mapstructure:"n3_address" validate:"ipv4" json:"n3_address"`
-	N9Address               string   `mapstructure:"n9_address" validate:"ipv4" json:"n9_address"`
-	GtpPeer                 []string `mapstructure:"gtp_peer" validate:"omitempty,dive,hostname_port" json:"gtp_peer"`
-	GtpEchoInterval         uint32   `mapstructure:"gtp_echo_interval" validate:"min=1" json:"gtp_echo_interval"`
-	QerMapSize              uint32   `mapstructure:"qer_map_size" json:"qer_map_size"`
-	FarMapSize              uint32   `mapstructure:"far_map_size" json:"far_map_size"`
-	UrrMapSize              uint32   `mapstructure:"urr_map_size" json:"urr_map_size"`
-	PdrMapSize              uint32   `mapstructure:"pdr_map_size" json:"pdr_map_size"`
-	MaxSessions             uint32   `mapstructure:"max_sessions" json:"max_sessions"`
-	HeartbeatRetries        uint32   `mapstructure:"heartbeat_retries" json:"heartbeat_retries"`
-	HeartbeatInterval       uint32   `mapstructure:"heartbeat_interval" json:"heartbeat_interval"`
-	HeartbeatTimeout        uint32   `mapstructure:"heartbeat_timeout" json:"heartbeat_timeout"`
-	LoggingLevel            string   `mapstructure:"logging_level" validate:"required" json:"logging_level"`
-	UEIPPool                string   `mapstructure:"ueip_pool" validate:"cidr" json:"ueip_pool"`
-	FTEIDPool               uint32   `mapstructure:"teid_pool" json:"teid_pool"`
-	FeatureUEIP             bool     `mapstructure:"feature_ueip" json:"feature_ueip"`
-	FeatureFTUP             bool     `mapstructure:"feature_ftup" json:"feature_ftup"`
+	InterfaceName           []string                `mapstructure:"interface_name" json:"interface_name"`
+	XDPAttachMode           string                  `mapstructure:"xdp_attach_mode" validate:"oneof=generic native offload" json:"xdp_attach_mode"`
+	ApiAddress              string                  `mapstructure:"api_address" validate:"hostname_port" json:"api_address"`
+	PfcpAddress             string                  `mapstructure:"pfcp_address" validate:"hostname_port" json:"pfcp_address"`
+	PfcpNodeId              string                  `mapstructure:"pfcp_node_id" validate:"hostname|ip" json:"pfcp_node_id"`
+	PfcpRemoteNode          []string                `mapstructure:"pfcp_remote_node" validate:"omitempty,dive,hostname|ip" json:"pfcp_node"`
+	AssociationSetupTimeout uint32                  `mapstructure:"association_setup_timeout" json:"association_setup_timeout"`
+	MetricsAddress          string                  `mapstructure:"metrics_address" validate:"hostname_port" json:"metrics_address"`
+	N3Address               string                  `mapstructure:"n3_address" validate:"ipv4" json:"n3_address"`
+	N9Address               string                  `mapstructure:"n9_address" validate:"ipv4" json:"n9_address"`
+	GtpPeer                 []string                `mapstructure:"gtp_peer" validate:"omitempty,dive,hostname_port" json:"gtp_peer"`
+	GtpEchoInterval         uint32                  `mapstructure:"gtp_echo_interval" validate:"min=1" json:"gtp_echo_interval"`
+	GtpEchoRetries          uint32                  `mapstructure:"gtp_echo_retries" validate:"min=1" json:"gtp_echo_retries"`
+	QerMapSize              uint32                  `mapstructure:"qer_map_size" json:"qer_map_size"`
+	FarMapSize              uint32                  `mapstructure:"far_map_size" json:"far_map_size"`
+	UrrMapSize              uint32                  `mapstructure:"urr_map_size" json:"urr_map_size"`
+	PdrMapSize              uint32                  `mapstructure:"pdr_map_size" json:"pdr_map_size"`
+	MaxSessions             uint32                  `mapstructure:"max_sessions" json:"max_sessions"`
+	HeartbeatRetries        uint32                  `mapstructure:"heartbeat_retries" json:"heartbeat_retries"`
+	HeartbeatInterval       uint32                  `mapstructure:"heartbeat_interval" json:"heartbeat_interval"`
+	HeartbeatTimeout        uint32                  `mapstructure:"heartbeat_timeout" json:"heartbeat_timeout"`
+	LoggingLevel            string                  `mapstructure:"logging_level" validate:"required" json:"logging_level"`
+	UEIPPool                string                  `mapstructure:"ueip_pool" validate:"cidr" json:"ueip_pool"`
+	FTEIDPool               uint32                  `mapstructure:"teid_pool" json:"teid_pool"`
+	FeatureUEIP             bool                    `mapstructure:"feature_ueip" json:"feature_ueip"`
+	FeatureFTUP             bool                    `mapstructure:"feature_ftup" json:"feature_ftup"`
+	UrrPollInterval         uint32                  `mapstructure:"urr_poll_interval" validate:"min=1" json:"urr_poll_interval"`
+	GracefulReleaseTimeout  uint32                  `mapstructure:"graceful_release_timeout" json:"graceful_release_timeout"`
+	PfcpRequestTimeout      uint32                  `mapstructure:"pfcp_request_timeout" validate:"min=1" json:"pfcp_request_timeout"`
+	PfcpRequestRetries      uint32                  `mapstructure:"pfcp_request_retries" json:"pfcp_request_retries"`
+	SeidPrefix              uint32                  `mapstructure:"seid_prefix" validate:"max=65535" json:"seid_prefix"`
+	MaxSdfFilters           uint32                  `mapstructure:"max_sdf_filters" validate:"min=1,max=5" json:"max_sdf_filters"`
+	DownlinkBufferPackets   uint32                  `mapstructure:"downlink_buffer_packets" validate:"min=1" json:"downlink_buffer_packets"`
+	NetworkInstances        []NetworkInstanceConfig `mapstructure:"network_instances" validate:"max=63,unique=Name,dive" json:"network_instances"`
+}
+
+// NetworkInstanceConfig routes the traffic of a network instance (DNN) in its own routing table (VRF).
+// Network instances received on N6 through their own interface or VLAN may reuse the UE addresses of the others.
+type NetworkInstanceConfig struct {
+	Name             string `mapstructure:"name" validate:"required" json:"name"`
+	Table            uint32 `mapstructure:"table" validate:"required_without_all=Interface IngressInterface Vlan" json:"table"`
+	Interface        string `mapstructure:"interface" json:"interface"`
+	IngressInterface string `mapstructure:"ingress_interface" json:"ingress_interface"`
+	Vlan             uint16 `mapstructure:"vlan" validate:"max=4094" json:"vlan"`
 }
 
 func init() {
@@ -51,6 +70,7 @@ func init() {
 	pflag.String("n9addr", "n3addr", "Address for communication over N9 interface")
 	pflag.StringArray("peer", []string{}, "Address of GTP peer")
 	pflag.Uint32("echo", 10, "Interval of sending echo requests in seconds")
+	pflag.Uint32("echoretries", 3, "Number of unanswered echo requests before GTP path is reported as failed")
 	pflag.Uint32("qersize", 0, "Size of the QER ebpf map")
 	pflag.Uint32("farsize", 0, "Size of the FAR ebpf map")
 	pflag.Uint32("urrsize", 0, "Size of the URR ebpf map")
@@ -66,6 +86,13 @@ func init() {
 	pflag.Uint32("teidpool", 65535, "TEID pool for FTUP feature")
 	pflag.StringArray("pfcprnode", []string{}, "Address of remote PFCP node")
 	pflag.Uint32("astimeout", 5, "Association setup timeout in seconds")
+	pflag.Uint32("urrpoll", 1, "Interval of checking URRs for usage reports in seconds")
+	pflag.Uint32("grtimeout", 5, "Timeout of waiting for Association Release on shutdown in seconds")
+	pflag.Uint32("reqtimeout", 3, "Retransmission timeout (T1) of PFCP requests in seconds")
+	pflag.Uint32("reqretries", 3, "Number of retransmissions (N1) of PFCP requests")
+	pflag.Uint32("seidprefix", 0, "Prefix of local SEIDs unique to the UPF instance")
+	pflag.Uint32("maxsdf", 5, "Maximum number of SDF filters per PDR")
+	pflag.Uint32("dlbuffer", 128, "Maximum number of downlink packets buffered per session")
 	pflag.Parse()
 
 	// Bind flag errors only when flag is nil, and we ignore empty cli args
@@ -81,6 +108,7 @@ func init() {
 	_ = v.BindPFlag("n9_address", pflag.Lookup("n9addr"))
 	_ = v.BindPFlag("gtp_peer", pflag.Lookup("peer"))
 	_ = v.BindPFlag("gtp_echo_interval", pflag.Lookup("echo"))
+	_ = v.BindPFlag("gtp_echo_retries", pflag.Lookup("echoretries"))
 	_ = v.BindPFlag("qer_map_size", pflag.Lookup("qersize"))
 	_ = v.BindPFlag("far_map_size", pflag.Lookup("farsize"))
 	_ = v.BindPFlag("urr_map_size", pflag.Lookup("urrsize"))
@@ -94,6 +122,13 @@ func init() {
 	_ = v.BindPFlag("feature_ftup", pflag.Lookup("ftup"))
 	_ = v.BindPFlag("ueip_pool", pflag.Lookup("ueippool"))
 	_ = v.BindPFlag("teid_pool", pflag.Lookup("teidpool"))
+	_ = v.BindPFlag("urr_poll_interval", pflag.Lookup("urrpoll"))
+	_ = v.BindPFlag("graceful_release_timeout", pflag.Lookup("grtimeout"))
+	_ = v.BindPFlag("pfcp_request_timeout", pflag.Lookup("reqtimeout"))
+	_ = v.BindPFlag("pfcp_request_retries", pflag.Lookup("reqretries"))
+	_ = v.BindPFlag("seid_prefix", pflag.Lookup("seidprefix"))
+	_ = v.BindPFlag("max_sdf_filters", pflag.Lookup("maxsdf"))
+	_ = v.BindPFlag("downlink_buffer_packets", pflag.Lookup("dlbuffer"))
 
 	v.SetDefault("n9_address", v.GetString("n3_address"))
 
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"github.com/edgecomllc/eupf/cmd/config"
+	"github.com/edgecomllc/eupf/cmd/ebpf"
+	"github.com/rs/zerolog/log"
+)
+
+// downlinkBuffer keeps the downlink packets of the session handed over by the datapath, while its FARs buffer them,
+// until the CP function updates the FARs to forward the packets.
+type downlinkBuffer struct {
+	packets map[uint32][]ebpf.BufferedPacket // FAR ID -> packets in the order of arrival
+	size    int                              // Number of packets of all FARs
+	// FARs the CP function has been notified about, it is notified again only once the FAR is updated
+	notified map[uint32]bool
+}
+
+func newDownlinkBuffer() *downlinkBuffer {
+	return &downlinkBuffer{
+		packets:  map[uint32][]ebpf.BufferedPacket{},
+		notified: map[uint32]bool{},
+	}
+}
+
+// add stores the packet of the FAR unless the session already buffers the maximum number of packets.
+func (buffer *downlinkBuffer) add(farId uint32, packet ebpf.BufferedPacket, limit int) bool {
+	if buffer.size >= limit {
+		return false
+	}
+	buffer.packets[farId] = append(buffer.packets[farId], packet)
+	buffer.size++
+	return true
+}
+
+// take removes the packets of the FAR from the buffer and returns them.
+func (buffer *downlinkBuffer) take(farId uint32) []ebpf.BufferedPacket {
+	packets := buffer.packets[farId]
+	delete(buffer.packets, farId)
+	buffer.size -= len(packets)
+	return packets
+}
+
+// BufferedPackets returns the channel the downlink packets handed over by the datapath should be sent to.
+func (connection *PfcpConnection) BufferedPackets() chan<- ebpf.BufferedPacket {
+	return connection.bufferedPacketC
+}
+
+// DisableDownlinkBuffer makes the packets of buffering FARs dropped rather than buffered, as the datapath
+// can't forward them later. The CP function is still notified about them.
+func (connection *PfcpConnection) DisableDownlinkBuffer() {
+	connection.noDownlinkBuffer = true
+}
+
+// HandleBufferedPacket buffers the downlink packet if its FAR buffers packets, and sends a Downlink Data Report
+// to the CP function if the FAR notifies it.
+func (connection *PfcpConnection) HandleBufferedPacket(packet ebpf.BufferedPacket) {
+	association, session, farId := connection.sessions.FindFar(packet.FarId)
+	if session == nil {
+		log.Debug().Msgf("Dropping buffered packet of unknown FAR: %d", packet.FarId)
+		return
+	}
+	if session.downlinkBuffer == nil {
+		session.downlinkBuffer = newDownlinkBuffer()
+	}
+	buffer := session.downlinkBuffer
+
+	action := session.FARs[farId].FarInfo.Action
+	if action&ebpf.FarBuffer != 0 {
+		if connection.noDownlinkBuffer {
+			log.Debug().Msgf("Downlink buffer is disabled, dropping packet of FAR: %d", farId)
+		} else if !buffer.add(farId, packet, int(config.Conf.DownlinkBufferPackets)) {
+			log.Debug().Msgf("Downlink buffer of session %d is full, dropping packet of FAR: %d", session.LocalSEID, farId)
+		}
+	}
+	// The CP function is notified again about the next packet if the report can't be sent
+	if action&ebpf.FarNotifyCp != 0 && !buffer.notified[farId] {
+		if err := SendDownlinkDataReport(connection, association, session, packet.PdrId, session.pdrQfi(packet.PdrId)); err == nil {
+			buffer.notified[farId] = true
+		}
+	}
+}
+
+// pdrQfi returns the QFI the QER of the PDR marks the packets with.
+func (s *Session) pdrQfi(pdrId uint32) uint8 {
+	qerId := s.PDRs[pdrId].PdrInfo.QerId
+	for _, sQerInfo := range s.QERs {
+		if sQerInfo.GlobalId == qerId {
+			return sQerInfo.QerInfo.Qfi
+		}
+	}
+	return 0
+}
+
+// flushDownlinkBuffer reinjects the buffered packets of the FARs updated to forward packets into the datapath,
+// which applies the current rules of the session to them, and discards the packets of the FARs which have been
+// removed or updated to drop packets. The CP function is notified again about the next packets of the updated FARs.
+func (connection *PfcpConnection) flushDownlinkBuffer(session *Session, updatedFARs []uint32) {
+	buffer := session.downlinkBuffer
+	if buffer == nil {
+		return
+	}
+	for _, farId := range updatedFARs {
+		delete(buffer.notified, farId)
+	}
+	for farId := range buffer.notified {
+		if _, ok := session.FARs[farId]; !ok {
+			delete(buffer.notified, farId)
+		}
+	}
+	for farId := range buffer.packets {
+		sFarInfo, ok := session.FARs[farId]
+		if ok && sFarInfo.FarInfo.Action&ebpf.FarBuffer != 0 {
+			continue
+		}
+		packets := buffer.take(farId)
+		if !ok || sFarInfo.FarInfo.Action&ebpf.FarForward == 0 {
+			log.Debug().Msgf("Discarding %d buffered packets of FAR: %d", len(packets), farId)
+			continue
+		}
+		log.Debug().Msgf("Reinjecting %d buffered packets of FAR: %d", len(packets), farId)
+		for _, packet := range packets {
+			if err := connection.mapOperations.ReinjectPacket(packet.Ifindex, packet.Packet); err != nil {
+				log.Warn().Msgf("Failed to reinject buffered packet of session %d: %s", session.LocalSEID, err.Error())
+				break
+			}
+		}
+	}
+}
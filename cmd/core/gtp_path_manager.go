@@ -12,27 +12,43 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// GtpPathEvent notifies that a GTP-U peer stopped or resumed answering echo requests.
+type GtpPathEvent struct {
+	PeerAddress string
+	Up          bool
+}
+
+type gtpPath struct {
+	sequenceNumber uint16
+	failedEchoes   uint32
+	down           bool
+}
+
 type GtpPathManager struct {
 	localAddress  string
-	peers         map[string]uint16
+	peers         map[string]*gtpPath
 	checkInterval time.Duration
+	echoRetries   uint32
+	events        chan<- GtpPathEvent
 	ctx           context.Context
 	cancelCtx     context.CancelFunc
 }
 
-func NewGtpPathManager(localAddress string, interval time.Duration) *GtpPathManager {
+func NewGtpPathManager(localAddress string, interval time.Duration, echoRetries uint32, events chan<- GtpPathEvent) *GtpPathManager {
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	return &GtpPathManager{
 		localAddress:  localAddress,
-		peers:         map[string]uint16{},
+		peers:         map[string]*gtpPath{},
 		checkInterval: interval,
+		echoRetries:   echoRetries,
+		events:        events,
 		ctx:           ctx,
 		cancelCtx:     cancelCtx,
 	}
 }
 
 func (gtpPathManager *GtpPathManager) AddGtpPath(gtpPeerAddress string) {
-	gtpPathManager.peers[gtpPeerAddress] = 0
+	gtpPathManager.peers[gtpPeerAddress] = &gtpPath{}
 }
 
 func (gtpPathManager *GtpPathManager) Run() {
@@ -45,23 +61,44 @@ func (gtpPathManager *GtpPathManager) Run() {
 				// The context is over, stop processing results
 				return
 			case <-ticker.C:
-				for peer, sequenceNumber := range gtpPathManager.peers {
-					log.Trace().Msgf("Send GTP Echo request to %s, seq %d", peer, sequenceNumber)
-					elapseTime, err := gtpPathManager.sendEcho(peer, sequenceNumber)
+				for peer, path := range gtpPathManager.peers {
+					log.Trace().Msgf("Send GTP Echo request to %s, seq %d", peer, path.sequenceNumber)
+					elapseTime, err := gtpPathManager.sendEcho(peer, path.sequenceNumber)
 					if err != nil {
 						log.Warn().Msgf("%v", err)
+						path.failedEchoes++
+						if !path.down && path.failedEchoes >= gtpPathManager.echoRetries {
+							log.Warn().Msgf("GTP path to %s failed after %d unanswered echo requests", peer, path.failedEchoes)
+							path.down = true
+							gtpPathManager.notify(GtpPathEvent{PeerAddress: peer, Up: false})
+						}
 						continue
 					}
 
-					log.Trace().Msgf("Received GTP Echo response from %s, seq %d in %d ms", peer, sequenceNumber, elapseTime.Milliseconds())
-					gtpPathManager.peers[peer] = sequenceNumber + 1
-
+					log.Trace().Msgf("Received GTP Echo response from %s, seq %d in %d ms", peer, path.sequenceNumber, elapseTime.Milliseconds())
+					path.sequenceNumber++
+					path.failedEchoes = 0
+					if path.down {
+						log.Info().Msgf("GTP path to %s recovered", peer)
+						path.down = false
+						gtpPathManager.notify(GtpPathEvent{PeerAddress: peer, Up: true})
+					}
 				}
 			}
 		}
 	}()
 }
 
+func (gtpPathManager *GtpPathManager) notify(event GtpPathEvent) {
+	if gtpPathManager.events == nil {
+		return
+	}
+	select {
+	case gtpPathManager.events <- event:
+	case <-gtpPathManager.ctx.Done():
+	}
+}
+
 func (gtpPathManager *GtpPathManager) Stop() {
 	gtpPathManager.cancelCtx()
 }
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serveGtpEcho(t *testing.T, conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		echoResponse := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(echoResponse, gopacket.SerializeOptions{},
+			&layers.GTPv1U{
+				Version:            1,
+				MessageType:        2, // GTPU_ECHO_RESPONSE
+				MessageLength:      4,
+				SequenceNumberFlag: true,
+			},
+		); err != nil {
+			t.Errorf("Error serializing echo response: %s", err)
+			return
+		}
+		_, _ = conn.WriteToUDP(echoResponse.Bytes(), addr)
+	}
+}
+
+func TestGtpPathFailureAndRecovery(t *testing.T) {
+	peerConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	// Nobody answers on the closed port, so the echo requests fail right away
+	peerConn.Close()
+
+	events := make(chan GtpPathEvent, 2)
+	gtpPathManager := NewGtpPathManager("127.0.0.1:0", 10*time.Millisecond, 2, events)
+	gtpPathManager.AddGtpPath(peerAddr.String())
+	gtpPathManager.Run()
+	defer gtpPathManager.Stop()
+
+	select {
+	case event := <-events:
+		if event.Up || event.PeerAddress != peerAddr.String() {
+			t.Errorf("Unexpected GTP path event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GTP path failure not reported")
+	}
+
+	peerConn, err = net.ListenUDP("udp", peerAddr)
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer peerConn.Close()
+	go serveGtpEcho(t, peerConn)
+
+	select {
+	case event := <-events:
+		if !event.Up || event.PeerAddress != peerAddr.String() {
+			t.Errorf("Unexpected GTP path event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GTP path recovery not reported")
+	}
+}
@@ -12,34 +12,38 @@ import (
 )
 
 type MapOperationsMock struct {
-	urr ebpf.UrrInfo
+	urr                 ebpf.UrrInfo
+	occupancy           float64
+	deletedDownlinkPdrs []uint32
+	reinjectedPackets   [][]byte
 }
 
 func (mapOps *MapOperationsMock) PutPdrUplink(teid uint32, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) PutPdrDownlink(ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
+func (mapOps *MapOperationsMock) PutPdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
 func (mapOps *MapOperationsMock) UpdatePdrUplink(teid uint32, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) UpdatePdrDownlink(ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
+func (mapOps *MapOperationsMock) UpdatePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) DeletePdrUplink(teid uint32) error {
+func (mapOps *MapOperationsMock) DeletePdrUplink(teid uint32, pdrId uint32) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) DeletePdrDownlink(ipv4 net.IP) error {
+func (mapOps *MapOperationsMock) DeletePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrId uint32) error {
+	mapOps.deletedDownlinkPdrs = append(mapOps.deletedDownlinkPdrs, pdrId)
 	return nil
 }
-func (mapOps *MapOperationsMock) PutDownlinkPdrIp6(ipv6 net.IP, pdrInfo ebpf.PdrInfo) error {
+func (mapOps *MapOperationsMock) PutDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) UpdateDownlinkPdrIp6(ipv6 net.IP, pdrInfo ebpf.PdrInfo) error {
+func (mapOps *MapOperationsMock) UpdateDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo ebpf.PdrInfo) error {
 	return nil
 }
-func (mapOps *MapOperationsMock) DeleteDownlinkPdrIp6(ipv6 net.IP) error {
+func (mapOps *MapOperationsMock) DeleteDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrId uint32) error {
 	return nil
 }
 func (mapOps *MapOperationsMock) NewFar(farInfo ebpf.FarInfo) (uint32, error) {
@@ -69,10 +73,23 @@ func (mapOps *MapOperationsMock) UpdateUrr(internalId uint32, urrInfo ebpf.UrrIn
 	return nil
 }
 
+func (mapOps *MapOperationsMock) GetUrr(internalId uint32) (ebpf.UrrInfo, error) {
+	return mapOps.urr, nil
+}
+
+func (mapOps *MapOperationsMock) MapOccupancy() float64 {
+	return mapOps.occupancy
+}
+
 func (mapOps *MapOperationsMock) DeleteUrr(internalId uint32) (error, ebpf.UrrInfo) {
 	return nil, mapOps.urr
 }
 
+func (mapOps *MapOperationsMock) ReinjectPacket(ifindex uint32, packet []byte) error {
+	mapOps.reinjectedPackets = append(mapOps.reinjectedPackets, packet)
+	return nil
+}
+
 func TestSessionOverwrite(t *testing.T) {
 
 	mapOps := MapOperationsMock{}
@@ -108,7 +125,7 @@ func TestSessionOverwrite(t *testing.T) {
 	if nodeId != "test-node" {
 		t.Errorf("Unexpected node ID in association setup response: %s", nodeId)
 	}
-	if _, ok := pfcpConn.NodeAssociations[remoteIP]; !ok {
+	if _, ok := pfcpConn.NodeAssociations["test"]; !ok {
 		t.Errorf("Association not created")
 	}
 
@@ -155,10 +172,10 @@ func TestSessionOverwrite(t *testing.T) {
 	}
 
 	// Check that session PDRs are correct
-	if pfcpConn.NodeAssociations[remoteIP].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
+	if pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
 		t.Errorf("Session 1, got broken")
 	}
-	if pfcpConn.NodeAssociations[remoteIP].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
+	if pfcpConn.NodeAssociations["test"].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
 		t.Errorf("Session 2, got broken")
 	}
 
@@ -184,10 +201,10 @@ func TestSessionOverwrite(t *testing.T) {
 	}
 
 	// Check that session PDRs are correct
-	if pfcpConn.NodeAssociations[remoteIP].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
+	if pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
 		t.Errorf("Session 1, got broken")
 	}
-	if pfcpConn.NodeAssociations[remoteIP].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
+	if pfcpConn.NodeAssociations["test"].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
 		t.Errorf("Session 2, got broken")
 	}
 }
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"time"
+
+	"github.com/edgecomllc/eupf/cmd/config"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+const (
+	// PFCP handler latency that corresponds to the full load
+	loadControlLatencyBudget = 100 * time.Millisecond
+	// Weight of the latest handler latency in the moving average
+	loadControlLatencyWeight = 0.1
+	// Load metric from which the UP function reports overload
+	overloadThreshold uint8 = 80
+	// Period of validity of the overload reduction
+	overloadValidity = 10 * time.Second
+)
+
+// loadControl tracks the load of the UP function reported in Load and Overload Control Information.
+// It is only accessed from the PFCP connection loop.
+type loadControl struct {
+	latency            time.Duration
+	loadSequenceNumber uint32
+	loadMetric         uint8
+	overloadSeqNumber  uint32
+	overloadMetric     uint8
+}
+
+// observeLatency adds the duration of a handled PFCP message to the moving average.
+func (control *loadControl) observeLatency(duration time.Duration) {
+	control.latency += time.Duration(loadControlLatencyWeight * float64(duration-control.latency))
+}
+
+// LoadMetric returns the load of the UP function in percent. It is the highest of
+// the session count against max sessions, the eBPF maps occupancy and the PFCP handler latency.
+func (connection *PfcpConnection) LoadMetric() uint8 {
+	load := connection.mapOperations.MapOccupancy()
+	if config.Conf.MaxSessions != 0 {
+		load = max(load, float64(connection.GetSessionCount())/float64(config.Conf.MaxSessions))
+	}
+	load = max(load, float64(connection.loadControl.latency)/float64(loadControlLatencyBudget))
+	return uint8(min(load, 1) * 100)
+}
+
+// loadControlIEs returns Load and Overload Control Information for the CP function supporting them.
+func (connection *PfcpConnection) loadControlIEs(association *NodeAssociation) []*ie.IE {
+	if !association.LoadControl && !association.OverloadControl {
+		return nil
+	}
+	metric := connection.LoadMetric()
+
+	control := &connection.loadControl
+	// Sequence numbers are incremented only when the reported information changes
+	if metric != control.loadMetric {
+		control.loadMetric = metric
+		control.loadSequenceNumber++
+	}
+	overloadMetric := uint8(0)
+	if metric >= overloadThreshold {
+		overloadMetric = uint8(uint32(metric-overloadThreshold) * 100 / uint32(100-overloadThreshold))
+	}
+	if overloadMetric != control.overloadMetric {
+		control.overloadMetric = overloadMetric
+		control.overloadSeqNumber++
+	}
+
+	var ies []*ie.IE
+	if association.LoadControl {
+		ies = append(ies, ie.NewLoadControlInformation(
+			ie.NewSequenceNumber(control.loadSequenceNumber),
+			ie.NewMetric(control.loadMetric),
+		))
+	}
+	// Overload Control Information is sent while overloaded and once more when the overload ends
+	if association.OverloadControl && (overloadMetric != 0 || association.overloadSeqNumber != control.overloadSeqNumber) {
+		association.overloadSeqNumber = control.overloadSeqNumber
+		validity := overloadValidity
+		if overloadMetric == 0 {
+			validity = 0
+		}
+		ies = append(ies, ie.NewOverloadControlInformation(
+			ie.NewSequenceNumber(control.overloadSeqNumber),
+			ie.NewMetric(overloadMetric),
+			ie.NewTimer(validity),
+		))
+	}
+	return ies
+}
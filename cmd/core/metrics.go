@@ -21,6 +21,16 @@ var (
 		Help: "The total number of transmitted PFCP messages",
 	}, []string{"message_name"})
 
+	PfcpRequestRetransmissions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upf_pfcp_tx_retransmissions",
+		Help: "The total number of retransmitted PFCP requests",
+	}, []string{"message_name"})
+
+	PfcpRequestTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upf_pfcp_tx_timeouts",
+		Help: "The total number of PFCP requests left unanswered after all retransmissions",
+	}, []string{"message_name"})
+
 	PfcpMessageRxErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "upf_pfcp_rx_errors",
 		Help: "The total number of received PFCP messages with cause code",
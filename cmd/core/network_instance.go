@@ -0,0 +1,73 @@
+package core
+
+import (
+	"github.com/edgecomllc/eupf/cmd/config"
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// NetworkInstanceID returns the datapath ID of the configured network instance, its position in the config
+// starting from 1. Network instances missing in the config use the default routing table of ID 0.
+func NetworkInstanceID(name string) uint32 {
+	for i, instance := range config.Conf.NetworkInstances {
+		if instance.Name == name {
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// downlinkNetworkInstance returns the network instance keying the downlink PDRs of the network instance. UE addresses
+// are kept apart only for the network instances told apart on N6 by their ingress interface or VLAN, the others
+// share the UE addresses of the default network instance.
+func downlinkNetworkInstance(networkInstance uint32) uint32 {
+	if networkInstance == 0 || int(networkInstance) > len(config.Conf.NetworkInstances) {
+		return 0
+	}
+	instance := config.Conf.NetworkInstances[networkInstance-1]
+	if instance.IngressInterface == "" && instance.Vlan == 0 {
+		return 0
+	}
+	return networkInstance
+}
+
+// parseNetworkInstance returns the ID of the Network Instance IE among the IEs of PDI or Forwarding Parameters,
+// and false if there is no such IE.
+func parseNetworkInstance(ies []*ie.IE) (uint32, bool) {
+	index := findIEindex(ies, ie.NetworkInstance)
+	if index == -1 {
+		return 0, false
+	}
+	name, err := networkInstanceName(ies[index])
+	if err != nil {
+		log.Warn().Msgf("Network Instance IE is incorrect: %s", err.Error())
+		return 0, true
+	}
+	id := NetworkInstanceID(name)
+	if id == 0 && len(config.Conf.NetworkInstances) > 0 {
+		log.Warn().Msgf("Network instance %q is not configured, using the default routing table", name)
+	}
+	return id, true
+}
+
+// networkInstanceName decodes the Network Instance, which SMFs send either as a plain string
+// or as a DNN in the label encoding of an APN.
+func networkInstanceName(networkInstance *ie.IE) (string, error) {
+	if isLabelEncoded(networkInstance.Payload) {
+		return networkInstance.ValueAsFQDN()
+	}
+	return networkInstance.ValueAsString()
+}
+
+func isLabelEncoded(b []byte) bool {
+	// The first character of a plain string is printable, unlike the length octet of a label shorter than 32
+	if len(b) == 0 || b[0] >= 0x20 {
+		return false
+	}
+	for offset := 0; offset < len(b); offset += int(b[offset]) + 1 {
+		if b[offset] == 0 || b[offset] > 63 || offset+int(b[offset]) >= len(b) {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
 
 	"github.com/edgecomllc/eupf/cmd/config"
 )
@@ -13,70 +14,104 @@ import (
 type NodeAssociation struct {
 	ID               string
 	Addr             string
-	NextSessionID    uint64
-	NextSequenceID   uint32
 	Sessions         map[uint64]*Session
 	HeartbeatChannel chan uint32
 	HeartbeatsActive bool
+	// Recovery Time Stamp received from the CP function in the PFCP Association Setup
+	RecoveryTimeStamp time.Time
+	// SMF Set ID of the CP function, its sessions may be taken over by other SMFs of the set
+	SMFSetID string
+	// LOAD and OVRL features of the CP function
+	LoadControl     bool
+	OverloadControl bool
+	// Sequence number of the last Overload Control Information sent to the CP function
+	overloadSeqNumber uint32
+	heartbeatCtx      context.Context
+	stopHeartbeat     context.CancelFunc
 	sync.Mutex
 	// AssociationStart time.Time // Held until propper failure detection is implemented
 }
 
 func NewNodeAssociation(remoteNodeID string, addr string) *NodeAssociation {
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
 	return &NodeAssociation{
 		ID:               remoteNodeID,
 		Addr:             addr,
-		NextSessionID:    1,
-		NextSequenceID:   1,
 		Sessions:         make(map[uint64]*Session),
 		HeartbeatChannel: make(chan uint32),
+		heartbeatCtx:     heartbeatCtx,
+		stopHeartbeat:    stopHeartbeat,
 		// AssociationStart: time.Now(),
 	}
 }
 
-func (association *NodeAssociation) NewLocalSEID() uint64 {
-	association.NextSessionID += 1
-	return association.NextSessionID
+// SetCPFunctionFeatures stores the features of the CP function that affect the UP function behavior.
+func (association *NodeAssociation) SetCPFunctionFeatures(cpFunctionFeatures *ie.IE) {
+	if cpFunctionFeatures == nil {
+		return
+	}
+	association.LoadControl = cpFunctionFeatures.HasLOAD()
+	association.OverloadControl = cpFunctionFeatures.HasOVRL()
 }
 
-func (association *NodeAssociation) NewSequenceID() uint32 {
+// GetAddr returns the transport address the CP function currently uses.
+func (association *NodeAssociation) GetAddr() string {
 	association.Lock()
 	defer association.Unlock()
+	return association.Addr
+}
 
-	association.NextSequenceID += 1
-	return association.NextSequenceID
+// SetAddr updates the transport address when the CP function sends from another address,
+// e.g. after a NAT rebinding or from another member of an SMF set sharing the Node ID.
+func (association *NodeAssociation) SetAddr(addr string) {
+	association.Lock()
+	defer association.Unlock()
+	if association.Addr != addr {
+		log.Info().Msgf("Association with NodeID: %s moved from address: %s to: %s", association.ID, association.Addr, addr)
+		association.Addr = addr
+	}
 }
 
 func (association *NodeAssociation) ScheduleHeartbeat(conn *PfcpConnection) {
-	ctx := context.Background()
-	failedHeartbeats := uint32(0)
+	ctx := association.heartbeatCtx
 
 	for {
-		sequence := association.NewSequenceID()
-		SendHeartbeatRequest(conn, sequence, association.Addr)
+		failed := make(chan struct{}, 1)
+		sequence := SendHeartbeatRequest(conn, association.GetAddr(), func() { failed <- struct{}{} })
 
-		heartbeatTimeout := time.NewTimer(time.Duration(config.Conf.HeartbeatTimeout) * time.Second)
-		select {
-		case <-heartbeatTimeout.C:
-			failedHeartbeats++
-			if failedHeartbeats >= config.Conf.HeartbeatRetries {
-				log.Warn().Msgf("the number of unanswered heartbeats has reached the limit, association deleted: %s", association.Addr)
-				conn.heartbeatFailedC <- association.Addr
+		for answered := false; !answered; {
+			select {
+			case seq := <-association.HeartbeatChannel:
+				answered = sequence == seq
+			case <-failed:
+				log.Warn().Msgf("the number of unanswered heartbeats has reached the limit, association deleted: %s", association.ID)
+				select {
+				case conn.heartbeatFailedC <- association.ID:
+				case <-ctx.Done():
+				}
+				return
+			case <-ctx.Done():
+				log.Info().Msgf("HeartbeatScheduler context done | association: %s", association.ID)
 				return
 			}
-		case seq := <-association.HeartbeatChannel:
-			if sequence == seq {
-				heartbeatTimeout.Stop()
-				failedHeartbeats = 0
-				<-time.After(time.Duration(config.Conf.HeartbeatInterval) * time.Second)
-			}
+		}
+
+		select {
+		case <-time.After(time.Duration(config.Conf.HeartbeatInterval) * time.Second):
 		case <-ctx.Done():
-			log.Info().Msgf("HeartbeatScheduler context done | association address: %s", association.Addr)
 			return
 		}
 	}
 }
 
+// StopHeartbeat stops the heartbeat scheduler of a released or expired association.
+func (association *NodeAssociation) StopHeartbeat() {
+	association.stopHeartbeat()
+}
+
 func (association *NodeAssociation) HandleHeartbeat(sequence uint32) {
-	association.HeartbeatChannel <- sequence
+	select {
+	case association.HeartbeatChannel <- sequence:
+	case <-association.heartbeatCtx.Done():
+	}
 }
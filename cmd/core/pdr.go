@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/edgecomllc/eupf/cmd/ebpf"
@@ -11,13 +12,17 @@ import (
 const flagPresentIPv4 = 2
 
 func applyPDR(spdrInfo SPDRInfo, mapOperations ebpf.ForwardingPlaneController) error {
+	if !spdrInfo.isApplied() {
+		log.Warn().Msgf("PDR %d is not applied until PFDs of application %s are provisioned", spdrInfo.PdrID, spdrInfo.ApplicationID)
+		return nil
+	}
 	if spdrInfo.Ipv4 != nil {
-		if err := mapOperations.PutPdrDownlink(spdrInfo.Ipv4, spdrInfo.PdrInfo); err != nil {
+		if err := mapOperations.PutPdrDownlink(spdrInfo.downlinkNetworkInstance(), spdrInfo.Ipv4, spdrInfo.PdrInfo); err != nil {
 			log.Error().Err(err).Msg("Can't apply IPv4 PDR")
 			return err
 		}
 	} else if spdrInfo.Ipv6 != nil {
-		if err := mapOperations.PutDownlinkPdrIp6(spdrInfo.Ipv6, spdrInfo.PdrInfo); err != nil {
+		if err := mapOperations.PutDownlinkPdrIp6(spdrInfo.downlinkNetworkInstance(), spdrInfo.Ipv6, spdrInfo.PdrInfo); err != nil {
 			log.Error().Err(err).Msg("Can't apply IPv6 PDR")
 			return err
 		}
@@ -45,3 +50,35 @@ func processCreatedPDRs(createdPDRs []SPDRInfo, n3Address net.IP) []*ie.IE {
 	}
 	return additionalIEs
 }
+
+// removePDR deletes the rule written by applyPDR, other PDRs of the same key are kept.
+func removePDR(spdrInfo SPDRInfo, mapOperations ebpf.ForwardingPlaneController) error {
+	if !spdrInfo.isApplied() {
+		return nil
+	}
+	if spdrInfo.Ipv4 != nil {
+		if err := mapOperations.DeletePdrDownlink(spdrInfo.downlinkNetworkInstance(), spdrInfo.Ipv4, spdrInfo.PdrID); err != nil {
+			return fmt.Errorf("Can't delete IPv4 PDR: %s", err.Error())
+		}
+	} else if spdrInfo.Ipv6 != nil {
+		if err := mapOperations.DeleteDownlinkPdrIp6(spdrInfo.downlinkNetworkInstance(), spdrInfo.Ipv6, spdrInfo.PdrID); err != nil {
+			return fmt.Errorf("Can't delete IPv6 PDR: %s", err.Error())
+		}
+	} else {
+		if err := mapOperations.DeletePdrUplink(spdrInfo.Teid, spdrInfo.PdrID); err != nil {
+			return fmt.Errorf("Can't delete GTP PDR: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// samePDRKey reports whether both PDRs are stored in the maps under the same key.
+func samePDRKey(spdrInfo SPDRInfo, other SPDRInfo) bool {
+	if spdrInfo.Ipv4 != nil || other.Ipv4 != nil {
+		return spdrInfo.Ipv4.Equal(other.Ipv4) && spdrInfo.downlinkNetworkInstance() == other.downlinkNetworkInstance()
+	}
+	if spdrInfo.Ipv6 != nil || other.Ipv6 != nil {
+		return spdrInfo.Ipv6.Equal(other.Ipv6) && spdrInfo.downlinkNetworkInstance() == other.downlinkNetworkInstance()
+	}
+	return spdrInfo.Teid == other.Teid
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -15,13 +16,17 @@ import (
 type PDRCreationContext struct {
 	Session         *Session
 	ResourceManager *service.ResourceManager
+	ApplicationPfds ApplicationPfds
 	TEIDCache       map[uint8]uint32
+	// Called with the release of every TEID and UE IP allocated, if set, e.g. to undo a failed modification
+	OnAllocate func(release func())
 }
 
-func NewPDRCreationContext(session *Session, resourceManager *service.ResourceManager) *PDRCreationContext {
+func NewPDRCreationContext(session *Session, resourceManager *service.ResourceManager, applicationPfds ApplicationPfds) *PDRCreationContext {
 	return &PDRCreationContext{
 		Session:         session,
 		ResourceManager: resourceManager,
+		ApplicationPfds: applicationPfds,
 		TEIDCache:       make(map[uint8]uint32),
 	}
 }
@@ -64,6 +69,10 @@ func GetURRIDs(i *ie.IE) ([]uint32, error) {
 }
 
 func (pdrContext *PDRCreationContext) extractPDR(pdr *ie.IE, spdrInfo *SPDRInfo) error {
+	spdrInfo.PdrInfo.PdrId = spdrInfo.PdrID
+	if precedence, err := pdr.Precedence(); err == nil {
+		spdrInfo.PdrInfo.Precedence = precedence
+	}
 	if outerHeaderRemoval, err := pdr.OuterHeaderRemovalDescription(); err == nil {
 		spdrInfo.PdrInfo.OuterHeaderRemoval = outerHeaderRemoval
 	}
@@ -89,14 +98,27 @@ func (pdrContext *PDRCreationContext) extractPDR(pdr *ie.IE, spdrInfo *SPDRInfo)
 		return fmt.Errorf("PDI IE is missing")
 	}
 
-	if sdfFilter, err := pdr.SDFFilter(); err == nil {
-		if sdfFilter.FlowDescription == "" {
-			log.Warn().Msgf("SDFFilter is empty")
-		} else if sdfFilterParsed, err := ParseSdfFilter(sdfFilter.FlowDescription); err == nil {
-			spdrInfo.PdrInfo.SdfFilter = &sdfFilterParsed
-		} else {
-			log.Error().Msgf("SDFFilter err: %v", err)
-			return err
+	spdrInfo.PdrInfo.NetworkInstance, _ = parseNetworkInstance(pdi)
+
+	if sdfFilters, err := parseSdfFilters(pdi); err == nil {
+		spdrInfo.PdrInfo.SdfFilters = sdfFilters
+	} else {
+		log.Error().Msgf("SDFFilter err: %v", err)
+		return err
+	}
+
+	if appIdPdiId := findIEindex(pdi, ie.ApplicationID); appIdPdiId != -1 {
+		applicationID, err := pdi[appIdPdiId].ApplicationID()
+		if err != nil {
+			return fmt.Errorf("Application ID IE is incorrect")
+		}
+		spdrInfo.ApplicationID = applicationID
+		// SDF Filter of the PDI takes precedence over the PFDs of the application
+		if _, err := pdr.SDFFilter(); err != nil {
+			if err := pdrContext.ApplicationPfds.resolveSdfFilter(spdrInfo); err != nil {
+				log.Error().Msgf("Application ID err: %v", err)
+				return err
+			}
 		}
 	}
 
@@ -117,7 +139,7 @@ func (pdrContext *PDRCreationContext) extractPDR(pdr *ie.IE, spdrInfo *SPDRInfo)
 				}
 			}
 			if allocate {
-				allocatedTeid, err := pdrContext.getFTEID(pdrContext.Session.RemoteSEID, spdrInfo.PdrID)
+				allocatedTeid, err := pdrContext.getFTEID(pdrContext.Session.LocalSEID, spdrInfo.PdrID)
 				if err != nil {
 					log.Error().Msgf("AllocateTEID err: %v", err)
 					return fmt.Errorf("can't allocate TEID: %s", causeToString(ie.CauseNoResourcesAvailable))
@@ -162,27 +184,10 @@ func (pdrContext *PDRCreationContext) extractPDR(pdr *ie.IE, spdrInfo *SPDRInfo)
 	return err
 }
 
+// deletePDR deletes the rule of the PDR. The TEIDs and UE IPs of the session are released along with the session,
+// as PDRs with the same CHOOSE ID share their TEID.
 func (pdrContext *PDRCreationContext) deletePDR(spdrInfo SPDRInfo, mapOperations ebpf.ForwardingPlaneController) error {
-	if spdrInfo.Ipv4 != nil {
-		if err := mapOperations.DeletePdrDownlink(spdrInfo.Ipv4); err != nil {
-			return fmt.Errorf("Can't delete IPv4 PDR: %s", err.Error())
-		}
-	} else if spdrInfo.Ipv6 != nil {
-		if err := mapOperations.DeleteDownlinkPdrIp6(spdrInfo.Ipv6); err != nil {
-			return fmt.Errorf("Can't delete IPv6 PDR: %s", err.Error())
-		}
-	} else {
-		if _, ok := pdrContext.TEIDCache[uint8(spdrInfo.Teid)]; !ok {
-			if err := mapOperations.DeletePdrUplink(spdrInfo.Teid); err != nil {
-				return fmt.Errorf("Can't delete GTP PDR: %s", err.Error())
-			}
-			pdrContext.TEIDCache[uint8(spdrInfo.Teid)] = 0
-		}
-	}
-	if spdrInfo.Teid != 0 {
-		pdrContext.ResourceManager.FTEIDM.ReleaseTEID(pdrContext.Session.RemoteSEID)
-	}
-	return nil
+	return removePDR(spdrInfo, mapOperations)
 }
 
 func (pdrContext *PDRCreationContext) getFARID(farid uint32) uint32 {
@@ -207,6 +212,7 @@ func (pdrContext *PDRCreationContext) getFTEID(seID uint64, pdrID uint32) (uint3
 		log.Error().Msgf("AllocateTEID err: %v", err)
 		return 0, fmt.Errorf("Can't allocate TEID: %s", causeToString(ie.CauseNoResourcesAvailable))
 	}
+	pdrContext.allocated(func() { pdrContext.ResourceManager.FTEIDM.ReleaseSessionTEID(seID, allocatedTeid) })
 	return allocatedTeid, nil
 }
 
@@ -214,13 +220,21 @@ func (pdrContext PDRCreationContext) getIP() (net.IP, error) {
 	if pdrContext.ResourceManager == nil || pdrContext.ResourceManager.IPAM == nil {
 		return nil, errors.New("IP address manager is nil")
 	}
-	allocatedIP, err := pdrContext.ResourceManager.IPAM.AllocateIP(pdrContext.Session.RemoteSEID)
+	seID := pdrContext.Session.LocalSEID
+	allocatedIP, err := pdrContext.ResourceManager.IPAM.AllocateIP(seID)
 	if err != nil {
 		return nil, fmt.Errorf("can't allocate IP: %s", causeToString(ie.CauseNoResourcesAvailable))
 	}
+	pdrContext.allocated(func() { pdrContext.ResourceManager.IPAM.ReleaseSessionIP(seID, allocatedIP) })
 	return allocatedIP, nil
 }
 
+func (pdrContext PDRCreationContext) allocated(release func()) {
+	if pdrContext.OnAllocate != nil {
+		pdrContext.OnAllocate(release)
+	}
+}
+
 func (pdrContext *PDRCreationContext) hasTEIDCache(chooseID uint8) (uint32, bool) {
 	teid, ok := pdrContext.TEIDCache[chooseID]
 	return teid, ok
@@ -233,3 +247,80 @@ func (pdrContext *PDRCreationContext) setTEIDCache(chooseID uint8, teid uint32)
 func hasCHV4(flags uint8) bool {
 	return flags&(1<<4) != 0
 }
+
+// sdfFilterLimit returns the number of SDF filters allowed per PDR.
+func sdfFilterLimit() int {
+	if config.Conf.MaxSdfFilters == 0 || config.Conf.MaxSdfFilters > ebpf.SdfListSize {
+		return ebpf.SdfListSize
+	}
+	return int(config.Conf.MaxSdfFilters)
+}
+
+// parseSdfFilters parses the flow descriptions of all SDF Filter IEs of the PDI. PDRs with more
+// filters than the limit are rejected rather than matching only a part of the traffic.
+func parseSdfFilters(pdi []*ie.IE) ([]ebpf.SdfFilter, error) {
+	var sdfFilters []ebpf.SdfFilter
+	for _, sdfFilterIe := range pdi {
+		if sdfFilterIe.Type != ie.SDFFilter {
+			continue
+		}
+		sdfFilter, err := sdfFilterIe.SDFFilter()
+		if err != nil {
+			return nil, err
+		}
+		if sdfFilter.FlowDescription == "" && sdfFilter.ToSTrafficClass == "" && sdfFilter.SecurityParameterIndex == "" && sdfFilter.FlowLabel == "" {
+			log.Warn().Msgf("SDFFilter is empty")
+			continue
+		}
+		// SDF Filter without a flow description matches the packets of any flow
+		sdfFiltersParsed := []ebpf.SdfFilter{{Protocol: sdfProtocolAny, SrcPortRange: anyPortRange, DstPortRange: anyPortRange}}
+		if sdfFilter.FlowDescription != "" {
+			if sdfFiltersParsed, err = ParseSdfFilters(sdfFilter.FlowDescription); err != nil {
+				return nil, err
+			}
+		}
+		if err := setSdfFilterFields(sdfFiltersParsed, sdfFilter); err != nil {
+			return nil, err
+		}
+		sdfFilters = append(sdfFilters, sdfFiltersParsed...)
+	}
+	if limit := sdfFilterLimit(); len(sdfFilters) > limit {
+		return nil, fmt.Errorf("%d SDF filters exceed the limit of %d per PDR", len(sdfFilters), limit)
+	}
+	return sdfFilters, nil
+}
+
+// setSdfFilterFields sets the ToS/Traffic Class, SPI and Flow Label of the SDF Filter IE to the filters of its flow description.
+func setSdfFilterFields(sdfFilters []ebpf.SdfFilter, fields *ie.SDFFilterFields) error {
+	var matchFlags, tosTrafficClass, tosTrafficClassMask uint8
+	var spi, flowLabel uint32
+	if fields.ToSTrafficClass != "" {
+		if len(fields.ToSTrafficClass) != 2 {
+			return fmt.Errorf("ToS/Traffic Class of SDF Filter should be 2 octets")
+		}
+		matchFlags |= ebpf.SdfMatchToSTrafficClass
+		tosTrafficClass, tosTrafficClassMask = fields.ToSTrafficClass[0], fields.ToSTrafficClass[1]
+	}
+	if fields.SecurityParameterIndex != "" {
+		if len(fields.SecurityParameterIndex) != 4 {
+			return fmt.Errorf("Security Parameter Index of SDF Filter should be 4 octets")
+		}
+		matchFlags |= ebpf.SdfMatchSecurityParameterIndex
+		spi = binary.BigEndian.Uint32([]byte(fields.SecurityParameterIndex))
+	}
+	if fields.FlowLabel != "" {
+		if len(fields.FlowLabel) != 3 {
+			return fmt.Errorf("Flow Label of SDF Filter should be 3 octets")
+		}
+		matchFlags |= ebpf.SdfMatchFlowLabel
+		flowLabel = (uint32(fields.FlowLabel[0])<<16 | uint32(fields.FlowLabel[1])<<8 | uint32(fields.FlowLabel[2])) & 0xfffff
+	}
+	for i := range sdfFilters {
+		sdfFilters[i].MatchFlags = matchFlags
+		sdfFilters[i].ToSTrafficClass = tosTrafficClass
+		sdfFilters[i].ToSTrafficClassMask = tosTrafficClassMask
+		sdfFilters[i].SecurityParameterIndex = spi
+		sdfFilters[i].FlowLabel = flowLabel
+	}
+	return nil
+}
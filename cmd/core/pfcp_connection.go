@@ -27,9 +27,15 @@ var pfcpHandlers = PfcpHandlerMap{
 	message.MsgTypeAssociationSetupRequest:     HandlePfcpAssociationSetupRequest,
 	message.MsgTypeAssociationSetupResponse:    HandlePfcpAssociationSetupResponse,
 	message.MsgTypeAssociationUpdateRequest:    HandlePfcpAssociationUpdateRequest,
+	message.MsgTypeAssociationUpdateResponse:   HandlePfcpAssociationUpdateResponse,
+	message.MsgTypeAssociationReleaseRequest:   HandlePfcpAssociationReleaseRequest,
+	message.MsgTypeNodeReportResponse:          HandlePfcpNodeReportResponse,
 	message.MsgTypeSessionEstablishmentRequest: HandlePfcpSessionEstablishmentRequest,
 	message.MsgTypeSessionDeletionRequest:      HandlePfcpSessionDeletionRequest,
 	message.MsgTypeSessionModificationRequest:  HandlePfcpSessionModificationRequest,
+	message.MsgTypeSessionReportResponse:       HandlePfcpSessionReportResponse,
+	message.MsgTypeSessionSetDeletionRequest:   HandlePfcpSessionSetDeletionRequest,
+	message.MsgTypePFDManagementRequest:        HandlePfcpPfdManagementRequest,
 }
 
 type PfcpConnection struct {
@@ -46,16 +52,82 @@ type PfcpConnection struct {
 	featuresOctets    []uint8
 	ResourceManager   *service.ResourceManager
 	heartbeatFailedC  chan string
-	nodes             []AssociationConnector
+	urrEventC         chan ebpf.UrrEvent
+	bufferedPacketC   chan ebpf.BufferedPacket
+	noDownlinkBuffer  bool
+	gtpPathEventC     chan GtpPathEvent
+	// Last reported state of the GTP-U paths, up or not
+	gtpPaths          map[string]bool
+	gtpReportTimeoutC chan nodeReport
+	reportTimeoutC    chan sessionReport
+	releaseC          chan chan struct{}
+	teardownC         chan chan struct{}
+	// Closed by the Run loop once all associations are released
+	releasedC       chan struct{}
+	sessions        sessionIndex
+	sessionSets     sessionSetIndex
+	applicationPfds ApplicationPfds
+	loadControl     loadControl
+	responseCache   responseCache
+	transactions    *pfcpTransactions
+	nodes           []AssociationConnector
 }
 
-func (connection *PfcpConnection) GetAssociation(assocAddr string) *NodeAssociation {
-	if assoc, ok := connection.NodeAssociations[assocAddr]; ok {
+func (connection *PfcpConnection) GetAssociation(nodeID string) *NodeAssociation {
+	if assoc, ok := connection.NodeAssociations[nodeID]; ok {
 		return assoc
 	}
 	return nil
 }
 
+// GetAssociationByAddr returns the association of the CP function currently using the transport address.
+// It serves the messages without Node ID, such as Heartbeat Response.
+func (connection *PfcpConnection) GetAssociationByAddr(addr string) *NodeAssociation {
+	for _, assoc := range connection.NodeAssociations {
+		if assoc.GetAddr() == addr {
+			return assoc
+		}
+	}
+	return nil
+}
+
+// FindSession returns the session with the local SEID together with its association.
+func (connection *PfcpConnection) FindSession(seid uint64) (*NodeAssociation, *Session) {
+	return connection.sessions.Find(seid)
+}
+
+// FindPeerSession returns the session with the local SEID together with its association and the association of the
+// sending CP function. The sender is identified by the Node ID of the message if present, otherwise by its address;
+// an address no association uses is taken for the owning association, moved after a NAT rebinding or a failover.
+// The sender controls the session if it owns it or is of the same SMF set, its address is updated then.
+func (connection *PfcpConnection) FindPeerSession(seid uint64, addr string, nodeID *ie.IE) (*NodeAssociation, *NodeAssociation, *Session) {
+	association, session := connection.sessions.Find(seid)
+	if session == nil {
+		return nil, nil, nil
+	}
+	sender := connection.GetAssociationByAddr(addr)
+	if nodeID != nil {
+		remoteNodeID, err := nodeID.NodeID()
+		if err != nil {
+			log.Warn().Msgf("Session %d addressed with invalid NodeID from: %s", seid, addr)
+			return nil, nil, nil
+		}
+		sender = connection.GetAssociation(remoteNodeID)
+		if sender == nil {
+			log.Warn().Msgf("Session %d of NodeID: %s is not controlled by unknown NodeID: %s", seid, association.ID, remoteNodeID)
+			return nil, nil, nil
+		}
+	} else if sender == nil {
+		sender = association
+	}
+	if sender != association && !sender.InSameSMFSet(association) {
+		log.Warn().Msgf("Session %d of NodeID: %s is not controlled from: %s", seid, association.ID, addr)
+		return nil, nil, nil
+	}
+	sender.SetAddr(addr)
+	return association, sender, session
+}
+
 func NewPfcpConnection(addr string, nodeId string, n3Ip string, n9Ip string, mapOperations ebpf.ForwardingPlaneController, resourceManager *service.ResourceManager) (*PfcpConnection, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -79,14 +151,22 @@ func NewPfcpConnection(addr string, nodeId string, n3Ip string, n9Ip string, map
 
 	log.Info().Msgf("Starting PFCP connection: %v with Node ID: %v, N3 address: %v, N9 address: %v", udpAddr, nodeId, n3Addr, n9Addr)
 
-	featuresOctets := []uint8{0, 0, 0}
+	featuresOctets := []uint8{0, 0, 0, 0}
 	featuresOctets[1] = setBit(featuresOctets[1], 0)
+	// QUOAC
+	featuresOctets[1] = setBit(featuresOctets[1], 3)
 	if config.Conf.FeatureFTUP {
 		featuresOctets[0] = setBit(featuresOctets[0], 4)
 	}
+	// PFDM
+	featuresOctets[0] = setBit(featuresOctets[0], 5)
 	if config.Conf.FeatureUEIP {
 		featuresOctets[2] = setBit(featuresOctets[2], 2)
 	}
+	// SSET
+	featuresOctets[2] = setBit(featuresOctets[2], 3)
+	// MPAS
+	featuresOctets[3] = setBit(featuresOctets[3], 0)
 
 	return &PfcpConnection{
 		udpConn:           udpConn,
@@ -102,10 +182,30 @@ func NewPfcpConnection(addr string, nodeId string, n3Ip string, n9Ip string, map
 		featuresOctets:    featuresOctets,
 		ResourceManager:   resourceManager,
 		heartbeatFailedC:  make(chan string),
+		urrEventC:         make(chan ebpf.UrrEvent, 64),
+		bufferedPacketC:   make(chan ebpf.BufferedPacket, 256),
+		gtpPathEventC:     make(chan GtpPathEvent, 16),
+		gtpReportTimeoutC: make(chan nodeReport),
+		reportTimeoutC:    make(chan sessionReport),
+		releaseC:          make(chan chan struct{}),
+		teardownC:         make(chan chan struct{}),
+		sessions:          newSessionIndex(config.Conf.SeidPrefix),
+		applicationPfds:   ApplicationPfds{},
+		transactions:      newPfcpTransactions(),
 		nodes:             []AssociationConnector{},
 	}, nil
 }
 
+// UrrEvents returns the channel the datapath URR events should be sent to.
+func (connection *PfcpConnection) UrrEvents() chan<- ebpf.UrrEvent {
+	return connection.urrEventC
+}
+
+// GtpPathEvents returns the channel the GTP-U path failures and recoveries should be sent to.
+func (connection *PfcpConnection) GtpPathEvents() chan<- GtpPathEvent {
+	return connection.gtpPathEventC
+}
+
 func (connection *PfcpConnection) SetRemoteNodes(nodes []AssociationConnector) {
 	connection.nodes = nodes
 }
@@ -113,14 +213,35 @@ func (connection *PfcpConnection) SetRemoteNodes(nodes []AssociationConnector) {
 func (connection *PfcpConnection) Run() {
 
 	ticker := time.NewTicker(time.Duration(config.Conf.AssociationSetupTimeout) * time.Second)
+	usageReportTicker := time.NewTicker(time.Duration(config.Conf.UrrPollInterval) * time.Second)
 	buf := make([]byte, 1500)
 
 	for {
 		select {
 		case <-ticker.C:
 			connection.RefreshAssociations()
-		case associationAddr := <-connection.heartbeatFailedC:
-			connection.DeleteAssociation(associationAddr)
+		case <-usageReportTicker.C:
+			connection.ReportUsage()
+		case event := <-connection.urrEventC:
+			connection.HandleUrrEvent(event)
+		case packet := <-connection.bufferedPacketC:
+			connection.HandleBufferedPacket(packet)
+		case event := <-connection.gtpPathEventC:
+			connection.ReportGtpPath(event)
+		case report := <-connection.reportTimeoutC:
+			connection.HandleSessionReportTimeout(report)
+		case report := <-connection.gtpReportTimeoutC:
+			connection.HandleNodeReportTimeout(report)
+		case nodeID := <-connection.heartbeatFailedC:
+			connection.associationMutex.Lock()
+			connection.FailAssociation(nodeID)
+			connection.associationMutex.Unlock()
+			connection.checkReleased()
+		case released := <-connection.releaseC:
+			connection.requestRelease(released)
+		case done := <-connection.teardownC:
+			connection.DeleteAssociations()
+			close(done)
 		default:
 			_ = connection.udpConn.SetReadDeadline(time.Now().Add(time.Second))
 			n, addr, err := connection.Receive(buf)
@@ -134,6 +255,7 @@ func (connection *PfcpConnection) Run() {
 			}
 			log.Debug().Msgf("Received %d bytes from %s", n, addr)
 			connection.Handle(buf[:n], addr)
+			connection.checkReleased()
 		}
 	}
 }
@@ -172,32 +294,88 @@ func (connection *PfcpConnection) SendMessage(msg message.Message, addr *net.UDP
 
 func (connection *PfcpConnection) RefreshAssociations() {
 	for _, node := range connection.nodes {
-		if connection.GetAssociation(node.getAddress()) == nil {
+		if connection.GetAssociationByAddr(node.getAddress()) == nil {
 			node.sendAssociationSetupRequest(connection)
 		}
 	}
 }
 
 // DeleteAssociation deletes an association and all sessions associated with it.
-func (connection *PfcpConnection) DeleteAssociation(assocAddr string) {
-	assoc := connection.GetAssociation(assocAddr)
-	log.Info().Msgf("Pruning expired node association: %s", assocAddr)
+func (connection *PfcpConnection) DeleteAssociation(nodeID string) {
+	assoc := connection.GetAssociation(nodeID)
+	if assoc == nil {
+		return
+	}
+	log.Info().Msgf("Pruning node association: %s", nodeID)
+	assoc.StopHeartbeat()
 	for sessionId, session := range assoc.Sessions {
 		log.Info().Msgf("Deleting session: %d", sessionId)
 		connection.DeleteSession(session)
+		connection.ReleaseResources(sessionId)
+	}
+	delete(connection.NodeAssociations, nodeID)
+}
+
+// DeleteAssociations deletes all associations and their sessions locally.
+func (connection *PfcpConnection) DeleteAssociations() {
+	connection.associationMutex.Lock()
+	defer connection.associationMutex.Unlock()
+	for nodeID := range connection.NodeAssociations {
+		connection.DeleteAssociation(nodeID)
 	}
-	delete(connection.NodeAssociations, assocAddr)
 }
 
-// DeleteSession deletes a session and all PDRs, FARs and QERs associated with it.
+// ReleaseAssociations asks every associated CP function to release its PFCP association
+// and waits until all of them are released or the timeout expires. The associations left
+// are deleted locally. The associations are owned by the Run loop, so both steps are done there.
+func (connection *PfcpConnection) ReleaseAssociations(timeout time.Duration) {
+	released := make(chan struct{})
+	connection.releaseC <- released
+	select {
+	case <-released:
+		log.Info().Msg("All PFCP associations released")
+	case <-time.After(timeout):
+		log.Warn().Msgf("PFCP associations are not released in %s, deleting them locally", timeout)
+	}
+
+	done := make(chan struct{})
+	connection.teardownC <- done
+	<-done
+}
+
+// requestRelease sends the Association Update Requests with the release request to all associated CP functions.
+func (connection *PfcpConnection) requestRelease(released chan struct{}) {
+	connection.associationMutex.Lock()
+	for _, association := range connection.NodeAssociations {
+		SendAssociationReleaseUpdateRequest(connection, association)
+	}
+	connection.associationMutex.Unlock()
+	connection.releasedC = released
+	connection.checkReleased()
+}
+
+// checkReleased notifies the pending ReleaseAssociations once the last association is gone.
+func (connection *PfcpConnection) checkReleased() {
+	if connection.releasedC != nil && len(connection.NodeAssociations) == 0 {
+		close(connection.releasedC)
+		connection.releasedC = nil
+	}
+}
+
+// DeleteSession deletes a session and all PDRs, FARs, QERs and URRs associated with it.
 func (connection *PfcpConnection) DeleteSession(session *Session) {
+	connection.sessions.Remove(session.LocalSEID)
+	connection.sessionSets.Remove(session)
 	for _, far := range session.FARs {
 		_ = connection.mapOperations.DeleteFar(far.GlobalId)
 	}
 	for _, qer := range session.QERs {
 		_ = connection.mapOperations.DeleteQer(qer.GlobalId)
 	}
-	pdrContext := NewPDRCreationContext(session, connection.ResourceManager)
+	for _, urr := range session.URRs {
+		_, _ = connection.mapOperations.DeleteUrr(urr.GlobalId)
+	}
+	pdrContext := NewPDRCreationContext(session, connection.ResourceManager, connection.applicationPfds)
 	for _, PDR := range session.PDRs {
 		_ = pdrContext.deletePDR(PDR, connection.mapOperations)
 	}
@@ -246,19 +424,23 @@ func (connector *DefaultAssociationConnector) getAddress() string {
 func (connector *DefaultAssociationConnector) sendAssociationSetupRequest(connection *PfcpConnection) {
 
 	associationAddr := connector.getAddress()
+	udpAddr, err := net.ResolveUDPAddr("udp", associationAddr+":8805")
+	if err != nil {
+		log.Error().Msgf("Failed to resolve udp address from PFCP peer address %s. Error: %s\n", associationAddr, err.Error())
+		return
+	}
+	// Outstanding request is retransmitted by its transaction, a new one is sent once it times out
+	if connection.transactions.Outstanding(udpAddr.IP.String(), message.MsgTypeAssociationSetupRequest) {
+		return
+	}
+
 	AssociationSetupRequest := message.NewAssociationSetupRequest(0,
 		newIeNodeID(connection.nodeId),
 		ie.NewRecoveryTimeStamp(connection.RecoveryTimestamp),
 		ie.NewUPFunctionFeatures(connection.featuresOctets[:]...),
 	)
 	log.Info().Msgf("Sent Association Setup Request to: %s", associationAddr)
-
-	udpAddr, err := net.ResolveUDPAddr("udp", associationAddr+":8805")
-	if err != nil {
-		log.Error().Msgf("Failed to resolve udp address from PFCP peer address %s. Error: %s\n", associationAddr, err.Error())
-		return
-	}
-	if err := connection.SendMessage(AssociationSetupRequest, udpAddr); err != nil {
+	if err := connection.SendRequest(AssociationSetupRequest, udpAddr, nil); err != nil {
 		log.Info().Msgf("Failed to send Association Setup Request: %s\n", err.Error())
 	}
 }
@@ -22,19 +22,36 @@ func (handlerMap PfcpHandlerMap) Handle(conn *PfcpConnection, buf []byte, addr *
 		return err
 	}
 	PfcpMessageRx.WithLabelValues(incomingMsg.MessageTypeName()).Inc()
+	// TODO: Trim port as a workaround for NAT changing the port. Explore proper solutions.
+	stringIpAddr := addr.IP.String()
+	isRequest := isPfcpRequest(incomingMsg.MessageType())
+	if isRequest {
+		// Retransmitted requests are answered with the response sent before, without handling them again
+		if outgoingMsg, ok := conn.responseCache.Get(stringIpAddr, incomingMsg, buf); ok {
+			log.Info().Msgf("Got retransmitted %s with sequence number %d from %s", incomingMsg.MessageTypeName(), incomingMsg.Sequence(), addr)
+			PfcpMessageTx.WithLabelValues(outgoingMsg.MessageTypeName()).Inc()
+			return conn.SendMessage(outgoingMsg, addr)
+		}
+	} else if !conn.transactions.Complete(stringIpAddr, incomingMsg.Sequence()) {
+		// Responses to retransmissions of answered requests are handled only once
+		log.Warn().Msgf("Ignored %s with sequence number %d from %s: no outstanding request", incomingMsg.MessageTypeName(), incomingMsg.Sequence(), addr)
+		return nil
+	}
 	if handler, ok := handlerMap[incomingMsg.MessageType()]; ok {
 		startTime := time.Now()
-		// TODO: Trim port as a workaround for NAT changing the port. Explore proper solutions.
-		stringIpAddr := addr.IP.String()
 		outgoingMsg, err := handler(conn, incomingMsg, stringIpAddr)
 		if err != nil {
 			log.Warn().Msgf("Error handling PFCP message: %s", err.Error())
 			return err
 		}
 		duration := time.Since(startTime)
+		conn.loadControl.observeLatency(duration)
 		UpfMessageRxLatency.WithLabelValues(incomingMsg.MessageTypeName()).Observe(float64(duration.Microseconds()))
 		// Now assumption that all handlers will return a message to send is not true.
 		if outgoingMsg != nil {
+			if isRequest {
+				conn.responseCache.Put(stringIpAddr, incomingMsg, buf, outgoingMsg)
+			}
 			PfcpMessageTx.WithLabelValues(outgoingMsg.MessageTypeName()).Inc()
 			return conn.SendMessage(outgoingMsg, addr)
 		}
@@ -85,7 +102,7 @@ func HandlePfcpAssociationSetupRequest(conn *PfcpConnection, msg message.Message
 		)
 		return asres, nil
 	}
-	_, err = asreq.RecoveryTimeStamp.RecoveryTimeStamp()
+	recoveryTimeStamp, err := asreq.RecoveryTimeStamp.RecoveryTimeStamp()
 	if err != nil {
 		log.Warn().Msgf("Got Association Setup Request with invalid RecoveryTimeStamp from: %s", addr)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
@@ -95,6 +112,21 @@ func HandlePfcpAssociationSetupRequest(conn *PfcpConnection, msg message.Message
 		return asres, nil
 	}
 
+	// PFCP Session Retention Information
+	var retainedCpAddresses []net.IP
+	if asreq.PFCPSessionRetentionInformation != nil {
+		retainedCpAddresses, err = parseSessionRetentionInformation(asreq.PFCPSessionRetentionInformation)
+		if err != nil {
+			log.Warn().Msgf("Got Association Setup Request with invalid PFCPSessionRetentionInformation from: %s", addr)
+			PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+			asres := message.NewAssociationSetupResponse(asreq.SequenceNumber,
+				ie.NewCause(ie.CauseMandatoryIEIncorrect),
+				ie.NewOffendingIE(ie.PFCPSessionRetentionInformation),
+			)
+			return asres, nil
+		}
+	}
+
 	// If the PFCP Association Setup Request contains a Node ID for which a PFCP association was already established
 	// proceed with establishing the new PFCP association (regardless of the Recovery AssociationStart received in the request), overwriting the existing association;
 	// if the request is accepted:
@@ -103,20 +135,29 @@ func HandlePfcpAssociationSetupRequest(conn *PfcpConnection, msg message.Message
 	// Check if the PFCP Association Setup Request contains a Node ID for which a PFCP association was already established
 	conn.associationMutex.Lock()
 	defer conn.associationMutex.Unlock()
-	if _, ok := conn.NodeAssociations[addr]; ok {
+	// Create RemoteNode from AssociationSetupRequest
+	remoteNode := NewNodeAssociation(remoteNodeID, addr)
+	remoteNode.SetCPFunctionFeatures(asreq.CPFunctionFeatures)
+	remoteNode.RecoveryTimeStamp = recoveryTimeStamp
+	if asreq.SMFSetID != nil {
+		if remoteNode.SMFSetID, err = asreq.SMFSetID.SMFSetID(); err != nil {
+			log.Warn().Msgf("Got Association Setup Request with invalid SMFSetID from: %s", addr)
+		}
+	}
+	if existing, ok := conn.NodeAssociations[remoteNodeID]; ok {
 		log.Warn().Msgf("Association with NodeID: %s and address: %s already exists", remoteNodeID, addr)
+		if !existing.RecoveryTimeStamp.Equal(recoveryTimeStamp) {
+			log.Info().Msgf("CP function with NodeID: %s restarted at %s", remoteNodeID, recoveryTimeStamp)
+		}
 		// retain the PFCP sessions that were established with the existing PFCP association and that are requested to be retained, if the PFCP Session Retention Information IE was received in the request; otherwise, delete the PFCP sessions that were established with the existing PFCP association;
-		//log.Warn().Msg("Session retention is not yet implemented")
+		conn.ReplaceAssociation(existing, remoteNode, asreq.PFCPSessionRetentionInformation != nil, retainedCpAddresses)
 	} else {
-		// Create RemoteNode from AssociationSetupRequest
-		remoteNode := NewNodeAssociation(remoteNodeID, addr)
-		// Add or replace RemoteNode to NodeAssociationMap
-		conn.NodeAssociations[addr] = remoteNode
-
-		log.Info().Msgf("Saving new association: %+v", remoteNode)
-		if config.Conf.HeartbeatTimeout != 0 {
-			go remoteNode.ScheduleHeartbeat(conn)
-		}
+		// Add RemoteNode to NodeAssociationMap
+		conn.NodeAssociations[remoteNodeID] = remoteNode
+	}
+	log.Info().Msgf("Saving new association: %+v", remoteNode)
+	if config.Conf.HeartbeatTimeout != 0 {
+		go remoteNode.ScheduleHeartbeat(conn)
 	}
 
 	// shall send a PFCP Association Setup Response including:
@@ -159,7 +200,8 @@ func HandlePfcpAssociationUpdateRequest(conn *PfcpConnection, msg message.Messag
 
 	conn.associationMutex.Lock()
 	defer conn.associationMutex.Unlock()
-	if _, ok := conn.NodeAssociations[addr]; !ok {
+	association, ok := conn.NodeAssociations[remoteNodeID]
+	if !ok {
 		log.Warn().Msgf("Association with NodeID: %s and address: %s doesn't exist", remoteNodeID, addr)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
 		asres := message.NewAssociationUpdateResponse(asreq.SequenceNumber,
@@ -167,6 +209,8 @@ func HandlePfcpAssociationUpdateRequest(conn *PfcpConnection, msg message.Messag
 		)
 		return asres, nil
 	}
+	association.SetAddr(addr)
+	association.SetCPFunctionFeatures(asreq.CPFunctionFeatures)
 
 	// shall send a PFCP Association Update Response including:
 	asres := message.NewAssociationUpdateResponse(asreq.SequenceNumber,
@@ -179,6 +223,92 @@ func HandlePfcpAssociationUpdateRequest(conn *PfcpConnection, msg message.Messag
 	return asres, nil
 }
 
+func HandlePfcpAssociationReleaseRequest(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	arreq := msg.(*message.AssociationReleaseRequest)
+	log.Info().Msgf("Got Association Release Request from: %s", addr)
+	if arreq.NodeID == nil {
+		log.Warn().Msgf("Got Association Release Request without NodeID from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		arres := message.NewAssociationReleaseResponse(arreq.SequenceNumber,
+			newIeNodeID(conn.nodeId),
+			ie.NewCause(ie.CauseMandatoryIEMissing),
+		)
+		return arres, nil
+	}
+	remoteNodeID, err := arreq.NodeID.NodeID()
+	if err != nil {
+		log.Warn().Msgf("Got Association Release Request with invalid NodeID from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		arres := message.NewAssociationReleaseResponse(arreq.SequenceNumber,
+			newIeNodeID(conn.nodeId),
+			ie.NewCause(ie.CauseMandatoryIEIncorrect),
+		)
+		return arres, nil
+	}
+
+	conn.associationMutex.Lock()
+	defer conn.associationMutex.Unlock()
+	if _, ok := conn.NodeAssociations[remoteNodeID]; !ok {
+		log.Warn().Msgf("Association with NodeID: %s and address: %s doesn't exist", remoteNodeID, addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
+		arres := message.NewAssociationReleaseResponse(arreq.SequenceNumber,
+			newIeNodeID(conn.nodeId),
+			ie.NewCause(ie.CauseNoEstablishedPFCPAssociation),
+		)
+		return arres, nil
+	}
+
+	// shall delete the PFCP sessions related to the PFCP association locally and delete the PFCP association
+	log.Info().Msgf("Releasing association with NodeID: %s and address: %s", remoteNodeID, addr)
+	conn.DeleteAssociation(remoteNodeID)
+
+	arres := message.NewAssociationReleaseResponse(arreq.SequenceNumber,
+		newIeNodeID(conn.nodeId),
+		ie.NewCause(ie.CauseRequestAccepted),
+	)
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRequestAccepted)).Inc()
+	return arres, nil
+}
+
+// SendAssociationReleaseUpdateRequest requests the CP function to release the PFCP association.
+func SendAssociationReleaseUpdateRequest(conn *PfcpConnection, association *NodeAssociation) {
+	aureq := message.NewAssociationUpdateRequest(0,
+		newIeNodeID(conn.nodeId),
+		ie.NewPFCPAssociationReleaseRequest(1, 0),
+	)
+	log.Info().Msgf("Sent Association Update Request with release request to: %s", association.GetAddr())
+	udpAddr, err := net.ResolveUDPAddr("udp", association.GetAddr()+":8805")
+	if err != nil {
+		log.Info().Msgf("Failed to send Association Update Request: %s\n", err.Error())
+		return
+	}
+	if err := conn.SendRequest(aureq, udpAddr, nil); err != nil {
+		log.Info().Msgf("Failed to send Association Update Request: %s\n", err.Error())
+	}
+}
+
+func HandlePfcpAssociationUpdateResponse(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	aures := msg.(*message.AssociationUpdateResponse)
+	if aures.Cause == nil {
+		log.Warn().Msgf("Got Association Update Response without Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		return nil, errMandatoryIeMissing
+	}
+	cause, err := aures.Cause.Cause()
+	if err != nil {
+		log.Warn().Msgf("Got Association Update Response with invalid Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		return nil, err
+	}
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(cause)).Inc()
+	if cause != ie.CauseRequestAccepted {
+		log.Warn().Msgf("Association Update Request rejected by: %s, cause: %s", addr, causeToString(cause))
+		return nil, nil
+	}
+	log.Info().Msgf("Got Association Update Response from: %s", addr)
+	return nil, nil
+}
+
 func newIeNodeID(nodeID string) *ie.IE {
 	ip := net.ParseIP(nodeID)
 	if ip != nil {
@@ -239,23 +369,45 @@ func HandlePfcpAssociationSetupResponse(conn *PfcpConnection, msg message.Messag
 	}
 	log.Info().Msgf("Got Association Setup Response with CPFunctionFeatures from: %s. CPFunctionFeatures: %b", addr, cpFunctionFeatures)
 
+	// Recovery Time Stamp
+	if asres.RecoveryTimeStamp == nil {
+		log.Warn().Msgf("Got Association Setup Response without RecoveryTimeStamp from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		return nil, nil
+	}
+	recoveryTimeStamp, err := asres.RecoveryTimeStamp.RecoveryTimeStamp()
+	if err != nil {
+		log.Warn().Msgf("Got Association Setup Response with invalid RecoveryTimeStamp from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		return nil, err
+	}
+
 	// Check if the PFCP Association Setup Request contains a Node ID for which a PFCP association was already established
 	conn.associationMutex.Lock()
 	defer conn.associationMutex.Unlock()
-	if _, ok := conn.NodeAssociations[addr]; ok {
+	existing, ok := conn.NodeAssociations[remoteNodeID]
+	if ok {
 		log.Warn().Msgf("Association with NodeID: %s and address: %s already exists", remoteNodeID, addr)
-		// retain the PFCP sessions that were established with the existing PFCP association and that are requested to be retained, if the PFCP Session Retention Information IE was received in the request; otherwise, delete the PFCP sessions that were established with the existing PFCP association;
-		//log.Warn().Msg("Session retention is not yet implemented")
-	} else {
-		// Create RemoteNode from AssociationSetupResponse
-		remoteNode := NewNodeAssociation(remoteNodeID, addr)
-		// Add or replace RemoteNode to NodeAssociationMap
-		conn.NodeAssociations[addr] = remoteNode
-		log.Info().Msgf("Saving new association: %+v", remoteNode)
-
-		if config.Conf.HeartbeatTimeout != 0 {
-			go remoteNode.ScheduleHeartbeat(conn)
+		if existing.RecoveryTimeStamp.Equal(recoveryTimeStamp) {
+			return nil, nil
 		}
+		log.Info().Msgf("CP function with NodeID: %s restarted at %s", remoteNodeID, recoveryTimeStamp)
+	}
+	// Create RemoteNode from AssociationSetupResponse
+	remoteNode := NewNodeAssociation(remoteNodeID, addr)
+	remoteNode.SetCPFunctionFeatures(asres.CPFunctionFeatures)
+	remoteNode.RecoveryTimeStamp = recoveryTimeStamp
+	if ok {
+		// The restarted CP function has lost its sessions, so the sessions of the existing association are deleted
+		conn.ReplaceAssociation(existing, remoteNode, false, nil)
+	} else {
+		// Add RemoteNode to NodeAssociationMap
+		conn.NodeAssociations[remoteNodeID] = remoteNode
+	}
+	log.Info().Msgf("Saving new association: %+v", remoteNode)
+
+	if config.Conf.HeartbeatTimeout != 0 {
+		go remoteNode.ScheduleHeartbeat(conn)
 	}
 
 	return nil, nil
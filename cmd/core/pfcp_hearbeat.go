@@ -2,6 +2,9 @@ package core
 
 import (
 	"net"
+	"time"
+
+	"github.com/edgecomllc/eupf/cmd/config"
 
 	"github.com/rs/zerolog/log"
 	"github.com/wmnsk/go-pfcp/ie"
@@ -33,21 +36,28 @@ func HandlePfcpHeartbeatResponse(conn *PfcpConnection, msg message.Message, addr
 		log.Debug().Msgf("Got Heartbeat Response with TS: %s, from: %s", ts, addr)
 	}
 
-	if association := conn.GetAssociation(addr); association != nil {
+	if association := conn.GetAssociationByAddr(addr); association != nil {
 		association.HandleHeartbeat(msg.Sequence())
 	}
 	return nil, err
 }
 
-func SendHeartbeatRequest(conn *PfcpConnection, sequenceID uint32, associationAddr string) {
-	hbreq := message.NewHeartbeatRequest(sequenceID, ie.NewRecoveryTimeStamp(conn.RecoveryTimestamp), nil)
+// SendHeartbeatRequest sends a Heartbeat Request retransmitted every heartbeat timeout and returns its sequence number,
+// onTimeout is called when all the heartbeat retries are left unanswered, or right away when the request can't be sent at all.
+func SendHeartbeatRequest(conn *PfcpConnection, associationAddr string, onTimeout func()) uint32 {
+	hbreq := message.NewHeartbeatRequest(0, ie.NewRecoveryTimeStamp(conn.RecoveryTimestamp), nil)
 	log.Debug().Msgf("Sent Heartbeat Request to: %s", associationAddr)
 	udpAddr, err := net.ResolveUDPAddr("udp", associationAddr+":8805")
-	if err == nil {
-		if err := conn.SendMessage(hbreq, udpAddr); err != nil {
-			log.Info().Msgf("Failed to send Heartbeat Request: %s\n", err.Error())
-		}
-	} else {
+	if err != nil {
+		// No response can arrive, so the heartbeat fails without waiting for it
+		log.Info().Msgf("Failed to send Heartbeat Request: %s\n", err.Error())
+		onTimeout()
+		return hbreq.Sequence()
+	}
+	interval := time.Duration(config.Conf.HeartbeatTimeout) * time.Second
+	retries := max(config.Conf.HeartbeatRetries, 1) - 1
+	if err := conn.sendRequest(hbreq, udpAddr, interval, retries, onTimeout); err != nil {
 		log.Info().Msgf("Failed to send Heartbeat Request: %s\n", err.Error())
 	}
+	return hbreq.Sequence()
 }
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+const (
+	nodeReportTypeUPFR uint8 = 1 << 0 // User Plane Path Failure Report
+	nodeReportTypeUPRR uint8 = 1 << 1 // User Plane Path Recovery Report
+)
+
+// nodeReport is a Node Report Request about a GTP-U path left unanswered by the CP function.
+type nodeReport struct {
+	nodeID string
+	event  GtpPathEvent
+}
+
+// ReportGtpPath informs every associated CP function about a failed or recovered GTP-U path.
+func (connection *PfcpConnection) ReportGtpPath(event GtpPathEvent) {
+	if connection.gtpPaths == nil {
+		connection.gtpPaths = map[string]bool{}
+	}
+	connection.gtpPaths[event.PeerAddress] = event.Up
+
+	// The requests are sent without holding the mutex
+	connection.associationMutex.Lock()
+	associations := make([]*NodeAssociation, 0, len(connection.NodeAssociations))
+	for _, association := range connection.NodeAssociations {
+		associations = append(associations, association)
+	}
+	connection.associationMutex.Unlock()
+	for _, association := range associations {
+		connection.sendGtpPathReport(association, event)
+	}
+}
+
+// HandleNodeReportTimeout reports the GTP-U path again to the CP function which left the report unanswered,
+// unless the association is gone or the path state has changed and been reported since.
+func (connection *PfcpConnection) HandleNodeReportTimeout(report nodeReport) {
+	association := connection.GetAssociation(report.nodeID)
+	if association == nil {
+		return
+	}
+	if up, ok := connection.gtpPaths[report.event.PeerAddress]; !ok || up != report.event.Up {
+		return
+	}
+	connection.sendGtpPathReport(association, report.event)
+}
+
+func (connection *PfcpConnection) sendGtpPathReport(association *NodeAssociation, event GtpPathEvent) {
+	peerAddr, err := net.ResolveUDPAddr("udp", event.PeerAddress)
+	if err != nil {
+		log.Warn().Msgf("Can't resolve GTP peer address %s: %s", event.PeerAddress, err.Error())
+		return
+	}
+	remotePeer := newIeRemoteGTPUPeer(peerAddr.IP)
+
+	var reportType, report *ie.IE
+	if event.Up {
+		reportType = ie.NewNodeReportType(nodeReportTypeUPRR)
+		report = ie.NewUserPlanePathRecoveryReport(remotePeer)
+	} else {
+		reportType = ie.NewNodeReportType(nodeReportTypeUPFR)
+		report = ie.NewUserPlanePathFailureReport(remotePeer)
+	}
+
+	onTimeout := func() {
+		log.Warn().Msgf("Node Report Request about GTP-U peer %s left unanswered by NodeID: %s, reporting it again", event.PeerAddress, association.ID)
+		connection.gtpReportTimeoutC <- nodeReport{nodeID: association.ID, event: event}
+	}
+	SendNodeReportRequest(connection, association, onTimeout, reportType, report)
+}
+
+func newIeRemoteGTPUPeer(ip net.IP) *ie.IE {
+	if ip.To4() != nil {
+		return ie.NewRemoteGTPUPeer(0x02, ip.String(), "", 0, "")
+	}
+	return ie.NewRemoteGTPUPeer(0x01, "", ip.String(), 0, "")
+}
+
+// SendNodeReportRequest sends the Node Report Request with the IEs, onTimeout is called when it is left unanswered.
+func SendNodeReportRequest(conn *PfcpConnection, association *NodeAssociation, onTimeout func(), ies ...*ie.IE) {
+	ies = append([]*ie.IE{newIeNodeID(conn.nodeId)}, ies...)
+	nrreq := message.NewNodeReportRequest(0, ies...)
+	log.Info().Msgf("Sent Node Report Request to: %s", association.GetAddr())
+	udpAddr, err := net.ResolveUDPAddr("udp", association.GetAddr()+":8805")
+	if err != nil {
+		log.Info().Msgf("Failed to send Node Report Request: %s\n", err.Error())
+		return
+	}
+	if err := conn.SendRequest(nrreq, udpAddr, onTimeout); err != nil {
+		log.Info().Msgf("Failed to send Node Report Request: %s\n", err.Error())
+	}
+}
+
+func HandlePfcpNodeReportResponse(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	nrres := msg.(*message.NodeReportResponse)
+	if nrres.Cause == nil {
+		log.Warn().Msgf("Got Node Report Response without Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		return nil, errMandatoryIeMissing
+	}
+	cause, err := nrres.Cause.Cause()
+	if err != nil {
+		log.Warn().Msgf("Got Node Report Response with invalid Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		return nil, err
+	}
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(cause)).Inc()
+	if cause != ie.CauseRequestAccepted {
+		log.Warn().Msgf("Node Report Request rejected by: %s, cause: %s", addr, causeToString(cause))
+		return nil, nil
+	}
+	log.Debug().Msgf("Node Report Request accepted by: %s", addr)
+	return nil, nil
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"github.com/edgecomllc/eupf/cmd/config"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// responseCacheExpiry returns the time a response is kept for retransmitted requests. It covers the retransmission
+// window of the peer, T1 x (N1 + 1), assuming the peer retransmits with the same timer and retries as the UPF.
+func responseCacheExpiry() time.Duration {
+	return time.Duration(config.Conf.PfcpRequestTimeout) * time.Second * time.Duration(config.Conf.PfcpRequestRetries+1)
+}
+
+// responseCacheKey identifies a request of the peer. Besides the sequence number it holds the message type and
+// the SEID, so a request reusing the sequence number of another one, e.g. after a restart of the peer, isn't
+// answered with the response to the other request.
+type responseCacheKey struct {
+	peer        string
+	messageType uint8
+	seid        uint64
+	sequence    uint32
+}
+
+func newResponseCacheKey(peer string, request message.Message) responseCacheKey {
+	return responseCacheKey{peer: peer, messageType: request.MessageType(), seid: request.SEID(), sequence: request.Sequence()}
+}
+
+type cachedResponse struct {
+	response message.Message
+	// Digest of the request, a retransmission is identical to it
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+type responseCacheEntry struct {
+	key     responseCacheKey
+	expires time.Time
+}
+
+// responseCache keeps the responses sent to the peers to answer their retransmitted requests
+// without handling them again. It is only accessed from the PFCP connection loop.
+type responseCache struct {
+	responses map[responseCacheKey]cachedResponse
+	// Entries in the order they expire
+	entries []responseCacheEntry
+}
+
+// Get returns the response sent to the request of the peer, if the request is a retransmission of the answered one.
+func (cache *responseCache) Get(peer string, request message.Message, payload []byte) (message.Message, bool) {
+	cache.expire(time.Now())
+	cached, ok := cache.responses[newResponseCacheKey(peer, request)]
+	if !ok || cached.digest != sha256.Sum256(payload) {
+		return nil, false
+	}
+	return cached.response, true
+}
+
+func (cache *responseCache) Put(peer string, request message.Message, payload []byte, response message.Message) {
+	if cache.responses == nil {
+		cache.responses = map[responseCacheKey]cachedResponse{}
+	}
+	key := newResponseCacheKey(peer, request)
+	expires := time.Now().Add(responseCacheExpiry())
+	cache.responses[key] = cachedResponse{response: response, digest: sha256.Sum256(payload), expires: expires}
+	cache.entries = append(cache.entries, responseCacheEntry{key: key, expires: expires})
+}
+
+func (cache *responseCache) expire(now time.Time) {
+	expired := 0
+	for ; expired < len(cache.entries) && !now.Before(cache.entries[expired].expires); expired++ {
+		key := cache.entries[expired].key
+		// The sequence number may have been reused by a later request of the peer
+		if cached, ok := cache.responses[key]; ok && !now.Before(cached.expires) {
+			delete(cache.responses, key)
+		}
+	}
+	cache.entries = cache.entries[expired:]
+}
+
+// isPfcpRequest reports whether the message type is a request the peer retransmits until answered.
+func isPfcpRequest(messageType uint8) bool {
+	switch messageType {
+	case message.MsgTypeHeartbeatRequest,
+		message.MsgTypePFDManagementRequest,
+		message.MsgTypeAssociationSetupRequest,
+		message.MsgTypeAssociationUpdateRequest,
+		message.MsgTypeAssociationReleaseRequest,
+		message.MsgTypeNodeReportRequest,
+		message.MsgTypeSessionSetDeletionRequest,
+		message.MsgTypeSessionEstablishmentRequest,
+		message.MsgTypeSessionModificationRequest,
+		message.MsgTypeSessionDeletionRequest,
+		message.MsgTypeSessionReportRequest:
+		return true
+	}
+	return false
+}
@@ -27,21 +27,23 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 		return message.NewSessionEstablishmentResponse(0, 0, 0, req.Sequence(), 0, newIeNodeID(conn.nodeId), convertErrorToIeCause(err)), nil
 	}
 
-	association, ok := conn.NodeAssociations[addr]
+	remoteNodeID, _ := req.NodeID.NodeID()
+	association, ok := conn.NodeAssociations[remoteNodeID]
 	if !ok {
 		log.Warn().Msgf("Rejecting Session Establishment Request from: %s (no association)", addr)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
 		return message.NewSessionEstablishmentResponse(0, 0, 0, req.Sequence(), 0, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseNoEstablishedPFCPAssociation)), nil
 	}
+	association.SetAddr(addr)
 
-	localSEID := association.NewLocalSEID()
+	localSEID := conn.sessions.NewLocalSEID()
 
 	session := NewSession(localSEID, remoteSEID.SEID)
+	session.SetCpFSEID(remoteSEID)
 
 	printSessionEstablishmentRequest(req)
-	// #TODO: Implement rollback on error
 	createdPDRs := []SPDRInfo{}
-	pdrContext := NewPDRCreationContext(session, conn.ResourceManager)
+	pdrContext := NewPDRCreationContext(session, conn.ResourceManager, conn.applicationPfds)
 
 	err = func() error {
 		mapOperations := conn.mapOperations
@@ -79,15 +81,18 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 		}
 
 		for _, urr := range req.CreateURR {
-			urrInfo := ebpf.UrrInfo{}
+			sUrrInfo := SUrrInfo{StartTime: time.Now()}
 			urrId, err := urr.URRID()
 			if err != nil {
 				return fmt.Errorf("URR ID missing")
 			}
-			updateUrr(&urrInfo, urr)
-			log.Info().Msgf("Saving URR info to session: %d, %+v", urrId, urrInfo)
-			if internalId, err := mapOperations.NewUrr(urrInfo); err == nil {
-				session.NewUrr(urrId, internalId, urrInfo)
+			if err := updateUrr(&sUrrInfo, urr, session); err != nil {
+				log.Warn().Err(err).Msg("Error extracting URR info")
+				return err
+			}
+			log.Info().Msgf("Saving URR info to session: %d, %+v", urrId, sUrrInfo)
+			if internalId, err := mapOperations.NewUrr(sUrrInfo.UrrInfo); err == nil {
+				session.NewUrr(urrId, internalId, sUrrInfo)
 			} else {
 				log.Error().Err(err).Msg("Can't put URR")
 				return err
@@ -104,8 +109,9 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 			spdrInfo := SPDRInfo{PdrID: uint32(pdrId)}
 
 			if err := pdrContext.extractPDR(pdr, &spdrInfo); err == nil {
-				session.PutPDR(spdrInfo.PdrID, spdrInfo)
 				if err := applyPDR(spdrInfo, mapOperations); err == nil {
+					// Only applied PDRs are stored, so a rollback doesn't delete map entries it didn't write
+					session.PutPDR(spdrInfo.PdrID, spdrInfo)
 					createdPDRs = append(createdPDRs, spdrInfo)
 				} else {
 					return err
@@ -121,13 +127,25 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 
 	if err != nil {
 		log.Warn().Msgf("Rejecting Session Establishment Request from: %s (error in applying IEs)", err)
+		// Roll back the rules written so far and the TEIDs and UE IPs allocated to the session
+		conn.DeleteSession(session)
+		conn.ReleaseResources(localSEID)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRuleCreationModificationFailure)).Inc()
 		return message.NewSessionEstablishmentResponse(0, 0, remoteSEID.SEID, req.Sequence(), 0, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseRuleCreationModificationFailure)), nil
 	}
 
+	if req.FQCSID != nil {
+		if fqcsid, err := parseFQCSID(req.FQCSID); err == nil {
+			session.CpFQCSID = fqcsid
+		} else {
+			log.Warn().Msgf("Ignoring invalid FQ-CSID from: %s, %s", addr, err.Error())
+		}
+	}
+	conn.sessionSets.Add(association, session)
+
 	// Reassigning is the best I can think of for now
 	association.Sessions[localSEID] = session
-	conn.NodeAssociations[addr] = association
+	conn.sessions.Add(association, session)
 
 	additionalIEs := []*ie.IE{
 		newIeNodeID(conn.nodeId),
@@ -137,6 +155,7 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 
 	pdrIEs := processCreatedPDRs(createdPDRs, cloneIP(conn.n3Address))
 	additionalIEs = append(additionalIEs, pdrIEs...)
+	additionalIEs = append(additionalIEs, conn.loadControlIEs(association)...)
 
 	// Send SessionEstablishmentResponse
 	estResp := message.NewSessionEstablishmentResponse(0, 0, remoteSEID.SEID, req.Sequence(), 0, additionalIEs...)
@@ -148,23 +167,17 @@ func HandlePfcpSessionEstablishmentRequest(conn *PfcpConnection, msg message.Mes
 func HandlePfcpSessionDeletionRequest(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
 	req := msg.(*message.SessionDeletionRequest)
 	log.Info().Msgf("Got Session Deletion Request from: %s. \n", addr)
-	association, ok := conn.NodeAssociations[addr]
-	if !ok {
-		log.Warn().Msgf("Rejecting Session Deletion Request from: %s (no association)", addr)
-		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
-		return message.NewSessionDeletionResponse(0, 0, 0, req.Sequence(), 0, ie.NewCause(ie.CauseNoEstablishedPFCPAssociation)), nil
-	}
 	printSessionDeleteRequest(req)
 
-	session, ok := association.Sessions[req.SEID()]
-	if !ok {
+	association, _, session := conn.FindPeerSession(req.SEID(), addr, nil)
+	if session == nil {
 		log.Warn().Msgf("Rejecting Session Deletion Request from: %s (unknown SEID)", addr)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseSessionContextNotFound)).Inc()
 		return message.NewSessionDeletionResponse(0, 0, 0, req.Sequence(), 0, ie.NewCause(ie.CauseSessionContextNotFound)), nil
 	}
 	deletedURRs := make([]*ie.IE, 0, len(session.URRs))
 	mapOperations := conn.mapOperations
-	pdrContext := NewPDRCreationContext(session, conn.ResourceManager)
+	pdrContext := NewPDRCreationContext(session, conn.ResourceManager, conn.applicationPfds)
 	for _, pdrInfo := range session.PDRs {
 		if err := pdrContext.deletePDR(pdrInfo, mapOperations); err != nil {
 			PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRuleCreationModificationFailure)).Inc()
@@ -189,13 +202,8 @@ func HandlePfcpSessionDeletionRequest(conn *PfcpConnection, msg message.Message,
 			log.Error().Msgf("WARN: mapOperations failed to delete URR: %d, %s", id, err.Error())
 			continue
 		}
-		urr.ReportSeqNumber = urr.ReportSeqNumber + 1
 		deletedURRs = append(deletedURRs, ie.NewUsageReportWithinSessionDeletionResponse(
-			ie.NewURRID(id),
-			ie.NewURSEQN(urr.ReportSeqNumber),
-			ie.NewUsageReportTrigger([]uint8{0, 1 << 3, 0}...),
-			ie.NewEndTime(time.Now()),
-			ie.NewVolumeMeasurement(0x7, urrInfo.UplinkVolume+urrInfo.DownlinkVolume, urrInfo.UplinkVolume, urrInfo.DownlinkVolume, 0, 0, 0),
+			urr.newUsageReport(id, usageReportTriggerTERMR, urrInfo, time.Now())...,
 		))
 	}
 
@@ -207,6 +215,8 @@ func HandlePfcpSessionDeletionRequest(conn *PfcpConnection, msg message.Message,
 	}
 
 	log.Info().Msgf("Deleting session: %d", req.SEID())
+	conn.sessions.Remove(req.SEID())
+	conn.sessionSets.Remove(session)
 	delete(association.Sessions, req.SEID())
 
 	conn.ReleaseResources(req.SEID())
@@ -220,44 +230,25 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 	req := msg.(*message.SessionModificationRequest)
 	log.Info().Msgf("Got Session Modification Request from: %s. \n", addr)
 
-	log.Info().Msgf("Finding association for %s", addr)
-	association, ok := conn.NodeAssociations[addr]
-	if !ok {
-		log.Warn().Msgf("Rejecting Session Modification Request from: %s (no association)", addr)
-		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
-		return message.NewSessionModificationResponse(0, 0, req.SEID(), req.Sequence(), 0, ie.NewCause(ie.CauseNoEstablishedPFCPAssociation)), nil
-	}
-
 	log.Info().Msgf("Finding session %d", req.SEID())
-	session, ok := association.Sessions[req.SEID()]
-	if !ok {
+	association, sender, session := conn.FindPeerSession(req.SEID(), addr, req.NodeID)
+	if session == nil {
 		log.Warn().Msgf("Rejecting Session Modification Request from: %s (unknown SEID)", addr)
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseSessionContextNotFound)).Inc()
 		return message.NewSessionModificationResponse(0, 0, 0, req.Sequence(), 0, ie.NewCause(ie.CauseSessionContextNotFound)), nil
 	}
 
-	// This IE shall be present if the CP function decides to change its F-SEID for the PFCP session. The UP function
-	// shall use the new CP F-SEID for subsequent PFCP Session related messages for this PFCP Session
-	if req.CPFSEID != nil {
-		remoteSEID, err := req.CPFSEID.FSEID()
-		if err == nil {
-			session.RemoteSEID = remoteSEID.SEID
-
-			association.Sessions[req.SEID()] = session // FIXME
-			conn.NodeAssociations[addr] = association  // FIXME
-		}
-	}
-
 	printSessionModificationRequest(req)
 
-	// #TODO: Implement rollback on error
 	createdPDRs := []SPDRInfo{}
-	removedURRs := make([]*ie.IE, 0, len(req.RemoveURR))
-	pdrContext := NewPDRCreationContext(session, conn.ResourceManager)
+	pdrContext := NewPDRCreationContext(session, conn.ResourceManager, conn.applicationPfds)
+	modification := newSessionModification(conn, session)
+	pdrContext.OnAllocate = modification.Allocated
 
 	err := func() error {
 		mapOperations := conn.mapOperations
 
+		modification.Apply(ie.CreateFAR)
 		for _, far := range req.CreateFAR {
 			farInfo, err := composeFarInfo(far, ebpf.FarInfo{})
 			if err != nil {
@@ -269,18 +260,25 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 			log.Info().Msgf("Saving FAR info to session: %d, %+v", farid, farInfo)
 			if internalId, err := mapOperations.NewFar(farInfo); err == nil {
 				session.NewFar(farid, internalId, farInfo)
+				modification.Record(func() error { return mapOperations.DeleteFar(internalId) })
 			} else {
 				log.Error().Err(err).Msg("Can't put FAR")
 				return err
 			}
 		}
 
+		modification.Apply(ie.UpdateFAR)
 		for _, far := range req.UpdateFAR {
 			farid, err := far.FARID()
 			if err != nil {
 				return err
 			}
+			// An unknown FAR would be written to map entry 0 of another session
+			if _, ok := session.FARs[farid]; !ok {
+				return fmt.Errorf("FAR %d not found", farid)
+			}
 			sFarInfo := session.GetFar(farid)
+			previous := sFarInfo.FarInfo
 			sFarInfo.FarInfo, err = composeFarInfo(far, sFarInfo.FarInfo)
 			if err != nil {
 				log.Warn().Err(err).Msg("Error extracting FAR info")
@@ -292,18 +290,20 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 				log.Error().Err(err).Msg("Can't update FAR")
 				return err
 			}
+			modification.Record(func() error { return mapOperations.UpdateFar(sFarInfo.GlobalId, previous) })
+			modification.updatedFARs = append(modification.updatedFARs, farid)
 		}
 
+		modification.Apply(ie.RemoveFAR)
 		for _, far := range req.RemoveFAR {
 			farid, _ := far.FARID()
-			log.Info().Msgf("Removing FAR: %d", farid)
-			sFarInfo := session.RemoveFar(farid)
-			if err := mapOperations.DeleteFar(sFarInfo.GlobalId); err != nil {
-				log.Error().Err(err).Msg("Can't remove FAR")
-				return err
+			if _, ok := session.FARs[farid]; ok {
+				log.Info().Msgf("Removing FAR: %d", farid)
+				modification.removedFARs = append(modification.removedFARs, session.RemoveFar(farid))
 			}
 		}
 
+		modification.Apply(ie.CreateQER)
 		for _, qer := range req.CreateQER {
 			qerInfo := ebpf.QerInfo{}
 			qerId, err := qer.QERID()
@@ -314,18 +314,24 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 			log.Info().Msgf("Saving QER info to session: %d, %+v", qerId, qerInfo)
 			if internalId, err := mapOperations.NewQer(qerInfo); err == nil {
 				session.NewQer(qerId, internalId, qerInfo)
+				modification.Record(func() error { return mapOperations.DeleteQer(internalId) })
 			} else {
 				log.Error().Err(err).Msg("Can't put QER")
 				return err
 			}
 		}
 
+		modification.Apply(ie.UpdateQER)
 		for _, qer := range req.UpdateQER {
 			qerId, err := qer.QERID() // Probably will be used as ebpf map key
 			if err != nil {
 				return fmt.Errorf("QER ID missing")
 			}
+			if _, ok := session.QERs[qerId]; !ok {
+				return fmt.Errorf("QER %d not found", qerId)
+			}
 			sQerInfo := session.GetQer(qerId)
+			previous := sQerInfo.QerInfo
 			updateQer(&sQerInfo.QerInfo, qer)
 			log.Info().Msgf("Updating QER ID: %d, QER Info: %+v", qerId, sQerInfo)
 			session.UpdateQer(qerId, sQerInfo.QerInfo)
@@ -333,76 +339,82 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 				log.Error().Err(err).Msg("Can't update QER")
 				return err
 			}
+			modification.Record(func() error { return mapOperations.UpdateQer(sQerInfo.GlobalId, previous) })
 		}
 
+		modification.Apply(ie.RemoveQER)
 		for _, qer := range req.RemoveQER {
 			qerId, err := qer.QERID()
 			if err != nil {
 				return fmt.Errorf("QER ID missing")
 			}
-			log.Info().Msgf("Removing QER ID: %d", qerId)
-			sQerInfo := session.RemoveQer(qerId)
-			if err := mapOperations.DeleteQer(sQerInfo.GlobalId); err != nil {
-				log.Error().Err(err).Msg("Can't remove QER")
-				return err
+			if _, ok := session.QERs[qerId]; ok {
+				log.Info().Msgf("Removing QER ID: %d", qerId)
+				modification.removedQERs = append(modification.removedQERs, session.RemoveQer(qerId))
 			}
 		}
 
+		modification.Apply(ie.CreateURR)
 		for _, urr := range req.CreateURR {
-			urrInfo := ebpf.UrrInfo{}
+			sUrrInfo := SUrrInfo{StartTime: time.Now()}
 			urrId, err := urr.URRID()
 			if err != nil {
 				return fmt.Errorf("URR ID missing")
 			}
-			updateUrr(&urrInfo, urr)
-			log.Info().Msgf("Saving URR info to session: %d, %+v", urrId, urrInfo)
-			if internalId, err := mapOperations.NewUrr(urrInfo); err == nil {
-				session.NewUrr(urrId, internalId, urrInfo)
+			if err := updateUrr(&sUrrInfo, urr, session); err != nil {
+				log.Warn().Err(err).Msg("Error extracting URR info")
+				return err
+			}
+			log.Info().Msgf("Saving URR info to session: %d, %+v", urrId, sUrrInfo)
+			if internalId, err := mapOperations.NewUrr(sUrrInfo.UrrInfo); err == nil {
+				session.NewUrr(urrId, internalId, sUrrInfo)
+				modification.Record(func() error {
+					err, _ := mapOperations.DeleteUrr(internalId)
+					return err
+				})
 			} else {
 				log.Error().Err(err).Msg("Can't put URR")
 				return err
 			}
 		}
 
+		modification.Apply(ie.UpdateURR)
 		for _, urr := range req.UpdateURR {
 			urrId, err := urr.URRID()
 			if err != nil {
 				return fmt.Errorf("URR ID missing")
 			}
+			if _, ok := session.URRs[urrId]; !ok {
+				return fmt.Errorf("URR %d not found", urrId)
+			}
 			sUrrInfo := session.GetUrr(urrId)
-			updateUrr(&sUrrInfo.UrrInfo, urr)
+			previous := sUrrInfo.UrrInfo
+			if err := updateUrr(&sUrrInfo, urr, session); err != nil {
+				log.Warn().Err(err).Msg("Error extracting URR info")
+				return err
+			}
 			log.Info().Msgf("Updating URR ID: %d, URR Info: %+v", urrId, sUrrInfo)
-			session.UpdateUrr(urrId, sUrrInfo.UrrInfo)
+			session.UpdateUrr(urrId, sUrrInfo)
 			if err := mapOperations.UpdateUrr(sUrrInfo.GlobalId, sUrrInfo.UrrInfo); err != nil {
 				log.Error().Err(err).Msg("Can't update URR")
 				return err
 			}
+			modification.Record(func() error { return mapOperations.UpdateUrr(sUrrInfo.GlobalId, previous) })
 		}
 
+		modification.Apply(ie.RemoveURR)
 		for _, urr := range req.RemoveURR {
 			urrId, err := urr.URRID()
 			if err != nil {
 				return fmt.Errorf("URR ID missing")
 			}
-			log.Info().Msgf("Removing URR ID: %d", urrId)
-			sUrrInfo := session.RemoveUrr(urrId)
-
-			err, urrInfo := mapOperations.DeleteUrr(sUrrInfo.GlobalId)
-			if err != nil {
-				log.Error().Err(err).Msg("Can't remove URR")
-				return err
+			if _, ok := session.URRs[urrId]; ok {
+				log.Info().Msgf("Removing URR ID: %d", urrId)
+				modification.removedURRs = append(modification.removedURRs, removedURR{urrId: urrId, sUrrInfo: session.RemoveUrr(urrId)})
 			}
-
-			sUrrInfo.ReportSeqNumber = sUrrInfo.ReportSeqNumber + 1
-			removedURRs = append(removedURRs, ie.NewUsageReportWithinSessionModificationResponse(
-				ie.NewURRID(urrId),
-				ie.NewURSEQN(sUrrInfo.ReportSeqNumber),
-				ie.NewUsageReportTrigger([]uint8{0, 1 << 3, 0}...),
-				ie.NewEndTime(time.Now()),
-				ie.NewVolumeMeasurement(0x7, urrInfo.UplinkVolume+urrInfo.DownlinkVolume, urrInfo.UplinkVolume, urrInfo.DownlinkVolume, 0, 0, 0),
-			))
 		}
 
+		modification.Apply(ie.CreatePDR)
 		for _, pdr := range req.CreatePDR {
 			// PDR should be created last, because we need to reference FARs and QERs global id
 			pdrId, err := pdr.PDRID()
@@ -414,9 +426,10 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 			spdrInfo := SPDRInfo{PdrID: uint32(pdrId)}
 
 			if err := pdrContext.extractPDR(pdr, &spdrInfo); err == nil {
-				session.PutPDR(spdrInfo.PdrID, spdrInfo)
 				if err := applyPDR(spdrInfo, mapOperations); err == nil {
+					session.PutPDR(spdrInfo.PdrID, spdrInfo)
 					createdPDRs = append(createdPDRs, spdrInfo)
+					modification.Record(func() error { return removePDR(spdrInfo, mapOperations) })
 				} else {
 					return err
 				}
@@ -426,34 +439,57 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 			}
 		}
 
+		modification.Apply(ie.UpdatePDR)
 		for _, pdr := range req.UpdatePDR {
 			pdrId, err := pdr.PDRID()
 			if err != nil {
 				return fmt.Errorf("PDR ID missing")
 			}
+			// An unknown PDR would be created instead of updated
+			if _, ok := session.PDRs[uint32(pdrId)]; !ok {
+				return fmt.Errorf("PDR %d not found", pdrId)
+			}
 
-			spdrInfo := session.GetPDR(pdrId)
+			previous := session.GetPDR(pdrId)
+			spdrInfo := previous
 			if err := pdrContext.extractPDR(pdr, &spdrInfo); err == nil {
 				session.PutPDR(uint32(pdrId), spdrInfo)
 				if err := applyPDR(spdrInfo, mapOperations); err != nil {
 					return err
 				}
+				modification.Record(func() error {
+					if !samePDRKey(spdrInfo, previous) {
+						if err := removePDR(spdrInfo, mapOperations); err != nil {
+							return err
+						}
+					}
+					return applyPDR(previous, mapOperations)
+				})
+				// Other PDRs may share the previous key, so only the rule of this PDR is removed from it
+				if !samePDRKey(spdrInfo, previous) {
+					if err := removePDR(previous, mapOperations); err != nil {
+						return err
+					}
+				}
 			} else {
 				log.Warn().Err(err).Msg("Error extracting PDR info")
 				return err
 			}
 		}
 
+		modification.Apply(ie.RemovePDR)
 		for _, pdr := range req.RemovePDR {
 			pdrId, _ := pdr.PDRID()
 			if _, ok := session.PDRs[uint32(pdrId)]; ok {
 				log.Info().Msgf("Removing uplink PDR: %d", pdrId)
 				sPDRInfo := session.RemovePDR(uint32(pdrId))
 
-				if err := pdrContext.deletePDR(sPDRInfo, mapOperations); err != nil {
+				if err := removePDR(sPDRInfo, mapOperations); err != nil {
 					log.Error().Err(err).Msg("Failed to remove uplink PDR")
 					return err
 				}
+				modification.removedPDRs = append(modification.removedPDRs, sPDRInfo)
+				modification.Record(func() error { return applyPDR(sPDRInfo, mapOperations) })
 			}
 		}
 
@@ -461,11 +497,41 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 	}()
 	if err != nil {
 		log.Warn().Msgf("Rejecting Session Modification Request from: %s (failed to apply rules)", err)
+		modification.Rollback()
 		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRuleCreationModificationFailure)).Inc()
-		return message.NewSessionModificationResponse(0, 0, session.RemoteSEID, req.Sequence(), 0, ie.NewCause(ie.CauseRuleCreationModificationFailure)), nil
+		return message.NewSessionModificationResponse(0, 0, session.RemoteSEID, req.Sequence(), 0, ie.NewCause(ie.CauseRuleCreationModificationFailure), ie.NewOffendingIE(modification.offendingIE)), nil
+	}
+	usageReports := modification.Commit()
+	conn.flushDownlinkBuffer(session, modification.updatedFARs)
+
+	// Another SMF of the SMF set takes over the session, along with the new CP F-SEID below
+	if sender != association {
+		conn.takeOverSession(association, sender, session)
+		association = sender
+	}
+
+	// This IE shall be present if the CP function decides to change its F-SEID for the PFCP session. The UP function
+	// shall use the new CP F-SEID for subsequent PFCP Session related messages for this PFCP Session
+	if req.CPFSEID != nil {
+		remoteSEID, err := req.CPFSEID.FSEID()
+		if err == nil {
+			session.SetCpFSEID(remoteSEID)
+		}
+	}
+
+	if req.FQCSID != nil {
+		if fqcsid, err := parseFQCSID(req.FQCSID); err == nil {
+			conn.sessionSets.Remove(session)
+			session.CpFQCSID = fqcsid
+			conn.sessionSets.Add(association, session)
+		} else {
+			log.Warn().Msgf("Ignoring invalid FQ-CSID from: %s, %s", addr, err.Error())
+		}
 	}
 
 	association.Sessions[req.SEID()] = session
+	// Index the URRs created by the modification
+	conn.sessions.Add(association, session)
 
 	additionalIEs := []*ie.IE{
 		ie.NewCause(ie.CauseRequestAccepted),
@@ -473,9 +539,11 @@ func HandlePfcpSessionModificationRequest(conn *PfcpConnection, msg message.Mess
 
 	pdrIEs := processCreatedPDRs(createdPDRs, conn.n3Address)
 	additionalIEs = append(additionalIEs, pdrIEs...)
-	if len(removedURRs) != 0 {
-		additionalIEs = append(additionalIEs, removedURRs...)
+	usageReports = append(usageReports, queryUsageReports(session, req, conn.mapOperations, time.Now())...)
+	if len(usageReports) != 0 {
+		additionalIEs = append(additionalIEs, usageReports...)
 	}
+	additionalIEs = append(additionalIEs, conn.loadControlIEs(association)...)
 
 	// Send SessionEstablishmentResponse
 	modResp := message.NewSessionModificationResponse(0, 0, session.RemoteSEID, req.Sequence(), 0, additionalIEs...)
@@ -579,6 +647,9 @@ func composeFarInfo(far *ie.IE, farInfo ebpf.FarInfo) (ebpf.FarInfo, error) {
 		return ebpf.FarInfo{}, fmt.Errorf("unsupported IE type")
 	}
 	if err == nil {
+		if networkInstance, ok := parseNetworkInstance(forward); ok {
+			farInfo.NetworkInstance = networkInstance
+		}
 		outerHeaderCreationIndex := findIEindex(forward, 84) // IE Type Outer Header Creation
 		if outerHeaderCreationIndex == -1 {
 			log.Warn().Msg("No OuterHeaderCreation")
@@ -638,12 +709,59 @@ func GetTransportLevelMarking(far *ie.IE) (uint16, error) {
 	return 0, fmt.Errorf("no TransportLevelMarking found")
 }
 
-// TODO: add making or updating UrrInfo
-func updateUrr(urrInfo *ebpf.UrrInfo, urr *ie.IE) {
-
-	// if urr.HasVOLUM() {
-	// }
-
-	// if volumeThreshold, err := urr.VolumeThreshold(); err == nil {
-	// }
+func updateUrr(sUrrInfo *SUrrInfo, urr *ie.IE, session *Session) error {
+	measurementMethod, err := urr.MeasurementMethod()
+	if err == nil {
+		sUrrInfo.MeasurementMethod = measurementMethod
+	}
+	reportingTriggers, err := urr.ReportingTriggers()
+	if err == nil {
+		sUrrInfo.ReportingTriggers = composeTriggers(reportingTriggers)
+	}
+	volumeThreshold, err := urr.VolumeThreshold()
+	if err == nil {
+		sUrrInfo.VolumeThreshold = UrrVolume{
+			Flags:    volumeThreshold.Flags,
+			Total:    volumeThreshold.TotalVolume,
+			Uplink:   volumeThreshold.UplinkVolume,
+			Downlink: volumeThreshold.DownlinkVolume,
+		}
+	}
+	volumeQuota, err := urr.VolumeQuota()
+	if err == nil {
+		sUrrInfo.VolumeQuota = UrrVolume{
+			Flags:    volumeQuota.Flags,
+			Total:    volumeQuota.TotalVolume,
+			Uplink:   volumeQuota.UplinkVolume,
+			Downlink: volumeQuota.DownlinkVolume,
+		}
+		sUrrInfo.QuotaExhausted = false
+	}
+	timeThreshold, err := urr.TimeThreshold()
+	if err == nil {
+		sUrrInfo.TimeThreshold = timeThreshold
+	}
+	timeQuota, err := urr.TimeQuota()
+	if err == nil {
+		sUrrInfo.TimeQuota = timeQuota
+		sUrrInfo.TimeQuotaStart = time.Now()
+		sUrrInfo.TimeQuotaExhausted = false
+	}
+	measurementPeriod, err := urr.MeasurementPeriod()
+	if err == nil {
+		sUrrInfo.MeasurementPeriod = measurementPeriod
+		sUrrInfo.NextPeriodicReport = time.Now().Add(measurementPeriod)
+	}
+	// FAR ID for Quota Action
+	farId, err := urr.FARID()
+	if err == nil {
+		sFarInfo, ok := session.FARs[farId]
+		if !ok {
+			return fmt.Errorf("FAR ID for Quota Action not found: %d", farId)
+		}
+		sUrrInfo.UrrInfo.QuotaAction = ebpf.UrrQuotaActionApplyFar
+		sUrrInfo.UrrInfo.QuotaFarId = sFarInfo.GlobalId
+	}
+	sUrrInfo.updateVolumeLimits()
+	return nil
 }
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bytes"
+	"fmt"
 	"net"
 	"sync"
 	"testing"
@@ -68,7 +70,7 @@ func TestAssociationSetup(t *testing.T) {
 	if nodeId != "test-node" {
 		t.Errorf("Unexpected node ID in association setup response: %s", nodeId)
 	}
-	if _, ok := pfcpConn.NodeAssociations[remoteIP]; !ok {
+	if _, ok := pfcpConn.NodeAssociations["test"]; !ok {
 		t.Errorf("Association not created")
 	}
 }
@@ -100,6 +102,8 @@ func PreparePfcpConnectionWithMock(t *testing.T, ebpfMock ebpf.ForwardingPlaneCo
 		n3Address:        net.ParseIP("1.2.3.4"),
 		associationMutex: &sync.Mutex{},
 		featuresOctets:   featuresOctets,
+		applicationPfds:  ApplicationPfds{},
+		transactions:     newPfcpTransactions(),
 	}
 	asReq := message.NewAssociationSetupRequest(0,
 		ie.NewNodeID("", "", "test"),
@@ -124,7 +128,7 @@ func PreparePfcpConnectionWithMock(t *testing.T, ebpfMock ebpf.ForwardingPlaneCo
 	if nodeId != "test-node" {
 		t.Errorf("Unexpected node ID in association setup response: %s", nodeId)
 	}
-	if _, ok := pfcpConn.NodeAssociations[smfIP]; !ok {
+	if _, ok := pfcpConn.NodeAssociations["test"]; !ok {
 		t.Errorf("Association not created")
 	}
 
@@ -177,10 +181,10 @@ func SendDefaulMappingPdrs(t *testing.T, pfcpConn *PfcpConnection, smfIP string)
 	}
 
 	// Check that session PDRs are correct
-	if pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
+	if pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
 		t.Errorf("Session 1, got broken")
 	}
-	if pfcpConn.NodeAssociations[smfIP].Sessions[3].PDRs[1].Teid != 0 {
+	if pfcpConn.NodeAssociations["test"].Sessions[3].PDRs[1].Teid != 0 {
 		t.Errorf("Session 2, got broken")
 	}
 }
@@ -190,11 +194,11 @@ func TestSdfFilterStoreValid(t *testing.T) {
 	pfcpConn, smfIP := PreparePfcpConnection(t)
 	SendDefaulMappingPdrs(t, &pfcpConn, smfIP)
 
-	if len(pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs) != 1 {
+	if len(pfcpConn.NodeAssociations["test"].Sessions[2].PDRs) != 1 {
 		t.Errorf("Session 1, should have already stored 1 PDR")
 	}
 
-	if len(pfcpConn.NodeAssociations[smfIP].Sessions[3].PDRs) != 1 {
+	if len(pfcpConn.NodeAssociations["test"].Sessions[3].PDRs) != 1 {
 		t.Errorf("Session 2, should have already stored 1 PDR")
 	}
 
@@ -251,28 +255,112 @@ func TestSdfFilterStoreValid(t *testing.T) {
 	}
 
 	// Check that session PDRs are correct
-	if pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs[2].Ipv4.String() != "1.1.1.1" {
+	if pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2].Ipv4.String() != "1.1.1.1" {
 		t.Errorf("Session 1, got broken")
 	}
 
-	if pfcpConn.NodeAssociations[smfIP].Sessions[3].PDRs[2].Teid != 0 {
+	if pfcpConn.NodeAssociations["test"].Sessions[3].PDRs[2].Teid != 0 {
 		t.Errorf("Session 2, got broken")
 	}
 
 	// Check that SDF filter is stored inside session
-	pdrInfo := pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs[2].PdrInfo
-	err = CheckSdfFilterEquality(pdrInfo.SdfFilter, fd)
-	if err != nil {
-		t.Error(err.Error())
+	for _, seid := range []uint64{2, 3} {
+		pdrInfo := pfcpConn.NodeAssociations["test"].Sessions[seid].PDRs[2].PdrInfo
+		if len(pdrInfo.SdfFilters) != 1 {
+			t.Fatalf("Unexpected SDF filter count: %d", len(pdrInfo.SdfFilters))
+		}
+		err = CheckSdfFilterEquality(&pdrInfo.SdfFilters[0], fd)
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}
+
+	// TODO: Check that FAR and QER are successfully stored in PDR with SDF
+}
+
+func TestMultipleSdfFiltersPerPdr(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	SendDefaulMappingPdrs(t, &pfcpConn, smfIP)
+
+	newModificationRequest := func(sequence uint32) *message.SessionModificationRequest {
+		return message.NewSessionModificationRequest(0, 0, 2, sequence, 0,
+			ie.NewCreatePDR(
+				ie.NewPDRID(2),
+				ie.NewPDI(
+					ie.NewSourceInterface(ie.SrcInterfaceCore),
+					ie.NewUEIPAddress(2, "1.1.1.1", "", 0, 0),
+					ie.NewSDFFilter("permit out ip from 8.8.8.8/32 to assigned", "", "", "", 1),
+					ie.NewSDFFilter("permit out udp from 9.9.9.9/32 53 to assigned", "", "", "", 2),
+				),
+			),
+		)
+	}
+
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, newModificationRequest(1), smfIP); err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	sdfFilters := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2].PdrInfo.SdfFilters
+	if len(sdfFilters) != 2 {
+		t.Fatalf("Unexpected SDF filter count: %d", len(sdfFilters))
+	}
+	if sdfFilters[1].Protocol != 3 || sdfFilters[1].SrcPortRange.LowerBound != 53 {
+		t.Errorf("Unexpected second SDF filter: %s", sdfFilters[1].String())
 	}
 
-	pdrInfo = pfcpConn.NodeAssociations[smfIP].Sessions[3].PDRs[2].PdrInfo
-	err = CheckSdfFilterEquality(pdrInfo.SdfFilter, fd)
+	// PDRs with more filters than the limit are rejected
+	config.Conf.MaxSdfFilters = 1
+	defer func() { config.Conf.MaxSdfFilters = 0 }()
+	delete(pfcpConn.NodeAssociations["test"].Sessions[2].PDRs, 2)
+	response, err := HandlePfcpSessionModificationRequest(&pfcpConn, newModificationRequest(2), smfIP)
 	if err != nil {
-		t.Error(err.Error())
+		t.Errorf("Error handling session modification request: %s", err)
 	}
+	modRes := response.(*message.SessionModificationResponse)
+	if cause, _ := modRes.Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("Unexpected cause: %d", cause)
+	}
+	if _, ok := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2]; ok {
+		t.Errorf("PDR exceeding the SDF filter limit stored")
+	}
+}
 
-	// TODO: Check that FAR and QER are successfully stored in PDR with SDF
+func TestSdfFilterToSSpiAndFlowLabel(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	SendDefaulMappingPdrs(t, &pfcpConn, smfIP)
+
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 1, 0,
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(2, "1.1.1.1", "", 0, 0),
+				// DSCP EF with the ECN bits masked out
+				ie.NewSDFFilter("permit out udp from 8.8.8.8/32 to assigned", "\xb8\xfc", "", "\x01\x23\x45", 1),
+				// IPsec SA of any flow
+				ie.NewSDFFilter("", "", "\x00\x00\x10\x01", "", 2),
+			),
+		),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP); err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	sdfFilters := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2].PdrInfo.SdfFilters
+	if len(sdfFilters) != 2 {
+		t.Fatalf("Unexpected SDF filter count: %d", len(sdfFilters))
+	}
+	if sdfFilters[0].MatchFlags != ebpf.SdfMatchToSTrafficClass|ebpf.SdfMatchFlowLabel ||
+		sdfFilters[0].ToSTrafficClass != 0xb8 || sdfFilters[0].ToSTrafficClassMask != 0xfc || sdfFilters[0].FlowLabel != 0x12345 {
+		t.Errorf("Unexpected ToS/Traffic Class and Flow Label: %s", sdfFilters[0].String())
+	}
+	if sdfFilters[0].Protocol != 3 {
+		t.Errorf("Flow description of the first SDF filter is lost: %s", sdfFilters[0].String())
+	}
+	if sdfFilters[1].MatchFlags != ebpf.SdfMatchSecurityParameterIndex || sdfFilters[1].SecurityParameterIndex != 0x1001 {
+		t.Errorf("Unexpected SPI: %s", sdfFilters[1].String())
+	}
+	if sdfFilters[1].Protocol != 1 || sdfFilters[1].SrcAddress.Type != 0 || sdfFilters[1].DstPortRange.UpperBound != 65535 {
+		t.Errorf("SDF filter without flow description should match any flow: %s", sdfFilters[1].String())
+	}
 }
 
 func TestSdfFilterStoreInvalid(t *testing.T) {
@@ -280,7 +368,7 @@ func TestSdfFilterStoreInvalid(t *testing.T) {
 	pfcpConn, smfIP := PreparePfcpConnection(t)
 	SendDefaulMappingPdrs(t, &pfcpConn, smfIP)
 
-	if len(pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs) != 1 {
+	if len(pfcpConn.NodeAssociations["test"].Sessions[2].PDRs) != 1 {
 		t.Errorf("Session 1, should have already stored 1 PDR")
 	}
 
@@ -308,7 +396,7 @@ func TestSdfFilterStoreInvalid(t *testing.T) {
 	}
 
 	// Check that session PDR wasn't stored? Now it is, just without SDF.
-	if pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs[2].PdrInfo.SdfFilter != nil {
+	if len(pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2].PdrInfo.SdfFilters) != 0 {
 		t.Errorf("Bad SDF shouldn't be stored")
 	}
 }
@@ -514,6 +602,73 @@ func TestIPAllocationInSessionEstablishmentResponse(t *testing.T) {
 	}
 }
 
+func TestRecoveryTimeStampStoredFromAssociationSetupResponse(t *testing.T) {
+	pfcpConn, _ := PreparePfcpConnection(t)
+	recoveryTimeStamp := time.Unix(1700000000, 0)
+	asRes := message.NewAssociationSetupResponse(1,
+		ie.NewNodeID("", "", "smf"),
+		ie.NewCause(ie.CauseRequestAccepted),
+		ie.NewRecoveryTimeStamp(recoveryTimeStamp),
+		ie.NewCPFunctionFeatures(0),
+	)
+	if _, err := HandlePfcpAssociationSetupResponse(&pfcpConn, asRes, "127.0.0.3"); err != nil {
+		t.Errorf("Error handling association setup response: %s", err)
+	}
+	association := pfcpConn.NodeAssociations["smf"]
+	if association == nil {
+		t.Fatalf("Association not saved")
+	}
+	if !association.RecoveryTimeStamp.Equal(recoveryTimeStamp) {
+		t.Errorf("Unexpected Recovery Time Stamp: %s", association.RecoveryTimeStamp)
+	}
+}
+
+func TestSessionsPurgedOnRestartInAssociationSetupResponse(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	ip1, _ := net.ResolveIPAddr("ip", "1.1.1.1")
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewFTEID(0, 0, ip1.IP, nil, 0),
+			),
+		),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	if pfcpConn.GetSessionCount() != 1 {
+		t.Fatalf("Session not established")
+	}
+
+	asRes := message.NewAssociationSetupResponse(1,
+		ie.NewNodeID("", "", "test"),
+		ie.NewCause(ie.CauseRequestAccepted),
+		ie.NewRecoveryTimeStamp(time.Now().Add(time.Hour)),
+		ie.NewCPFunctionFeatures(0),
+	)
+	if _, err := HandlePfcpAssociationSetupResponse(&pfcpConn, asRes, smfIP); err != nil {
+		t.Errorf("Error handling association setup response: %s", err)
+	}
+	if pfcpConn.GetSessionCount() != 0 {
+		t.Errorf("Sessions of the restarted CP function are kept")
+	}
+}
+
+func TestHeartbeatFailsOnUnresolvableAddress(t *testing.T) {
+	pfcpConn, _ := PreparePfcpConnection(t)
+	failed := false
+	// The port appended to an IPv6 address without brackets can't be resolved
+	SendHeartbeatRequest(&pfcpConn, "::1", func() { failed = true })
+	if !failed {
+		t.Errorf("Heartbeat not failed")
+	}
+}
+
 func TestUEIPInAssociationSetupResponse(t *testing.T) {
 
 	config.Conf = config.UpfConfig{
@@ -573,7 +728,7 @@ func TestHandlePfcpSessionEstablishmentRequestWithURR(t *testing.T) {
 		t.Errorf("Error handling session establishment request: %s", err)
 	}
 
-	if _, exists := pfcpConn.NodeAssociations[smfIP].Sessions[2].URRs[0xf]; !exists {
+	if _, exists := pfcpConn.NodeAssociations["test"].Sessions[2].URRs[0xf]; !exists {
 		t.Errorf("URR wasn't stored")
 	}
 }
@@ -609,7 +764,7 @@ func TestHandlePfcpSessionModificationRequestWithURR(t *testing.T) {
 		t.Errorf("Error handling session modification request: %s", err)
 	}
 
-	if _, exists := pfcpConn.NodeAssociations[smfIP].Sessions[2].URRs[0xf]; !exists {
+	if _, exists := pfcpConn.NodeAssociations["test"].Sessions[2].URRs[0xf]; !exists {
 		t.Errorf("URR wasn't stored")
 	}
 
@@ -624,7 +779,7 @@ func TestHandlePfcpSessionModificationRequestWithURR(t *testing.T) {
 	// if err != nil {
 	// 	t.Errorf("Error handling session modification request: %s", err)
 	// }
-	// if pfcpConn.NodeAssociations[smfIP].Sessions[2].URRs[0xf].UrrInfo.MeasurementMethod != ?  {
+	// if pfcpConn.NodeAssociations["test"].Sessions[2].URRs[0xf].UrrInfo.MeasurementMethod != ?  {
 	// 	t.Errorf("URR wasn't updated")
 	// }
 
@@ -677,7 +832,7 @@ func TestHandlePfcpSessionModificationRequestWithURR(t *testing.T) {
 		t.Errorf("TotalVolume equals %d", vol.TotalVolume)
 	}
 
-	if _, exists := pfcpConn.NodeAssociations[smfIP].Sessions[2].URRs[0xf]; exists {
+	if _, exists := pfcpConn.NodeAssociations["test"].Sessions[2].URRs[0xf]; exists {
 		t.Errorf("URR wasn't removed")
 	}
 }
@@ -752,3 +907,1870 @@ func TestHandlePfcpSessionDeletionRequestWithURR(t *testing.T) {
 		t.Errorf("TotalVolume equals %d", vol.TotalVolume)
 	}
 }
+
+func TestQueryURRInSessionModification(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(ie.NewURRID(1)),
+		ie.NewCreateURR(ie.NewURRID(2)),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+
+	ebpfMock.urr.UplinkVolume = 100
+	ebpfMock.urr.DownlinkVolume = 200
+	modReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewQueryURR(ie.NewURRID(1)),
+		ie.NewQueryURRReference(7),
+	)
+	msg, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	modRes := msg.(*message.SessionModificationResponse)
+	if len(modRes.UsageReport) != 1 {
+		t.Fatalf("Unexpected Usage Report count: %d", len(modRes.UsageReport))
+	}
+	ur := modRes.UsageReport[0]
+	if urrID, _ := ur.URRID(); urrID != 1 {
+		t.Errorf("Unexpected URR ID: %d", urrID)
+	}
+	if trigger, _ := ur.UsageReportTrigger(); len(trigger) == 0 || uint32(trigger[0])&usageReportTriggerIMMER == 0 {
+		t.Errorf("Usage Report Trigger without IMMER: %v", trigger)
+	}
+	if reference, _ := ur.QueryURRReference(); reference != 7 {
+		t.Errorf("Unexpected Query URR Reference: %d", reference)
+	}
+	if vol, _ := ur.VolumeMeasurement(); vol.TotalVolume != 300 {
+		t.Errorf("Unexpected total volume: %d", vol.TotalVolume)
+	}
+	if _, ok := pfcpConn.NodeAssociations["test"].Sessions[2].URRs[1]; !ok {
+		t.Errorf("Queried URR removed")
+	}
+
+	// All URRs report the volume measured since their last report
+	ebpfMock.urr.UplinkVolume = 150
+	modReq = message.NewSessionModificationRequest(0, 0, 2, 3, 0,
+		ie.NewPFCPSMReqFlags(0x04), // QAURR
+	)
+	msg, err = HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	modRes = msg.(*message.SessionModificationResponse)
+	if len(modRes.UsageReport) != 2 {
+		t.Fatalf("Unexpected Usage Report count: %d", len(modRes.UsageReport))
+	}
+	for _, ur := range modRes.UsageReport {
+		urrID, _ := ur.URRID()
+		expected := uint64(350)
+		if urrID == 1 {
+			expected = 50
+		}
+		if vol, _ := ur.VolumeMeasurement(); vol.TotalVolume != expected {
+			t.Errorf("Unexpected total volume of URR %d: %d, expected %d", urrID, vol.TotalVolume, expected)
+		}
+	}
+}
+
+func TestUsageReportOnVolumeThresholdAndQuota(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(
+			ie.NewURRID(0xf),
+			ie.NewMeasurementMethod(0, 1, 0),
+			ie.NewReportingTriggers(1<<1, 0),
+			ie.NewVolumeThreshold(0x1, 1000, 0, 0),
+			ie.NewVolumeQuota(0x1, 2500, 0, 0),
+		),
+	)
+	_, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+
+	ebpfMock.urr.UplinkVolume = 300
+	ebpfMock.urr.DownlinkVolume = 300
+	if usageReports := collectUsageReports(session, ebpfMock, time.Now()); len(usageReports) != 0 {
+		t.Errorf("Unexpected usage report below volume threshold")
+	}
+
+	ebpfMock.urr.DownlinkVolume = 900
+	usageReports := collectUsageReports(session, ebpfMock, time.Now())
+	if len(usageReports) != 1 {
+		t.Fatalf("Expected one usage report, got %d", len(usageReports))
+	}
+	if !usageReports[0].HasVOLTH() || usageReports[0].HasVOLQU() {
+		t.Errorf("Unexpected usage report trigger")
+	}
+	vol, _ := usageReports[0].VolumeMeasurement()
+	if vol.TotalVolume != 1200 || vol.UplinkVolume != 300 || vol.DownlinkVolume != 900 {
+		t.Errorf("Unexpected volume measurement: %+v", vol)
+	}
+
+	// Only the volume measured since the previous report counts against the threshold, the quota keeps counting
+	ebpfMock.urr.UplinkVolume = 1600
+	usageReports = collectUsageReports(session, ebpfMock, time.Now())
+	if len(usageReports) != 1 || !usageReports[0].HasVOLTH() || !usageReports[0].HasVOLQU() {
+		t.Fatalf("Expected usage report for volume threshold and quota")
+	}
+	seqn, _ := usageReports[0].URSEQN()
+	if seqn != 2 {
+		t.Errorf("Unexpected UR-SEQN: %d", seqn)
+	}
+
+	urrInfo := session.URRs[0xf].UrrInfo
+	if urrInfo.Status&ebpf.UrrStatusQuotaExhausted == 0 {
+		t.Errorf("Exhausted quota isn't enforced by the datapath")
+	}
+	if urrInfo.VolumeFlags != ebpf.UrrTotalThreshold|ebpf.UrrTotalQuota || urrInfo.TotalThreshold != 3500 {
+		t.Errorf("Unexpected datapath volume limits: %+v", urrInfo)
+	}
+
+	ebpfMock.urr.UplinkVolume = 1700
+	if usageReports := collectUsageReports(session, ebpfMock, time.Now()); len(usageReports) != 0 {
+		t.Errorf("Exhausted quota reported twice")
+	}
+}
+
+func TestUsageKeptWhenReportCannotBeSent(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(
+			ie.NewURRID(1),
+			ie.NewMeasurementMethod(0, 1, 0),
+			ie.NewReportingTriggers(1<<1, 0),
+			ie.NewVolumeThreshold(0x1, 1000, 0, 0),
+			ie.NewVolumeQuota(0x1, 2500, 0, 0),
+		),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	association := pfcpConn.NodeAssociations["test"]
+	session := association.Sessions[2]
+	ebpfMock.urr.DownlinkVolume = 1200
+
+	// The report fails to be sent from the closed socket
+	_ = udpConn.Close()
+	pfcpConn.reportSessionUsage(association, session, time.Now())
+	sUrrInfo := session.URRs[1]
+	if sUrrInfo.ReportSeqNumber != 0 || sUrrInfo.ReportedVolume.Total != 0 || sUrrInfo.VolumeQuota.Total != 2500 {
+		t.Errorf("Usage of the unsent report is lost: %+v", sUrrInfo)
+	}
+	if len(pfcpConn.transactions.outstanding) != 0 {
+		t.Errorf("Unsent report is retransmitted")
+	}
+
+	udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+	pfcpConn.reportSessionUsage(association, session, time.Now())
+	if sUrrInfo := session.URRs[1]; sUrrInfo.ReportSeqNumber != 1 || sUrrInfo.ReportedVolume.Total != 1200 {
+		t.Errorf("Usage isn't reported once the report can be sent: %+v", sUrrInfo)
+	}
+}
+
+func TestUsageReportedAgainWhenReportIsUnanswered(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	pfcpConn.reportTimeoutC = make(chan sessionReport)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+	config.Conf.PfcpRequestTimeout = 1
+	defer func() { config.Conf.PfcpRequestTimeout = 0 }()
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(
+			ie.NewURRID(1),
+			ie.NewMeasurementMethod(0, 1, 0),
+			ie.NewReportingTriggers(1<<1, 0),
+			ie.NewVolumeThreshold(0x1, 1000, 0, 0),
+		),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	association := pfcpConn.NodeAssociations["test"]
+	session := association.Sessions[2]
+	ebpfMock.urr.DownlinkVolume = 1200
+	pfcpConn.reportSessionUsage(association, session, time.Now())
+
+	// The CP function never answers, so the report times out after T1
+	var report sessionReport
+	select {
+	case report = <-pfcpConn.reportTimeoutC:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Unanswered session report didn't time out")
+	}
+	if report.seid != 2 || len(report.usageReports) != 1 {
+		t.Fatalf("Unexpected unanswered session report: %+v", report)
+	}
+	if pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeSessionReportRequest) {
+		t.Errorf("Unanswered session report still outstanding")
+	}
+
+	pfcpConn.HandleSessionReportTimeout(report)
+	if !pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeSessionReportRequest) {
+		t.Errorf("Usage of the unanswered session report isn't reported again")
+	}
+	for key, transaction := range pfcpConn.transactions.outstanding {
+		srreq := transaction.request.(*message.SessionReportRequest)
+		if len(srreq.UsageReport) != 1 || !bytes.Equal(srreq.UsageReport[0].Payload, report.usageReports[0].Payload) {
+			t.Errorf("Unexpected usage reports sent again: %+v", srreq.UsageReport)
+		}
+		pfcpConn.transactions.Cancel(key.peer, key.sequence)
+	}
+}
+
+func TestUrrQuotaAction(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateFAR(
+			ie.NewFARID(2),
+			ie.NewApplyAction(1),
+		),
+		ie.NewCreateURR(
+			ie.NewURRID(0xf),
+			ie.NewVolumeQuota(0x1, 2500, 0, 0),
+			ie.NewFARID(2),
+		),
+	)
+	_, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	if pfcpConn.NodeAssociations["test"].Sessions[2].URRs[0xf].UrrInfo.QuotaAction != ebpf.UrrQuotaActionApplyFar {
+		t.Errorf("FAR ID for Quota Action wasn't stored")
+	}
+
+	modReq := message.NewSessionModificationRequest(0, 0, 2, 1, 0,
+		ie.NewUpdateURR(
+			ie.NewURRID(0xf),
+			ie.NewFARID(3),
+		),
+	)
+	msg, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	cause, _ := msg.(*message.SessionModificationResponse).Cause.Cause()
+	if cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("URR with unknown FAR ID for Quota Action accepted")
+	}
+}
+
+func TestSessionReportResponseSessionContextNotFound(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	_, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+
+	srRes := message.NewSessionReportResponse(0, 0, 2, 1, 0, ie.NewCause(ie.CauseSessionContextNotFound))
+	if _, err := HandlePfcpSessionReportResponse(&pfcpConn, srRes, smfIP); err != nil {
+		t.Errorf("Error handling session report response: %s", err)
+	}
+	if _, exists := pfcpConn.NodeAssociations["test"].Sessions[2]; exists {
+		t.Errorf("Session unknown to the CP function wasn't deleted")
+	}
+}
+
+func TestUsageReportOnTimeThresholdAndQuota(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(
+			ie.NewURRID(0xf),
+			ie.NewMeasurementMethod(0, 0, 1),
+			ie.NewReportingTriggers(1<<2, 0),
+			ie.NewTimeThreshold(10*time.Second),
+			ie.NewTimeQuota(25*time.Second),
+		),
+	)
+	_, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+	start := session.URRs[0xf].StartTime
+
+	if usageReports := collectUsageReports(session, ebpfMock, start.Add(5*time.Second)); len(usageReports) != 0 {
+		t.Errorf("Unexpected usage report below time threshold")
+	}
+
+	usageReports := collectUsageReports(session, ebpfMock, start.Add(12*time.Second))
+	if len(usageReports) != 1 || !usageReports[0].HasTIMTH() {
+		t.Fatalf("Expected usage report for time threshold")
+	}
+	if _, err := usageReports[0].VolumeMeasurement(); err == nil {
+		t.Errorf("Unexpected volume measurement for duration only URR")
+	}
+	startTime, _ := usageReports[0].StartTime()
+	endTime, _ := usageReports[0].EndTime()
+	duration, _ := usageReports[0].DurationMeasurement()
+	if !startTime.Equal(start.Truncate(time.Second)) || duration != 12*time.Second || endTime.Sub(startTime) != duration {
+		t.Errorf("Unexpected measurement period: %s - %s, duration %s", startTime, endTime, duration)
+	}
+
+	usageReports = collectUsageReports(session, ebpfMock, start.Add(26*time.Second))
+	if len(usageReports) != 1 || !usageReports[0].HasTIMTH() || !usageReports[0].HasTIMQU() {
+		t.Fatalf("Expected usage report for time threshold and quota")
+	}
+	if session.URRs[0xf].UrrInfo.Status&ebpf.UrrStatusQuotaExhausted == 0 {
+		t.Errorf("Exhausted time quota isn't enforced by the datapath")
+	}
+}
+
+func TestPeriodicUsageReport(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateURR(
+			ie.NewURRID(0xf),
+			ie.NewMeasurementMethod(0, 1, 1),
+			ie.NewReportingTriggers(1<<0, 0),
+			ie.NewMeasurementPeriod(10*time.Second),
+		),
+	)
+	_, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+	start := session.URRs[0xf].NextPeriodicReport.Add(-10 * time.Second)
+
+	if usageReports := collectUsageReports(session, ebpfMock, start.Add(5*time.Second)); len(usageReports) != 0 {
+		t.Errorf("Unexpected usage report before the end of measurement period")
+	}
+
+	ebpfMock.urr.UplinkVolume = 100
+	ebpfMock.urr.DownlinkVolume = 200
+	usageReports := collectUsageReports(session, ebpfMock, start.Add(10*time.Second))
+	if len(usageReports) != 1 || !usageReports[0].HasPERIO() {
+		t.Fatalf("Expected periodic usage report")
+	}
+	vol, _ := usageReports[0].VolumeMeasurement()
+	if vol.TotalVolume != 300 {
+		t.Errorf("Unexpected volume measurement: %+v", vol)
+	}
+
+	if usageReports := collectUsageReports(session, ebpfMock, start.Add(15*time.Second)); len(usageReports) != 0 {
+		t.Errorf("Unexpected usage report before the end of measurement period")
+	}
+
+	ebpfMock.urr.DownlinkVolume = 1200
+	usageReports = collectUsageReports(session, ebpfMock, start.Add(21*time.Second))
+	if len(usageReports) != 1 || !usageReports[0].HasPERIO() {
+		t.Fatalf("Expected periodic usage report")
+	}
+	vol, _ = usageReports[0].VolumeMeasurement()
+	if vol.TotalVolume != 1000 {
+		t.Errorf("Unexpected volume measurement: %+v", vol)
+	}
+	seqn, _ := usageReports[0].URSEQN()
+	if seqn != 2 {
+		t.Errorf("Unexpected UR-SEQN: %d", seqn)
+	}
+}
+
+func TestAssociationRelease(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+
+	arReq := message.NewAssociationReleaseRequest(0, ie.NewNodeID("", "", "test"))
+	response, err := HandlePfcpAssociationReleaseRequest(&pfcpConn, arReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling association release request: %s", err)
+	}
+	cause, err := response.(*message.AssociationReleaseResponse).Cause.Cause()
+	if err != nil {
+		t.Errorf("Error getting cause from association release response: %s", err)
+	}
+	if cause != ie.CauseRequestAccepted {
+		t.Errorf("Unexpected cause in association release response: %d", cause)
+	}
+	if _, ok := pfcpConn.NodeAssociations["test"]; ok {
+		t.Errorf("Association not released")
+	}
+	if pfcpConn.GetSessionCount() != 0 {
+		t.Errorf("Sessions of the released association not deleted")
+	}
+
+	response, err = HandlePfcpAssociationReleaseRequest(&pfcpConn, arReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling association release request: %s", err)
+	}
+	cause, err = response.(*message.AssociationReleaseResponse).Cause.Cause()
+	if err != nil {
+		t.Errorf("Error getting cause from association release response: %s", err)
+	}
+	if cause != ie.CauseNoEstablishedPFCPAssociation {
+		t.Errorf("Unexpected cause in association release response: %d", cause)
+	}
+}
+
+func TestSessionSetDeletion(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+
+	for seid, csid := range map[uint64]uint16{1: 10, 2: 20} {
+		estReq := message.NewSessionEstablishmentRequest(0, 0, seid, 1, 0,
+			ie.NewNodeID("", "", "test"),
+			ie.NewFSEID(seid, net.ParseIP(smfIP), nil),
+			ie.NewFQCSID(smfIP, csid),
+		)
+		if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+			t.Errorf("Error handling session establishment request: %s", err)
+		}
+	}
+	if pfcpConn.GetSessionCount() != 2 {
+		t.Fatalf("Unexpected session count: %d", pfcpConn.GetSessionCount())
+	}
+
+	ssdReq := message.NewSessionSetDeletionRequest(0, ie.NewNodeID("", "", "test"), ie.NewFQCSID(smfIP, 10))
+	response, err := HandlePfcpSessionSetDeletionRequest(&pfcpConn, ssdReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session set deletion request: %s", err)
+	}
+	cause, err := response.(*message.SessionSetDeletionResponse).Cause.Cause()
+	if err != nil {
+		t.Errorf("Error getting cause from session set deletion response: %s", err)
+	}
+	if cause != ie.CauseRequestAccepted {
+		t.Errorf("Unexpected cause in session set deletion response: %d", cause)
+	}
+	if pfcpConn.GetSessionCount() != 1 {
+		t.Errorf("Sessions of the FQ-CSID not deleted, session count: %d", pfcpConn.GetSessionCount())
+	}
+
+	ssdReq = message.NewSessionSetDeletionRequest(0, ie.NewNodeID("", "", "test"), nil)
+	if _, err := HandlePfcpSessionSetDeletionRequest(&pfcpConn, ssdReq, smfIP); err != nil {
+		t.Errorf("Error handling session set deletion request: %s", err)
+	}
+	if pfcpConn.GetSessionCount() != 0 {
+		t.Errorf("Sessions of the node not deleted, session count: %d", pfcpConn.GetSessionCount())
+	}
+	if len(pfcpConn.sessionSets.sessions) != 0 {
+		t.Errorf("Session set index not cleaned up")
+	}
+}
+
+func TestApplicationIdPdrResolvedFromPfds(t *testing.T) {
+	ebpfMock := &MapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	SendDefaulMappingPdrs(t, &pfcpConn, smfIP)
+
+	ip1, _ := net.ResolveIPAddr("ip", "1.1.1.1")
+	seReq := message.NewSessionModificationRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(2, ip1.IP.String(), "", 0, 0),
+				ie.NewApplicationID("zero-rated"),
+			),
+		),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	pdr := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2]
+	if pdr.ApplicationID != "zero-rated" || len(pdr.PdrInfo.SdfFilters) != 0 || pdr.isApplied() {
+		t.Errorf("PDR of application without PFDs shouldn't be applied: %+v", pdr)
+	}
+
+	pfdReq := message.NewPFDManagementRequest(0,
+		ie.NewApplicationIDsPFDs(
+			ie.NewApplicationID("zero-rated"),
+			ie.NewPFDContext(
+				ie.NewPFDContents("permit out ip from 8.8.8.8/32 to assigned", "", "", "", "", nil, nil, nil),
+			),
+		),
+	)
+	response, err := HandlePfcpPfdManagementRequest(&pfcpConn, pfdReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling PFD management request: %s", err)
+	}
+	cause, err := response.(*message.PFDManagementResponse).Cause.Cause()
+	if err != nil {
+		t.Errorf("Error getting cause from PFD management response: %s", err)
+	}
+	if cause != ie.CauseRequestAccepted {
+		t.Errorf("Unexpected cause in PFD management response: %d", cause)
+	}
+
+	pdr = pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2]
+	if len(pdr.PdrInfo.SdfFilters) == 0 || !pdr.isApplied() {
+		t.Fatalf("PDR of application not resolved: %+v", pdr)
+	}
+	if !pdr.PdrInfo.SdfFilters[0].SrcAddress.Ip.Equal(net.ParseIP("8.8.8.8")) {
+		t.Errorf("Unexpected SDF filter of application PDR: %s", pdr.PdrInfo.SdfFilters[0].String())
+	}
+
+	// Removing the PFDs removes the rule of the PDR from the datapath
+	pfdReq = message.NewPFDManagementRequest(0,
+		ie.NewApplicationIDsPFDs(ie.NewApplicationID("zero-rated")),
+	)
+	if _, err := HandlePfcpPfdManagementRequest(&pfcpConn, pfdReq, smfIP); err != nil {
+		t.Errorf("Error handling PFD management request: %s", err)
+	}
+	pdr = pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[2]
+	if pdr.isApplied() {
+		t.Errorf("PDR of application with removed PFDs still applied: %+v", pdr)
+	}
+	if len(ebpfMock.deletedDownlinkPdrs) != 1 || ebpfMock.deletedDownlinkPdrs[0] != 2 {
+		t.Errorf("Rule of PDR of application with removed PFDs not deleted: %v", ebpfMock.deletedDownlinkPdrs)
+	}
+
+	pfdReq = message.NewPFDManagementRequest(0,
+		ie.NewApplicationIDsPFDs(
+			ie.NewApplicationID("broken"),
+			ie.NewPFDContext(
+				ie.NewPFDContents("permit everything", "", "", "", "", nil, nil, nil),
+			),
+		),
+	)
+	response, err = HandlePfcpPfdManagementRequest(&pfcpConn, pfdReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling PFD management request: %s", err)
+	}
+	cause, _ = response.(*message.PFDManagementResponse).Cause.Cause()
+	if cause != ie.CauseMandatoryIEIncorrect {
+		t.Errorf("PFD with invalid flow description accepted")
+	}
+
+	// PFDs exceeding the SDF filter limit of a PDR are rejected rather than applied in part
+	flowDescriptions := make([]string, sdfFilterLimit()+1)
+	for i := range flowDescriptions {
+		flowDescriptions[i] = fmt.Sprintf("permit out ip from 8.8.8.%d to assigned", i)
+	}
+	pfdReq = message.NewPFDManagementRequest(0,
+		ie.NewApplicationIDsPFDs(
+			ie.NewApplicationID("zero-rated"),
+			ie.NewPFDContext(
+				ie.NewPFDContents(flowDescriptions[0], "", "", "", "", flowDescriptions[1:], nil, nil),
+			),
+		),
+	)
+	response, err = HandlePfcpPfdManagementRequest(&pfcpConn, pfdReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling PFD management request: %s", err)
+	}
+	cause, _ = response.(*message.PFDManagementResponse).Cause.Cause()
+	if cause != ie.CauseRequestRejected {
+		t.Errorf("PFDs exceeding the SDF filter limit accepted")
+	}
+	if _, ok := pfcpConn.applicationPfds["zero-rated"]; ok {
+		t.Errorf("PFDs exceeding the SDF filter limit provisioned")
+	}
+
+	// PDRs of such applications fail to be created
+	pfcpConn.applicationPfds["zero-rated"] = []PfdContents{{FlowDescriptions: flowDescriptions}}
+	seReq = message.NewSessionModificationRequest(0, 0,
+		2, 2, 0,
+		ie.NewCreatePDR(
+			ie.NewPDRID(3),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(2, ip1.IP.String(), "", 0, 0),
+				ie.NewApplicationID("zero-rated"),
+			),
+		),
+	)
+	response, err = HandlePfcpSessionModificationRequest(&pfcpConn, seReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionModificationResponse).Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("PDR exceeding the SDF filter limit created, cause: %d", cause)
+	}
+	if _, ok := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[3]; ok {
+		t.Errorf("PDR exceeding the SDF filter limit stored")
+	}
+}
+
+func TestLoadAndOverloadControlInformation(t *testing.T) {
+	ebpfMock := &MapOperationsMock{occupancy: 0.9}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	association := pfcpConn.NodeAssociations["test"]
+	association.SetCPFunctionFeatures(ie.NewCPFunctionFeatures(0x03))
+	if !association.LoadControl || !association.OverloadControl {
+		t.Fatalf("LOAD and OVRL features of CP function not stored")
+	}
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	response, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	estRes := response.(*message.SessionEstablishmentResponse)
+	if estRes.LoadControlInformation == nil || estRes.OverloadControlInformation == nil {
+		t.Fatalf("Load and Overload Control Information missing in session establishment response")
+	}
+	if metric, _ := estRes.LoadControlInformation.Metric(); metric != 90 {
+		t.Errorf("Unexpected load metric: %d", metric)
+	}
+	if metric, _ := estRes.OverloadControlInformation.Metric(); metric != 50 {
+		t.Errorf("Unexpected overload reduction metric: %d", metric)
+	}
+
+	// The end of overload is reported once
+	ebpfMock.occupancy = 0.1
+	for i := 0; i < 2; i++ {
+		modReq := message.NewSessionModificationRequest(0, 0, 2, 1, 0,
+			ie.NewNodeID("", "", "test"),
+		)
+		response, err = HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+		if err != nil {
+			t.Errorf("Error handling session modification request: %s", err)
+		}
+		modRes := response.(*message.SessionModificationResponse)
+		if metric, _ := modRes.LoadControlInformation.Metric(); metric != 10 {
+			t.Errorf("Unexpected load metric: %d", metric)
+		}
+		if i == 0 {
+			if modRes.OverloadControlInformation == nil {
+				t.Fatalf("End of overload not reported")
+			}
+			if metric, _ := modRes.OverloadControlInformation.Metric(); metric != 0 {
+				t.Errorf("Unexpected overload reduction metric: %d", metric)
+			}
+		} else if modRes.OverloadControlInformation != nil {
+			t.Errorf("Overload Control Information sent while not overloaded")
+		}
+	}
+}
+
+func TestSessionRetentionOnAssociationSetup(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+
+	for seid, cpIP := range map[uint64]string{1: "10.0.0.1", 2: "10.0.0.2"} {
+		estReq := message.NewSessionEstablishmentRequest(0, 0, seid, 1, 0,
+			ie.NewNodeID("", "", "test"),
+			ie.NewFSEID(seid, net.ParseIP(cpIP), nil),
+		)
+		if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+			t.Errorf("Error handling session establishment request: %s", err)
+		}
+	}
+	existing := pfcpConn.NodeAssociations["test"]
+
+	asReq := message.NewAssociationSetupRequest(0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewRecoveryTimeStamp(time.Now()),
+		ie.NewPFCPSessionRetentionInformation(ie.NewCPPFCPEntityIPAddress(net.ParseIP("10.0.0.1"), nil)),
+	)
+	if _, err := HandlePfcpAssociationSetupRequest(&pfcpConn, asReq, smfIP); err != nil {
+		t.Errorf("Error handling association setup request: %s", err)
+	}
+	association := pfcpConn.NodeAssociations["test"]
+	if association == existing {
+		t.Errorf("Association not replaced")
+	}
+	if len(association.Sessions) != 1 {
+		t.Fatalf("Unexpected retained session count: %d", len(association.Sessions))
+	}
+	for _, session := range association.Sessions {
+		if session.RemoteSEID != 1 {
+			t.Errorf("Unexpected retained session: %d", session.RemoteSEID)
+		}
+	}
+
+	// A restarted CP function not requesting retention loses its sessions
+	asReq = message.NewAssociationSetupRequest(0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewRecoveryTimeStamp(time.Now().Add(time.Minute)),
+	)
+	if _, err := HandlePfcpAssociationSetupRequest(&pfcpConn, asReq, smfIP); err != nil {
+		t.Errorf("Error handling association setup request: %s", err)
+	}
+	if pfcpConn.GetSessionCount() != 0 {
+		t.Errorf("Sessions of the restarted CP function not deleted")
+	}
+}
+
+func TestRetransmittedRequestAnsweredFromResponseCache(t *testing.T) {
+	config.Conf.PfcpRequestTimeout = 3
+	config.Conf.PfcpRequestRetries = 3
+	defer func() { config.Conf.PfcpRequestTimeout, config.Conf.PfcpRequestRetries = 0, 0 }()
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+	smfConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer smfConn.Close()
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 7, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	buf := make([]byte, estReq.MarshalLen())
+	if err := estReq.MarshalTo(buf); err != nil {
+		t.Fatalf("Error marshaling session establishment request: %s", err)
+	}
+
+	var responses [][]byte
+	for i := 0; i < 2; i++ {
+		if err := pfcpConn.pfcpHandlerMap.Handle(&pfcpConn, buf, smfConn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Errorf("Error handling session establishment request: %s", err)
+		}
+		response := make([]byte, 1500)
+		_ = smfConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := smfConn.ReadFromUDP(response)
+		if err != nil {
+			t.Fatalf("Error reading session establishment response: %s", err)
+		}
+		responses = append(responses, response[:n])
+	}
+
+	if pfcpConn.GetSessionCount() != 1 {
+		t.Errorf("Retransmitted request handled again, session count: %d", pfcpConn.GetSessionCount())
+	}
+	if string(responses[0]) != string(responses[1]) {
+		t.Errorf("Retransmitted request answered with another response")
+	}
+
+	// Other requests reusing the sequence number aren't answered from the cache
+	for _, request := range []message.Message{
+		message.NewHeartbeatRequest(7, ie.NewRecoveryTimeStamp(time.Now()), nil),
+		message.NewSessionEstablishmentRequest(0, 0, 1, 7, 0,
+			ie.NewNodeID("", "", "test"),
+			ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		),
+	} {
+		buf := make([]byte, request.MarshalLen())
+		if err := request.MarshalTo(buf); err != nil {
+			t.Fatalf("Error marshaling %s: %s", request.MessageTypeName(), err)
+		}
+		if err := pfcpConn.pfcpHandlerMap.Handle(&pfcpConn, buf, smfConn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Errorf("Error handling %s: %s", request.MessageTypeName(), err)
+		}
+		response := make([]byte, 1500)
+		_ = smfConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := smfConn.ReadFromUDP(response)
+		if err != nil {
+			t.Fatalf("Error reading response to %s: %s", request.MessageTypeName(), err)
+		}
+		if msg, err := message.Parse(response[:n]); err != nil || msg.MessageType() != request.MessageType()+1 {
+			t.Errorf("%s answered with a cached response", request.MessageTypeName())
+		}
+	}
+	if pfcpConn.GetSessionCount() != 2 {
+		t.Errorf("Request reusing the sequence number not handled, session count: %d", pfcpConn.GetSessionCount())
+	}
+}
+
+func TestRequestRetransmissionAndTimeout(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+	smfConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer smfConn.Close()
+	smfAddr := smfConn.LocalAddr().(*net.UDPAddr)
+
+	timedOut := make(chan struct{}, 1)
+	nrreq := message.NewNodeReportRequest(1, newIeNodeID(pfcpConn.nodeId))
+	if err := pfcpConn.sendRequest(nrreq, smfAddr, 10*time.Millisecond, 2, func() { timedOut <- struct{}{} }); err != nil {
+		t.Fatalf("Error sending node report request: %s", err)
+	}
+	// The request and its two retransmissions
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		_ = smfConn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := smfConn.ReadFromUDP(buf); err != nil {
+			t.Fatalf("Error reading node report request %d: %s", i, err)
+		}
+	}
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout of unanswered request not reported")
+	}
+	if pfcpConn.transactions.Complete(smfIP, 1) {
+		t.Errorf("Timed out request still outstanding")
+	}
+
+	// Answered request is neither retransmitted nor timed out
+	nrreq = message.NewNodeReportRequest(2, newIeNodeID(pfcpConn.nodeId))
+	if err := pfcpConn.sendRequest(nrreq, smfAddr, 50*time.Millisecond, 2, func() { timedOut <- struct{}{} }); err != nil {
+		t.Fatalf("Error sending node report request: %s", err)
+	}
+	nrres := message.NewNodeReportResponse(2, ie.NewNodeID("", "", "test"), ie.NewCause(ie.CauseRequestAccepted), nil)
+	resBuf := make([]byte, nrres.MarshalLen())
+	if err := nrres.MarshalTo(resBuf); err != nil {
+		t.Fatalf("Error marshaling node report response: %s", err)
+	}
+	if err := pfcpConn.pfcpHandlerMap.Handle(&pfcpConn, resBuf, smfAddr); err != nil {
+		t.Errorf("Error handling node report response: %s", err)
+	}
+	if pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeNodeReportRequest) {
+		t.Errorf("Answered request still outstanding")
+	}
+	select {
+	case <-timedOut:
+		t.Errorf("Timeout of answered request reported")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestGtpPathReportedAgainWhenUnanswered(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	pfcpConn.gtpReportTimeoutC = make(chan nodeReport)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+	config.Conf.PfcpRequestTimeout = 1
+	defer func() { config.Conf.PfcpRequestTimeout = 0 }()
+
+	failure := GtpPathEvent{PeerAddress: "127.0.0.5:2152", Up: false}
+	pfcpConn.ReportGtpPath(failure)
+
+	// The CP function never answers, so the report times out after T1
+	var report nodeReport
+	select {
+	case report = <-pfcpConn.gtpReportTimeoutC:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Unanswered node report didn't time out")
+	}
+	if report.nodeID != "test" || report.event != failure {
+		t.Fatalf("Unexpected unanswered node report: %+v", report)
+	}
+
+	pfcpConn.HandleNodeReportTimeout(report)
+	if !pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeNodeReportRequest) {
+		t.Errorf("Unanswered path failure isn't reported again")
+	}
+	for key := range pfcpConn.transactions.outstanding {
+		pfcpConn.transactions.Cancel(key.peer, key.sequence)
+	}
+
+	// A report superseded by the recovery of the path isn't sent again
+	pfcpConn.gtpPaths[failure.PeerAddress] = true
+	pfcpConn.HandleNodeReportTimeout(report)
+	if pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeNodeReportRequest) {
+		t.Errorf("Superseded path failure reported again")
+	}
+}
+
+func TestRequestSequenceNumbersPerPeer(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+
+	// Requests of any type to the same peer share the sequence numbers
+	association := pfcpConn.NodeAssociations["test"]
+	heartbeatSequence := SendHeartbeatRequest(&pfcpConn, smfIP, nil)
+	SendNodeReportRequest(&pfcpConn, association, nil)
+	otherAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 8805}
+	if err := pfcpConn.SendRequest(message.NewNodeReportRequest(0, newIeNodeID(pfcpConn.nodeId)), otherAddr, nil); err != nil {
+		t.Fatalf("Error sending node report request: %s", err)
+	}
+
+	if heartbeatSequence != 1 {
+		t.Errorf("Unexpected sequence number of heartbeat request: %d", heartbeatSequence)
+	}
+	if !pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeNodeReportRequest) ||
+		!pfcpConn.transactions.Complete(smfIP, 2) {
+		t.Errorf("Node report request not numbered after heartbeat request")
+	}
+	if !pfcpConn.transactions.Complete("127.0.0.2", 1) {
+		t.Errorf("Requests to another peer not numbered apart")
+	}
+	pfcpConn.transactions.Cancel(smfIP, heartbeatSequence)
+}
+
+func TestAssociationFollowsNodeIdAcrossAddresses(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	newSmfIP := "127.0.0.2"
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, newSmfIP); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	association := pfcpConn.NodeAssociations["test"]
+	if association.GetAddr() != newSmfIP {
+		t.Errorf("Association address not updated: %s", association.GetAddr())
+	}
+	if pfcpConn.GetAssociationByAddr(smfIP) != nil || pfcpConn.GetAssociationByAddr(newSmfIP) != association {
+		t.Errorf("Association not found by its new address")
+	}
+
+	// Session related messages are accepted from the new addresses of the association owning the session
+	for _, addr := range []string{newSmfIP, "127.0.0.3"} {
+		modReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+			ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(2)),
+		)
+		response, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, addr)
+		if err != nil {
+			t.Errorf("Error handling session modification request: %s", err)
+		}
+		cause, err := response.(*message.SessionModificationResponse).Cause.Cause()
+		if err != nil {
+			t.Errorf("Error getting cause from session modification response: %s", err)
+		}
+		if cause != ie.CauseRequestAccepted {
+			t.Errorf("Unexpected cause in session modification response from %s: %d", addr, cause)
+		}
+		if association.GetAddr() != addr {
+			t.Errorf("Association address not updated by session modification: %s", association.GetAddr())
+		}
+	}
+
+	// The Node ID of another CP function doesn't control the session from any address
+	modReq := message.NewSessionModificationRequest(0, 0, 2, 4, 0,
+		ie.NewNodeID("", "", "unknown"),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(2)),
+	)
+	response, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, "127.0.0.4")
+	if err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionModificationResponse).Cause.Cause(); cause != ie.CauseSessionContextNotFound {
+		t.Errorf("Unexpected cause in session modification response with unknown NodeID: %d", cause)
+	}
+	if association.GetAddr() != "127.0.0.3" {
+		t.Errorf("Association address updated by another CP function: %s", association.GetAddr())
+	}
+}
+
+func TestSessionOfAnotherAssociationNotFound(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	otherSmfIP := "127.0.0.2"
+	asReq := message.NewAssociationSetupRequest(0,
+		ie.NewNodeID("", "", "other"),
+		ie.NewRecoveryTimeStamp(time.Now()),
+	)
+	if _, err := HandlePfcpAssociationSetupRequest(&pfcpConn, asReq, otherSmfIP); err != nil {
+		t.Errorf("Error handling association setup request: %s", err)
+	}
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+
+	delReq := message.NewSessionDeletionRequest(0, 0, 2, 2, 0)
+	response, err := HandlePfcpSessionDeletionRequest(&pfcpConn, delReq, otherSmfIP)
+	if err != nil {
+		t.Errorf("Error handling session deletion request: %s", err)
+	}
+	cause, err := response.(*message.SessionDeletionResponse).Cause.Cause()
+	if err != nil {
+		t.Errorf("Error getting cause from session deletion response: %s", err)
+	}
+	if cause != ie.CauseSessionContextNotFound {
+		t.Errorf("Unexpected cause in session deletion response: %d", cause)
+	}
+	if _, session := pfcpConn.FindSession(2); session == nil {
+		t.Errorf("Session deleted by another association")
+	}
+}
+
+func TestLocalSEIDsUniqueAcrossAssociations(t *testing.T) {
+	pfcpConn, smfIP := PreparePfcpConnection(t)
+	pfcpConn.sessions = newSessionIndex(7)
+	otherSmfIP := "127.0.0.2"
+	asReq := message.NewAssociationSetupRequest(0,
+		ie.NewNodeID("", "", "other"),
+		ie.NewRecoveryTimeStamp(time.Now()),
+	)
+	if _, err := HandlePfcpAssociationSetupRequest(&pfcpConn, asReq, otherSmfIP); err != nil {
+		t.Errorf("Error handling association setup request: %s", err)
+	}
+
+	for nodeID, addr := range map[string]string{"test": smfIP, "other": otherSmfIP} {
+		estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+			ie.NewNodeID("", "", nodeID),
+			ie.NewFSEID(1, net.ParseIP(addr), nil),
+		)
+		if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, addr); err != nil {
+			t.Errorf("Error handling session establishment request: %s", err)
+		}
+	}
+
+	seids := map[uint64]bool{}
+	for nodeID, association := range pfcpConn.NodeAssociations {
+		for seid := range association.Sessions {
+			if seids[seid] {
+				t.Errorf("SEID %d allocated twice", seid)
+			}
+			seids[seid] = true
+			if seid>>seidPrefixShift != 7 {
+				t.Errorf("SEID %d without instance prefix", seid)
+			}
+			if found, _ := pfcpConn.FindSession(seid); found != association {
+				t.Errorf("Session %d of %s not found in the SEID index", seid, nodeID)
+			}
+		}
+	}
+	if len(seids) != 2 {
+		t.Errorf("Unexpected session count: %d", len(seids))
+	}
+}
+
+func TestSessionIndexFindsUrrs(t *testing.T) {
+	index := newSessionIndex(0)
+	association := NewNodeAssociation("test", "127.0.0.1")
+	session := NewSession(2, 1)
+	session.NewUrr(1, 5, SUrrInfo{})
+	index.Add(association, session)
+	if _, found := index.FindUrr(5); found != session {
+		t.Errorf("URR 5 not found")
+	}
+
+	// A modification replaces the URR, and another session reuses the released global ID
+	session.RemoveUrr(1)
+	session.NewUrr(2, 6, SUrrInfo{})
+	index.Add(association, session)
+	other := NewSession(3, 1)
+	other.NewUrr(1, 5, SUrrInfo{})
+	index.Add(association, other)
+	if _, found := index.FindUrr(6); found != session {
+		t.Errorf("URR 6 not found")
+	}
+	if _, found := index.FindUrr(5); found != other {
+		t.Errorf("Reused URR 5 not found")
+	}
+
+	index.Remove(session.LocalSEID)
+	if _, found := index.FindUrr(6); found != nil {
+		t.Errorf("URR 6 of deleted session found")
+	}
+	if _, found := index.FindUrr(5); found != other {
+		t.Errorf("URR 5 of other session removed")
+	}
+}
+
+func TestSessionIndexFindsFars(t *testing.T) {
+	index := newSessionIndex(0)
+	association := NewNodeAssociation("test", "127.0.0.1")
+	session := NewSession(2, 1)
+	session.NewFar(1, 7, ebpf.FarInfo{})
+	session.NewFar(2, 8, ebpf.FarInfo{})
+	index.Add(association, session)
+	if _, found, farId := index.FindFar(8); found != session || farId != 2 {
+		t.Errorf("FAR 8 not found: %d", farId)
+	}
+
+	session.RemoveFar(2)
+	index.Add(association, session)
+	if _, found, _ := index.FindFar(8); found != nil {
+		t.Errorf("Removed FAR 8 found")
+	}
+
+	index.Remove(session.LocalSEID)
+	if _, found, _ := index.FindFar(7); found != nil {
+		t.Errorf("FAR 7 of deleted session found")
+	}
+}
+
+func TestSessionTakeoverWithinSMFSet(t *testing.T) {
+	pfcpConn, _ := PreparePfcpConnection(t)
+	smfIPs := map[string]string{"smf1": "127.0.0.2", "smf2": "127.0.0.3"}
+	for nodeID, addr := range smfIPs {
+		asReq := message.NewAssociationSetupRequest(0,
+			ie.NewNodeID("", "", nodeID),
+			ie.NewRecoveryTimeStamp(time.Now()),
+			ie.NewSMFSetID("set1"),
+		)
+		if _, err := HandlePfcpAssociationSetupRequest(&pfcpConn, asReq, addr); err != nil {
+			t.Errorf("Error handling association setup request: %s", err)
+		}
+	}
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewNodeID("", "", "smf1"),
+		ie.NewFSEID(1, net.ParseIP(smfIPs["smf1"]), nil),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIPs["smf1"]); err != nil {
+		t.Errorf("Error handling session establishment request: %s", err)
+	}
+	seid := uint64(2)
+
+	// A rejected modification doesn't take the session over
+	modReq := message.NewSessionModificationRequest(0, 0, seid, 2, 0,
+		ie.NewFSEID(5, net.ParseIP(smfIPs["smf2"]), nil),
+		ie.NewCreatePDR(ie.NewPDRID(1)),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIPs["smf2"]); err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	if association, _ := pfcpConn.FindSession(seid); association != pfcpConn.NodeAssociations["smf1"] {
+		t.Fatalf("Session taken over by a rejected modification")
+	}
+
+	modReq = message.NewSessionModificationRequest(0, 0, seid, 3, 0,
+		ie.NewFSEID(5, net.ParseIP(smfIPs["smf2"]), nil),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIPs["smf2"]); err != nil {
+		t.Errorf("Error handling session modification request: %s", err)
+	}
+	association, session := pfcpConn.FindSession(seid)
+	if association != pfcpConn.NodeAssociations["smf2"] || len(pfcpConn.NodeAssociations["smf1"].Sessions) != 0 {
+		t.Fatalf("Session not taken over by the SMF of the same set")
+	}
+	if session.RemoteSEID != 5 || !session.CpIPv4.Equal(net.ParseIP(smfIPs["smf2"])) {
+		t.Errorf("CP F-SEID not changed: %d %s", session.RemoteSEID, session.CpIPv4)
+	}
+
+	// Sessions of a failed SMF are kept by the rest of the set
+	pfcpConn.FailAssociation("smf2")
+	if association, _ := pfcpConn.FindSession(seid); association != pfcpConn.NodeAssociations["smf1"] {
+		t.Errorf("Session of the failed SMF not kept by the SMF set")
+	}
+}
+
+// ruleCountingMapOperationsMock counts the rules written to the maps and fails to put downlink PDRs.
+type ruleCountingMapOperationsMock struct {
+	MapOperationsMock
+	rules int
+}
+
+func (mapOps *ruleCountingMapOperationsMock) PutPdrUplink(teid uint32, pdrInfo ebpf.PdrInfo) error {
+	mapOps.rules++
+	return nil
+}
+func (mapOps *ruleCountingMapOperationsMock) PutPdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
+	return fmt.Errorf("map is full")
+}
+func (mapOps *ruleCountingMapOperationsMock) DeletePdrUplink(teid uint32, pdrId uint32) error {
+	mapOps.rules--
+	return nil
+}
+func (mapOps *ruleCountingMapOperationsMock) NewFar(farInfo ebpf.FarInfo) (uint32, error) {
+	mapOps.rules++
+	return 0, nil
+}
+func (mapOps *ruleCountingMapOperationsMock) DeleteFar(internalId uint32) error {
+	mapOps.rules--
+	return nil
+}
+func (mapOps *ruleCountingMapOperationsMock) NewQer(qerInfo ebpf.QerInfo) (uint32, error) {
+	mapOps.rules++
+	return 0, nil
+}
+func (mapOps *ruleCountingMapOperationsMock) DeleteQer(internalId uint32) error {
+	mapOps.rules--
+	return nil
+}
+func (mapOps *ruleCountingMapOperationsMock) NewUrr(urrInfo ebpf.UrrInfo) (uint32, error) {
+	mapOps.rules++
+	return 0, nil
+}
+func (mapOps *ruleCountingMapOperationsMock) DeleteUrr(internalId uint32) (error, ebpf.UrrInfo) {
+	mapOps.rules--
+	return nil, ebpf.UrrInfo{}
+}
+
+func TestSessionEstablishmentRollback(t *testing.T) {
+	ebpfMock := &ruleCountingMapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	// A single TEID, available again only if the failed establishment releases it
+	resourceManager, err := service.NewResourceManager("", 1)
+	if err != nil {
+		t.Fatalf("failed to create ResourceManager: %s", err)
+	}
+	pfcpConn.ResourceManager = resourceManager
+
+	uplinkPDR := ie.NewCreatePDR(
+		ie.NewPDRID(1),
+		ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x04, 0, net.ParseIP("127.0.0.1"), nil, 0),
+		),
+	)
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(2)),
+		ie.NewCreateQER(ie.NewQERID(1), ie.NewGateStatus(0, 0)),
+		ie.NewCreateURR(ie.NewURRID(1)),
+		uplinkPDR,
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(2, "1.1.1.1", "", 0, 0),
+			),
+		),
+	)
+	response, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionEstablishmentResponse).Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("Unexpected cause: %d", cause)
+	}
+	if ebpfMock.rules != 0 {
+		t.Errorf("Rules left in the maps: %d", ebpfMock.rules)
+	}
+	if len(pfcpConn.NodeAssociations["test"].Sessions) != 0 {
+		t.Errorf("Session of the failed establishment stored")
+	}
+
+	estReq = message.NewSessionEstablishmentRequest(0, 0, 1, 2, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		uplinkPDR,
+	)
+	response, err = HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP)
+	if err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionEstablishmentResponse).Cause.Cause(); cause != ie.CauseRequestAccepted {
+		t.Errorf("TEID of the failed establishment not released, cause: %d", cause)
+	}
+}
+
+func TestSessionModificationRollback(t *testing.T) {
+	ebpfMock := &ruleCountingMapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(2)),
+		ie.NewCreateURR(ie.NewURRID(1)),
+		ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x01, 1, net.ParseIP("127.0.0.1"), nil, 0),
+			),
+		),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	seid := uint64(2)
+	rules := ebpfMock.rules
+
+	// The downlink PDR fails to be put after the other rules are changed
+	modReq := message.NewSessionModificationRequest(0, 0, seid, 2, 0,
+		ie.NewFSEID(5, net.ParseIP(smfIP), nil),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(2)),
+		ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(1)),
+		ie.NewRemoveURR(ie.NewURRID(1)),
+		ie.NewRemovePDR(ie.NewPDRID(1)),
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(2, "1.1.1.1", "", 0, 0),
+			),
+		),
+	)
+	response, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+	if err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	modRes := response.(*message.SessionModificationResponse)
+	if cause, _ := modRes.Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("Unexpected cause: %d", cause)
+	}
+	if modRes.OffendingIE == nil {
+		t.Fatalf("Offending IE missing")
+	}
+	if offendingIE, _ := modRes.OffendingIE.OffendingIE(); offendingIE != ie.CreatePDR {
+		t.Errorf("Unexpected Offending IE: %d", offendingIE)
+	}
+	if ebpfMock.rules != rules {
+		t.Errorf("Rules in the maps changed: %d, expected %d", ebpfMock.rules, rules)
+	}
+
+	session := pfcpConn.NodeAssociations["test"].Sessions[seid]
+	if len(session.FARs) != 1 || session.FARs[1].FarInfo.Action != 2 {
+		t.Errorf("FARs not restored: %+v", session.FARs)
+	}
+	if _, ok := session.URRs[1]; !ok {
+		t.Errorf("Removed URR not restored")
+	}
+	if _, ok := session.PDRs[1]; !ok || len(session.PDRs) != 1 {
+		t.Errorf("PDRs not restored: %+v", session.PDRs)
+	}
+	if session.RemoteSEID != 1 {
+		t.Errorf("CP F-SEID changed by the rejected request: %d", session.RemoteSEID)
+	}
+}
+
+func TestSessionModificationOfUnknownRules(t *testing.T) {
+	for _, update := range []*ie.IE{
+		ie.NewUpdateFAR(ie.NewFARID(7), ie.NewApplyAction(1)),
+		ie.NewUpdateQER(ie.NewQERID(7), ie.NewGateStatus(ie.GateStatusClosed, ie.GateStatusClosed)),
+		ie.NewUpdateURR(ie.NewURRID(7), ie.NewMeasurementMethod(0, 1, 0)),
+		ie.NewUpdatePDR(ie.NewPDRID(7), ie.NewPrecedence(100), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 7, net.ParseIP("1.2.3.4"), nil, 0),
+		), ie.NewFARID(1)),
+	} {
+		ebpfMock := &ruleCountingMapOperationsMock{}
+		pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+		estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+			ie.NewNodeID("", "", "test"),
+			ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+			ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(2)),
+		)
+		if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+			t.Fatalf("Error handling session establishment request: %s", err)
+		}
+		seid := uint64(2)
+		rules := ebpfMock.rules
+
+		// The FAR created before the unknown rule is removed again
+		modReq := message.NewSessionModificationRequest(0, 0, seid, 2, 0,
+			ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(2)),
+			update,
+		)
+		response, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+		if err != nil {
+			t.Fatalf("Error handling session modification request: %s", err)
+		}
+		modRes := response.(*message.SessionModificationResponse)
+		if cause, _ := modRes.Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+			t.Errorf("Unexpected cause: %d", cause)
+		}
+		if modRes.OffendingIE == nil {
+			t.Fatalf("Offending IE missing")
+		}
+		if offendingIE, _ := modRes.OffendingIE.OffendingIE(); offendingIE != update.Type {
+			t.Errorf("Unexpected Offending IE: %d, expected %d", offendingIE, update.Type)
+		}
+		if ebpfMock.rules != rules {
+			t.Errorf("Rules in the maps changed: %d, expected %d", ebpfMock.rules, rules)
+		}
+
+		session := pfcpConn.NodeAssociations["test"].Sessions[seid]
+		if len(session.FARs) != 1 || len(session.QERs) != 0 || len(session.URRs) != 0 || len(session.PDRs) != 0 {
+			t.Errorf("Rules of the session changed: FARs %+v, QERs %+v, URRs %+v, PDRs %+v", session.FARs, session.QERs, session.URRs, session.PDRs)
+		}
+	}
+}
+
+func TestSessionModificationRollbackReleasesAllocations(t *testing.T) {
+	config.Conf.FeatureUEIP = true
+	defer func() { config.Conf.FeatureUEIP = false }()
+	ebpfMock := &ruleCountingMapOperationsMock{}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+	// A single UE IP and a single TEID, available again only if the failed modification releases them
+	resourceManager, err := service.NewResourceManager("10.61.0.0/31", 1)
+	if err != nil {
+		t.Fatalf("failed to create ResourceManager: %s", err)
+	}
+	pfcpConn.ResourceManager = resourceManager
+
+	estReq := message.NewSessionEstablishmentRequest(0, 0, 1, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(1, net.ParseIP(smfIP), nil),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, estReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+
+	// The downlink PDR fails to be put after the TEID and the UE IP are allocated
+	modReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewCreatePDR(
+			ie.NewPDRID(1),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(0x04, 0, net.ParseIP("127.0.0.1"), nil, 0),
+			),
+		),
+		ie.NewCreatePDR(
+			ie.NewPDRID(2),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewUEIPAddress(0x10, "", "", 0, 0),
+			),
+		),
+	)
+	response, err := HandlePfcpSessionModificationRequest(&pfcpConn, modReq, smfIP)
+	if err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionModificationResponse).Cause.Cause(); cause != ie.CauseRuleCreationModificationFailure {
+		t.Errorf("Unexpected cause: %d", cause)
+	}
+
+	if _, err := resourceManager.FTEIDM.AllocateTEID(3, 1); err != nil {
+		t.Errorf("TEID of the failed modification not released: %s", err)
+	}
+	if _, err := resourceManager.IPAM.AllocateIP(3); err != nil {
+		t.Errorf("UE IP of the failed modification not released: %s", err)
+	}
+}
+
+// pdrRulesMapOperationsMock keeps the downlink PDR rules per network instance and UE IP the way the datapath maps do.
+type pdrRulesMapOperationsMock struct {
+	MapOperationsMock
+	downlink map[string]ebpf.IpEntrypointPdrInfo
+}
+
+func (mapOps *pdrRulesMapOperationsMock) PutPdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo ebpf.PdrInfo) error {
+	key := fmt.Sprintf("%d/%s", networkInstance, ipv4)
+	rule := ebpf.IpEntrypointPdrRule{PdrId: pdrInfo.PdrId, Precedence: pdrInfo.Precedence, FarId: pdrInfo.FarId}
+	stored, _, err := ebpf.InsertPdrRule(mapOps.downlink[key], rule)
+	if err == nil {
+		mapOps.downlink[key] = stored
+	}
+	return err
+}
+func (mapOps *pdrRulesMapOperationsMock) DeletePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrId uint32) error {
+	key := fmt.Sprintf("%d/%s", networkInstance, ipv4)
+	stored, removed := ebpf.RemovePdrRule(mapOps.downlink[key], pdrId)
+	if removed == nil {
+		return fmt.Errorf("PDR %d is not stored", pdrId)
+	}
+	if stored.RuleCount == 0 {
+		delete(mapOps.downlink, key)
+	} else {
+		mapOps.downlink[key] = stored
+	}
+	return nil
+}
+
+func (mapOps *pdrRulesMapOperationsMock) pdrIds(networkInstance uint32, ipv4 string) []uint32 {
+	stored := mapOps.downlink[fmt.Sprintf("%d/%s", networkInstance, ipv4)]
+	var pdrIds []uint32
+	for _, rule := range stored.Rules[:stored.RuleCount] {
+		pdrIds = append(pdrIds, rule.PdrId)
+	}
+	return pdrIds
+}
+
+func TestPdrsSharingUEIPInPrecedenceOrder(t *testing.T) {
+	ebpfMock := &pdrRulesMapOperationsMock{downlink: map[string]ebpf.IpEntrypointPdrInfo{}}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	newDownlinkPDR := func(pdrId uint16, precedence uint32, ueIP string, sdfFilter string) *ie.IE {
+		pdi := []*ie.IE{
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, ueIP, "", 0, 0),
+		}
+		if sdfFilter != "" {
+			pdi = append(pdi, ie.NewSDFFilter(sdfFilter, "", "", "", 1))
+		}
+		return ie.NewCreatePDR(ie.NewPDRID(pdrId), ie.NewPrecedence(precedence), ie.NewPDI(pdi...))
+	}
+
+	seReq := message.NewSessionEstablishmentRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		newDownlinkPDR(1, 255, "1.1.1.1", ""),
+		newDownlinkPDR(2, 100, "1.1.1.1", "permit out udp from 8.8.8.8/32 to assigned"),
+		newDownlinkPDR(3, 200, "1.1.1.1", "permit out tcp from 8.8.8.8/32 to assigned"),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	if pdrIds := ebpfMock.pdrIds(0, "1.1.1.1"); fmt.Sprint(pdrIds) != "[2 3 1]" {
+		t.Errorf("Unexpected PDR order: %v", pdrIds)
+	}
+	if precedence := pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[3].PdrInfo.Precedence; precedence != 200 {
+		t.Errorf("Unexpected precedence of PDR 3: %d", precedence)
+	}
+
+	// Removed and moved PDRs leave the other PDRs of the UE IP in place
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewRemovePDR(ie.NewPDRID(2)),
+		ie.NewUpdatePDR(ie.NewPDRID(3), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, "2.2.2.2", "", 0, 0),
+		)),
+	)
+	response, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP)
+	if err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	if cause, _ := response.(*message.SessionModificationResponse).Cause.Cause(); cause != ie.CauseRequestAccepted {
+		t.Fatalf("Unexpected cause: %d", cause)
+	}
+	if pdrIds := ebpfMock.pdrIds(0, "1.1.1.1"); fmt.Sprint(pdrIds) != "[1]" {
+		t.Errorf("Unexpected PDRs of 1.1.1.1: %v", pdrIds)
+	}
+	if pdrIds := ebpfMock.pdrIds(0, "2.2.2.2"); fmt.Sprint(pdrIds) != "[3]" {
+		t.Errorf("Unexpected PDRs of 2.2.2.2: %v", pdrIds)
+	}
+
+	sdReq := message.NewSessionDeletionRequest(0, 0, 2, 3, 0)
+	if _, err := HandlePfcpSessionDeletionRequest(&pfcpConn, sdReq, smfIP); err != nil {
+		t.Fatalf("Error handling session deletion request: %s", err)
+	}
+	if len(ebpfMock.downlink) != 0 {
+		t.Errorf("PDRs left after session deletion: %v", ebpfMock.downlink)
+	}
+}
+
+func TestNetworkInstanceOfPdrAndFar(t *testing.T) {
+	config.Conf.NetworkInstances = []config.NetworkInstanceConfig{
+		{Name: "internet", Table: 100},
+		{Name: "ims", Table: 200},
+	}
+	defer func() { config.Conf.NetworkInstances = nil }()
+
+	var mapOps MapOperationsMock
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, &mapOps)
+
+	seReq := message.NewSessionEstablishmentRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewFARID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewNetworkInstance("internet"),
+			ie.NewUEIPAddress(2, "1.1.1.1", "", 0, 0),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(2), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewNetworkInstanceFQDN("ims"),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(2), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewNetworkInstance("access"),
+		)),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+	if networkInstance := session.PDRs[1].PdrInfo.NetworkInstance; networkInstance != 1 {
+		t.Errorf("Unexpected network instance of PDR 1: %d", networkInstance)
+	}
+	if networkInstance := session.FARs[1].FarInfo.NetworkInstance; networkInstance != 2 {
+		t.Errorf("Unexpected network instance of label encoded FAR 1: %d", networkInstance)
+	}
+	if networkInstance := session.FARs[2].FarInfo.NetworkInstance; networkInstance != 0 {
+		t.Errorf("Network instance missing in the config should use the default table, got %d", networkInstance)
+	}
+
+	// Update Forwarding Parameters without Network Instance keep the network instance of the FAR
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewUpdateFAR(ie.NewFARID(1), ie.NewUpdateForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+		)),
+		ie.NewUpdateFAR(ie.NewFARID(2), ie.NewUpdateForwardingParameters(
+			ie.NewNetworkInstance("internet"),
+		)),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP); err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	if networkInstance := session.FARs[1].FarInfo.NetworkInstance; networkInstance != 2 {
+		t.Errorf("Unexpected network instance of FAR 1 after update: %d", networkInstance)
+	}
+	if networkInstance := session.FARs[2].FarInfo.NetworkInstance; networkInstance != 1 {
+		t.Errorf("Unexpected network instance of FAR 2 after update: %d", networkInstance)
+	}
+}
+
+func TestOverlappingUEIPsOfNetworkInstances(t *testing.T) {
+	config.Conf.NetworkInstances = []config.NetworkInstanceConfig{
+		{Name: "internet", Table: 100},
+		{Name: "enterprise-a", Table: 200, Vlan: 10},
+		{Name: "enterprise-b", Table: 300, IngressInterface: "eth2"},
+	}
+	defer func() { config.Conf.NetworkInstances = nil }()
+
+	ebpfMock := &pdrRulesMapOperationsMock{downlink: map[string]ebpf.IpEntrypointPdrInfo{}}
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, ebpfMock)
+
+	for i, session := range []struct{ networkInstance, ueIP string }{
+		{"enterprise-a", "10.0.0.1"},
+		{"enterprise-b", "10.0.0.1"},
+		{"internet", "10.0.0.2"},
+	} {
+		seReq := message.NewSessionEstablishmentRequest(0, 0,
+			uint64(i+2), uint32(i+1), 0,
+			ie.NewNodeID("", "", "test"),
+			ie.NewFSEID(uint64(i+2), net.ParseIP(smfIP), nil),
+			ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewNetworkInstance(session.networkInstance),
+				ie.NewUEIPAddress(2, session.ueIP, "", 0, 0),
+			)),
+		)
+		if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+			t.Fatalf("Error handling session establishment request: %s", err)
+		}
+	}
+	for _, networkInstance := range []uint32{2, 3} {
+		if pdrIds := ebpfMock.pdrIds(networkInstance, "10.0.0.1"); fmt.Sprint(pdrIds) != "[1]" {
+			t.Errorf("Unexpected PDRs of 10.0.0.1 in network instance %d: %v", networkInstance, pdrIds)
+		}
+	}
+	// Network instance not told apart on N6 shares the UE addresses of the default one
+	if pdrIds := ebpfMock.pdrIds(0, "10.0.0.2"); fmt.Sprint(pdrIds) != "[1]" {
+		t.Errorf("Unexpected PDRs of 10.0.0.2 in default network instance: %v", pdrIds)
+	}
+
+	// PDR moved to another network instance leaves its previous key
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 4, 0,
+		ie.NewUpdatePDR(ie.NewPDRID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, "10.0.0.1", "", 0, 0),
+		)),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP); err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	if pdrIds := ebpfMock.pdrIds(2, "10.0.0.1"); len(pdrIds) != 0 {
+		t.Errorf("PDRs left in network instance 2: %v", pdrIds)
+	}
+	if pdrIds := ebpfMock.pdrIds(0, "10.0.0.1"); fmt.Sprint(pdrIds) != "[1]" {
+		t.Errorf("Unexpected PDRs of 10.0.0.1 in default network instance: %v", pdrIds)
+	}
+}
+
+func TestDownlinkDataBufferingAndNotification(t *testing.T) {
+	defer func(limit uint32) { config.Conf.DownlinkBufferPackets = limit }(config.Conf.DownlinkBufferPackets)
+	config.Conf.DownlinkBufferPackets = 2
+	config.Conf.PfcpRequestTimeout = 3
+	defer func() { config.Conf.PfcpRequestTimeout = 0 }()
+
+	var mapOps MapOperationsMock
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, &mapOps)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+
+	seReq := message.NewSessionEstablishmentRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewFARID(1), ie.NewQERID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, "10.60.0.1", "", 0, 0),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(0x0c)),
+		ie.NewCreateQER(ie.NewQERID(1), ie.NewGateStatus(0, 0), ie.NewQFI(9)),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+
+	// Ethernet frames of IPv4 packets told apart by their identification
+	packets := make([][]byte, 3)
+	for i := range packets {
+		packets[i] = append(make([]byte, 12), 0x08, 0x00, 0x45, 0, 0, 20, 0, byte(i), 0, 0, 64, 17, 0, 0, 8, 8, 8, 8, 10, 60, 0, 1)
+		pfcpConn.HandleBufferedPacket(ebpf.BufferedPacket{FarId: session.FARs[1].GlobalId, PdrId: 1, Ifindex: 3, Packet: packets[i]})
+	}
+	if size := session.downlinkBuffer.size; size != 2 {
+		t.Errorf("Buffered packets exceed the limit of the session: %d", size)
+	}
+
+	// The CP function is notified only about the first packet
+	if len(pfcpConn.transactions.outstanding) != 1 {
+		t.Fatalf("Unexpected number of Session Report Requests: %d", len(pfcpConn.transactions.outstanding))
+	}
+	for _, transaction := range pfcpConn.transactions.outstanding {
+		srreq, ok := transaction.request.(*message.SessionReportRequest)
+		if !ok || srreq.ReportType == nil || !srreq.ReportType.HasDLDR() || srreq.DownlinkDataReport == nil {
+			t.Fatalf("Expected Session Report Request with Downlink Data Report, got %v", transaction.request)
+		}
+		if pdrId, err := srreq.DownlinkDataReport.PDRID(); err != nil || pdrId != 1 {
+			t.Errorf("Unexpected PDR ID of Downlink Data Report: %d, %v", pdrId, err)
+		}
+		// QFI flag and the QFI, without PPI
+		if info, err := srreq.DownlinkDataReport.DownlinkDataServiceInformation(); err != nil || string(info) != "\x02\x09" {
+			t.Errorf("Unexpected Downlink Data Service Information: %x, %v", info, err)
+		}
+	}
+
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(2), ie.NewUpdateForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x100, 0x1234, "127.0.0.1", "", 0, 0, 0),
+		)),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP); err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	if size := session.downlinkBuffer.size; size != 0 || len(session.downlinkBuffer.notified) != 0 {
+		t.Errorf("Buffer not flushed after the FAR is updated to forward packets: %d packets", size)
+	}
+
+	// Packets are reinjected into the datapath in the order of arrival
+	if len(mapOps.reinjectedPackets) != 2 {
+		t.Fatalf("Unexpected number of reinjected packets: %d", len(mapOps.reinjectedPackets))
+	}
+	for i, packet := range mapOps.reinjectedPackets {
+		if string(packet) != string(packets[i]) {
+			t.Errorf("Buffered packet %d reinjected out of order: %x", i, packet)
+		}
+	}
+}
+
+func TestDownlinkDataDroppedWithoutBuffer(t *testing.T) {
+	config.Conf.PfcpRequestTimeout = 3
+	defer func() { config.Conf.PfcpRequestTimeout = 0 }()
+	var mapOps MapOperationsMock
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, &mapOps)
+	pfcpConn.DisableDownlinkBuffer()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+
+	seReq := message.NewSessionEstablishmentRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewFARID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, "10.60.0.1", "", 0, 0),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(0x0c)),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+	pfcpConn.HandleBufferedPacket(ebpf.BufferedPacket{FarId: session.FARs[1].GlobalId, PdrId: 1, Ifindex: 3, Packet: make([]byte, 34)})
+
+	// The packet is dropped, but the CP function is still notified about it
+	if size := session.downlinkBuffer.size; size != 0 {
+		t.Errorf("Packets buffered with the buffer disabled: %d", size)
+	}
+	if !pfcpConn.transactions.Outstanding(smfIP, message.MsgTypeSessionReportRequest) {
+		t.Errorf("CP function not notified about the dropped packet")
+	}
+	for key := range pfcpConn.transactions.outstanding {
+		pfcpConn.transactions.Cancel(key.peer, key.sequence)
+	}
+}
+
+func TestDownlinkDataNotificationAfterFarUpdate(t *testing.T) {
+	config.Conf.PfcpRequestTimeout = 3
+	defer func() { config.Conf.PfcpRequestTimeout = 0 }()
+	var mapOps MapOperationsMock
+	pfcpConn, smfIP := PreparePfcpConnectionWithMock(t, &mapOps)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(smfIP)})
+	if err != nil {
+		t.Fatalf("Error listening UDP: %s", err)
+	}
+	defer udpConn.Close()
+	pfcpConn.udpConn = udpConn
+
+	seReq := message.NewSessionEstablishmentRequest(0, 0,
+		2, 1, 0,
+		ie.NewNodeID("", "", "test"),
+		ie.NewFSEID(2, net.ParseIP(smfIP), nil),
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewFARID(1), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(2, "10.60.0.1", "", 0, 0),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(0x0c)),
+	)
+	if _, err := HandlePfcpSessionEstablishmentRequest(&pfcpConn, seReq, smfIP); err != nil {
+		t.Fatalf("Error handling session establishment request: %s", err)
+	}
+	session := pfcpConn.NodeAssociations["test"].Sessions[2]
+	packet := ebpf.BufferedPacket{FarId: session.FARs[1].GlobalId, PdrId: 1, Ifindex: 3, Packet: make([]byte, 34)}
+
+	pfcpConn.HandleBufferedPacket(packet)
+	pfcpConn.HandleBufferedPacket(packet)
+	if len(pfcpConn.transactions.outstanding) != 1 {
+		t.Fatalf("Unexpected number of Session Report Requests: %d", len(pfcpConn.transactions.outstanding))
+	}
+
+	// The FAR still buffers and notifies the CP function after the update
+	smReq := message.NewSessionModificationRequest(0, 0, 2, 2, 0,
+		ie.NewUpdateFAR(ie.NewFARID(1), ie.NewApplyAction(0x0c)),
+	)
+	if _, err := HandlePfcpSessionModificationRequest(&pfcpConn, smReq, smfIP); err != nil {
+		t.Fatalf("Error handling session modification request: %s", err)
+	}
+	pfcpConn.HandleBufferedPacket(packet)
+	if len(pfcpConn.transactions.outstanding) != 2 {
+		t.Errorf("CP function not notified again after the FAR update: %d Session Report Requests", len(pfcpConn.transactions.outstanding))
+	}
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// sessionReport holds the usage reports of a Session Report Request left unanswered by the CP function.
+type sessionReport struct {
+	seid         uint64
+	usageReports []*ie.IE
+}
+
+func SendSessionReportRequest(conn *PfcpConnection, association *NodeAssociation, session *Session, usageReports []*ie.IE) error {
+	ies := append([]*ie.IE{ie.NewReportType(0, 0, 1, 0)}, usageReports...)
+	// The reported usage is already taken from the URRs, so it's reported again if the request is left unanswered
+	report := sessionReport{seid: session.LocalSEID, usageReports: usageReports}
+	onTimeout := func() { conn.reportTimeoutC <- report }
+	return sendSessionReport(conn, association, session, ies, fmt.Sprintf("usage reports: %d", len(usageReports)), onTimeout)
+}
+
+// HandleSessionReportTimeout sends the usage reports of an unanswered Session Report Request again while the session exists.
+func (connection *PfcpConnection) HandleSessionReportTimeout(report sessionReport) {
+	association, session := connection.sessions.Find(report.seid)
+	if session == nil {
+		log.Warn().Msgf("Usage reports of deleted session %d are lost", report.seid)
+		return
+	}
+	if err := SendSessionReportRequest(connection, association, session, report.usageReports); err != nil {
+		log.Error().Msgf("Usage reports of session %d are lost: %s", report.seid, err.Error())
+	}
+}
+
+// SendDownlinkDataReport notifies the CP function about the arrival of downlink data for the PDR of the session.
+func SendDownlinkDataReport(conn *PfcpConnection, association *NodeAssociation, session *Session, pdrId uint32, qfi uint8) error {
+	serviceInformation := ie.NewDownlinkDataServiceInformation(false, qfi != 0, 0, qfi)
+	ies := []*ie.IE{
+		ie.NewReportType(0, 0, 0, 1),
+		ie.NewDownlinkDataReport(ie.NewPDRID(uint16(pdrId)), serviceInformation),
+	}
+	return sendSessionReport(conn, association, session, ies, fmt.Sprintf("downlink data of PDR: %d", pdrId), nil)
+}
+
+// sendSessionReport sends the Session Report Request. A request failed to be sent is not retransmitted,
+// so the caller may report its content again. onTimeout is called when the request is left unanswered.
+func sendSessionReport(conn *PfcpConnection, association *NodeAssociation, session *Session, ies []*ie.IE, description string, onTimeout func()) error {
+	srreq := message.NewSessionReportRequest(0, 0, session.RemoteSEID, 0, 0, ies...)
+	udpAddr, err := net.ResolveUDPAddr("udp", association.GetAddr()+":8805")
+	if err != nil {
+		log.Info().Msgf("Failed to send Session Report Request: %s\n", err.Error())
+		return err
+	}
+	if err := conn.SendRequest(srreq, udpAddr, onTimeout); err != nil {
+		conn.transactions.Cancel(udpAddr.IP.String(), srreq.Sequence())
+		log.Info().Msgf("Failed to send Session Report Request: %s\n", err.Error())
+		return err
+	}
+	log.Info().Msgf("Sent Session Report Request to: %s, SEID: %d, %s", association.GetAddr(), session.LocalSEID, description)
+	return nil
+}
+
+func HandlePfcpSessionReportResponse(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	srres := msg.(*message.SessionReportResponse)
+	if srres.Cause == nil {
+		log.Warn().Msgf("Got Session Report Response without Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		return nil, errMandatoryIeMissing
+	}
+	cause, err := srres.Cause.Cause()
+	if err != nil {
+		log.Warn().Msgf("Got Session Report Response with invalid Cause from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		return nil, err
+	}
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(cause)).Inc()
+
+	switch cause {
+	case ie.CauseRequestAccepted:
+		log.Debug().Msgf("Session Report Request accepted by: %s, SEID: %d", addr, srres.SEID())
+	case ie.CauseSessionContextNotFound:
+		// The CP function doesn't know the session anymore, so there is no one to report to.
+		if association, _, session := conn.FindPeerSession(srres.SEID(), addr, nil); session != nil {
+			log.Warn().Msgf("Session %d is unknown to: %s, deleting it", srres.SEID(), addr)
+			conn.DeleteSession(session)
+			delete(association.Sessions, srres.SEID())
+			conn.ReleaseResources(srres.SEID())
+		}
+	default:
+		log.Warn().Msgf("Session Report Request rejected by: %s, SEID: %d, cause: %s", addr, srres.SEID(), causeToString(cause))
+	}
+	return nil, nil
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+func HandlePfcpSessionSetDeletionRequest(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	req := msg.(*message.SessionSetDeletionRequest)
+	log.Info().Msgf("Got Session Set Deletion Request from: %s", addr)
+	if req.NodeID == nil {
+		log.Warn().Msgf("Got Session Set Deletion Request without NodeID from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEMissing)).Inc()
+		return message.NewSessionSetDeletionResponse(req.SequenceNumber, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseMandatoryIEMissing), ie.NewOffendingIE(ie.NodeID)), nil
+	}
+	nodeID, err := req.NodeID.NodeID()
+	if err != nil {
+		log.Warn().Msgf("Got Session Set Deletion Request with invalid NodeID from: %s", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+		return message.NewSessionSetDeletionResponse(req.SequenceNumber, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseMandatoryIEIncorrect), ie.NewOffendingIE(ie.NodeID)), nil
+	}
+
+	conn.associationMutex.Lock()
+	defer conn.associationMutex.Unlock()
+	if _, ok := conn.NodeAssociations[nodeID]; !ok {
+		log.Warn().Msgf("Rejecting Session Set Deletion Request from: %s (no association)", addr)
+		PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseNoEstablishedPFCPAssociation)).Inc()
+		return message.NewSessionSetDeletionResponse(req.SequenceNumber, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseNoEstablishedPFCPAssociation), nil), nil
+	}
+
+	var sessions map[*Session]*NodeAssociation
+	if req.FQCSID != nil {
+		fqcsid, err := parseFQCSID(req.FQCSID)
+		if err != nil {
+			log.Warn().Msgf("Got Session Set Deletion Request with invalid FQ-CSID from: %s", addr)
+			PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+			return message.NewSessionSetDeletionResponse(req.SequenceNumber, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseMandatoryIEIncorrect), ie.NewOffendingIE(ie.FQCSID)), nil
+		}
+		log.Info().Msgf("Deleting sessions of FQ-CSID: %+v", fqcsid)
+		sessions = conn.sessionSets.Find(fqcsid)
+	} else {
+		// Without FQ-CSID the whole set of sessions established by the node is deleted
+		log.Info().Msgf("Deleting sessions of NodeID: %s", nodeID)
+		sessions = map[*Session]*NodeAssociation{}
+		association := conn.NodeAssociations[nodeID]
+		for _, session := range association.Sessions {
+			sessions[session] = association
+		}
+	}
+
+	for session, association := range sessions {
+		log.Info().Msgf("Deleting session: %d", session.LocalSEID)
+		conn.DeleteSession(session)
+		delete(association.Sessions, session.LocalSEID)
+		conn.ReleaseResources(session.LocalSEID)
+	}
+
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRequestAccepted)).Inc()
+	return message.NewSessionSetDeletionResponse(req.SequenceNumber, newIeNodeID(conn.nodeId), ie.NewCause(ie.CauseRequestAccepted), nil), nil
+}
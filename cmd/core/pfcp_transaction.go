@@ -0,0 +1,168 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/edgecomllc/eupf/cmd/config"
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+type transactionKey struct {
+	peer     string
+	sequence uint32
+}
+
+// pfcpTransaction is a request sent by the UPF waiting for its response.
+type pfcpTransaction struct {
+	request   message.Message
+	payload   []byte
+	addr      *net.UDPAddr
+	interval  time.Duration
+	retries   uint32
+	timer     *time.Timer
+	onTimeout func()
+}
+
+// pfcpTransactions tracks the outstanding requests sent by the UPF. Requests are sent and
+// retransmitted from different goroutines, so the transactions are guarded by the mutex.
+type pfcpTransactions struct {
+	mutex       sync.Mutex
+	outstanding map[transactionKey]*pfcpTransaction
+	// Sequence number of the last request sent to each peer, kept when its association is replaced
+	sequences map[string]uint32
+}
+
+func newPfcpTransactions() *pfcpTransactions {
+	return &pfcpTransactions{
+		outstanding: map[transactionKey]*pfcpTransaction{},
+		sequences:   map[string]uint32{},
+	}
+}
+
+// nextSequence returns the sequence number of the next request to the peer. The 24-bit numbers wrap around
+// skipping 0 and the numbers of the requests still waiting for a response. The mutex must be held.
+func (transactions *pfcpTransactions) nextSequence(peer string) uint32 {
+	const sequenceMask = 1<<24 - 1
+	for {
+		sequence := max((transactions.sequences[peer]+1)&sequenceMask, 1)
+		transactions.sequences[peer] = sequence
+		if _, ok := transactions.outstanding[transactionKey{peer: peer, sequence: sequence}]; !ok {
+			return sequence
+		}
+	}
+}
+
+// Complete ends the transaction of the response. It reports false for responses nobody waits for,
+// such as the responses to retransmissions of an already answered request.
+func (transactions *pfcpTransactions) Complete(peer string, sequence uint32) bool {
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+	key := transactionKey{peer: peer, sequence: sequence}
+	transaction, ok := transactions.outstanding[key]
+	if !ok {
+		return false
+	}
+	transaction.timer.Stop()
+	delete(transactions.outstanding, key)
+	return true
+}
+
+// Cancel ends the transaction of a request which is not retransmitted anymore.
+func (transactions *pfcpTransactions) Cancel(peer string, sequence uint32) {
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+	key := transactionKey{peer: peer, sequence: sequence}
+	if transaction, ok := transactions.outstanding[key]; ok {
+		transaction.timer.Stop()
+		delete(transactions.outstanding, key)
+	}
+}
+
+// Outstanding reports whether a request of the message type is waiting for the response of the peer.
+func (transactions *pfcpTransactions) Outstanding(peer string, messageType uint8) bool {
+	transactions.mutex.Lock()
+	defer transactions.mutex.Unlock()
+	for key, transaction := range transactions.outstanding {
+		if key.peer == peer && transaction.request.MessageType() == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// SendRequest sends a request initiated by the UPF and retransmits it every T1 until the response
+// is received, at most N1 times. The request is numbered with the next sequence number of the peer.
+// onTimeout, if set, is called from the timer goroutine when the request is left unanswered.
+func (connection *PfcpConnection) SendRequest(request message.Message, addr *net.UDPAddr, onTimeout func()) error {
+	interval := time.Duration(config.Conf.PfcpRequestTimeout) * time.Second
+	return connection.sendRequest(request, addr, interval, config.Conf.PfcpRequestRetries, onTimeout)
+}
+
+func (connection *PfcpConnection) sendRequest(request message.Message, addr *net.UDPAddr, interval time.Duration, retries uint32, onTimeout func()) error {
+	transactions := connection.transactions
+	peer := addr.IP.String()
+
+	// The transaction is stored first, as the response may arrive before the request is sent
+	transactions.mutex.Lock()
+	request.SetSequenceNumber(transactions.nextSequence(peer))
+	// Retransmissions are sent from the timer goroutines, so the request is marshaled only once
+	payload := make([]byte, request.MarshalLen())
+	if err := request.MarshalTo(payload); err != nil {
+		transactions.mutex.Unlock()
+		return err
+	}
+	key := transactionKey{peer: peer, sequence: request.Sequence()}
+	transaction := &pfcpTransaction{
+		request:   request,
+		payload:   payload,
+		addr:      addr,
+		interval:  interval,
+		retries:   retries,
+		onTimeout: onTimeout,
+	}
+	transactions.outstanding[key] = transaction
+	transaction.timer = time.AfterFunc(interval, func() { connection.retransmitRequest(key, transaction) })
+	transactions.mutex.Unlock()
+
+	// A request failed to be sent is retransmitted as a lost one
+	if _, err := connection.Send(payload, addr); err != nil {
+		return err
+	}
+	PfcpMessageTx.WithLabelValues(request.MessageTypeName()).Inc()
+	return nil
+}
+
+func (connection *PfcpConnection) retransmitRequest(key transactionKey, transaction *pfcpTransaction) {
+	transactions := connection.transactions
+	transactions.mutex.Lock()
+	if transactions.outstanding[key] != transaction {
+		// Answered in the meantime
+		transactions.mutex.Unlock()
+		return
+	}
+	if transaction.retries == 0 {
+		delete(transactions.outstanding, key)
+		transactions.mutex.Unlock()
+
+		log.Warn().Msgf("No response to %s with sequence number %d from: %s", transaction.request.MessageTypeName(), key.sequence, key.peer)
+		PfcpRequestTimeouts.WithLabelValues(transaction.request.MessageTypeName()).Inc()
+		if transaction.onTimeout != nil {
+			transaction.onTimeout()
+		}
+		return
+	}
+	transaction.retries--
+	transaction.timer = time.AfterFunc(transaction.interval, func() { connection.retransmitRequest(key, transaction) })
+	transactions.mutex.Unlock()
+
+	log.Debug().Msgf("Retransmitting %s with sequence number %d to: %s", transaction.request.MessageTypeName(), key.sequence, key.peer)
+	if _, err := connection.Send(transaction.payload, transaction.addr); err != nil {
+		log.Info().Msgf("Failed to retransmit %s: %s\n", transaction.request.MessageTypeName(), err.Error())
+		return
+	}
+	PfcpMessageTx.WithLabelValues(transaction.request.MessageTypeName()).Inc()
+	PfcpRequestRetransmissions.WithLabelValues(transaction.request.MessageTypeName()).Inc()
+}
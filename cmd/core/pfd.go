@@ -0,0 +1,180 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/edgecomllc/eupf/cmd/ebpf"
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// PfdContents holds a Packet Flow Description provisioned for an application.
+type PfdContents struct {
+	FlowDescriptions []string
+	URLs             []string
+	DomainNames      []string
+}
+
+// ApplicationPfds maps Application IDs to their PFDs.
+type ApplicationPfds map[string][]PfdContents
+
+// FlowDescriptions returns flow descriptions of all PFDs of the application.
+func (applicationPfds ApplicationPfds) FlowDescriptions(applicationID string) []string {
+	var flowDescriptions []string
+	for _, pfd := range applicationPfds[applicationID] {
+		flowDescriptions = append(flowDescriptions, pfd.FlowDescriptions...)
+	}
+	return flowDescriptions
+}
+
+// sdfFilters parses the flow descriptions of the application into the SDF filters of a PDR. Applications with
+// more filters than a PDR may have are rejected rather than matching only a part of their traffic.
+func (applicationPfds ApplicationPfds) sdfFilters(applicationID string) ([]ebpf.SdfFilter, error) {
+	var sdfFilters []ebpf.SdfFilter
+	for _, flowDescription := range applicationPfds.FlowDescriptions(applicationID) {
+		parsed, err := ParseSdfFilters(flowDescription)
+		if err != nil {
+			return nil, err
+		}
+		sdfFilters = append(sdfFilters, parsed...)
+	}
+	if limit := sdfFilterLimit(); len(sdfFilters) > limit {
+		return nil, fmt.Errorf("%d SDF filters of application %s exceed the limit of %d per PDR", len(sdfFilters), applicationID, limit)
+	}
+	return sdfFilters, nil
+}
+
+// resolveSdfFilter sets the SDF filters of the PDR from the flow descriptions of its application.
+func (applicationPfds ApplicationPfds) resolveSdfFilter(spdrInfo *SPDRInfo) error {
+	spdrInfo.PdrInfo.SdfFilters = nil
+	sdfFilters, err := applicationPfds.sdfFilters(spdrInfo.ApplicationID)
+	if err != nil {
+		return err
+	}
+	if len(sdfFilters) == 0 {
+		log.Warn().Msgf("No flow description PFDs for application: %s", spdrInfo.ApplicationID)
+		return nil
+	}
+	spdrInfo.PdrInfo.SdfFilters = sdfFilters
+	return nil
+}
+
+func parseApplicationIDsPFDs(applicationIDsPFDs *ie.IE) (string, []PfdContents, error) {
+	applicationID, err := applicationIDsPFDs.ApplicationID()
+	if err != nil {
+		return "", nil, fmt.Errorf("Application ID missing")
+	}
+	ies, err := applicationIDsPFDs.ApplicationIDsPFDs()
+	if err != nil {
+		return "", nil, err
+	}
+	pfds := []PfdContents{}
+	for _, pfdContext := range ies {
+		if pfdContext.Type != ie.PFDContext {
+			continue
+		}
+		contents, err := pfdContext.PFDContext()
+		if err != nil {
+			return "", nil, err
+		}
+		for _, content := range contents {
+			if content.Type != ie.PFDContents {
+				continue
+			}
+			fields, err := content.PFDContents()
+			if err != nil {
+				return "", nil, err
+			}
+			pfd := PfdContents{}
+			if fields.FlowDescription != "" {
+				pfd.FlowDescriptions = append(pfd.FlowDescriptions, fields.FlowDescription)
+			}
+			pfd.FlowDescriptions = append(pfd.FlowDescriptions, fields.AdditionalFlowDescription...)
+			for _, flowDescription := range pfd.FlowDescriptions {
+				if _, err := ParseSdfFilters(flowDescription); err != nil {
+					return "", nil, err
+				}
+			}
+			if fields.URL != "" {
+				pfd.URLs = append(pfd.URLs, fields.URL)
+			}
+			pfd.URLs = append(pfd.URLs, fields.AdditionalURL...)
+			if fields.DomainName != "" {
+				pfd.DomainNames = append(pfd.DomainNames, fields.DomainName)
+			}
+			pfds = append(pfds, pfd)
+		}
+	}
+	return applicationID, pfds, nil
+}
+
+func HandlePfcpPfdManagementRequest(conn *PfcpConnection, msg message.Message, addr string) (message.Message, error) {
+	req := msg.(*message.PFDManagementRequest)
+	log.Info().Msgf("Got PFD Management Request from: %s", addr)
+
+	provisioned := ApplicationPfds{}
+	for _, applicationIDsPFDs := range req.ApplicationIDsPFDs {
+		applicationID, pfds, err := parseApplicationIDsPFDs(applicationIDsPFDs)
+		if err != nil {
+			log.Warn().Msgf("Rejecting PFD Management Request from: %s (%s)", addr, err.Error())
+			PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseMandatoryIEIncorrect)).Inc()
+			return message.NewPFDManagementResponse(req.SequenceNumber, ie.NewCause(ie.CauseMandatoryIEIncorrect), ie.NewOffendingIE(ie.ApplicationIDsPFDs)), nil
+		}
+		// The PFDs must fit the PDRs of the application
+		if _, err := (ApplicationPfds{applicationID: pfds}).sdfFilters(applicationID); err != nil {
+			log.Warn().Msgf("Rejecting PFD Management Request from: %s (%s)", addr, err.Error())
+			PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRequestRejected)).Inc()
+			return message.NewPFDManagementResponse(req.SequenceNumber, ie.NewCause(ie.CauseRequestRejected), ie.NewOffendingIE(ie.ApplicationIDsPFDs)), nil
+		}
+		provisioned[applicationID] = pfds
+	}
+
+	// The provisioned PFDs replace all PFDs of the application, no PFDs remove the application
+	for applicationID, pfds := range provisioned {
+		if len(pfds) == 0 {
+			log.Info().Msgf("Removing PFDs of application: %s", applicationID)
+			delete(conn.applicationPfds, applicationID)
+			continue
+		}
+		log.Info().Msgf("Provisioning PFDs of application: %s, %+v", applicationID, pfds)
+		for _, pfd := range pfds {
+			if len(pfd.URLs) != 0 || len(pfd.DomainNames) != 0 {
+				log.Warn().Msgf("URL and domain name PFDs are not supported, application: %s", applicationID)
+			}
+		}
+		conn.applicationPfds[applicationID] = pfds
+	}
+	conn.applyApplicationPfds(provisioned)
+
+	PfcpMessageRxErrors.WithLabelValues(msg.MessageTypeName(), causeToString(ie.CauseRequestAccepted)).Inc()
+	return message.NewPFDManagementResponse(req.SequenceNumber, ie.NewCause(ie.CauseRequestAccepted), nil), nil
+}
+
+// applyApplicationPfds updates the PDRs of existing sessions which refer to the changed applications.
+func (connection *PfcpConnection) applyApplicationPfds(changed ApplicationPfds) {
+	for _, association := range connection.NodeAssociations {
+		for _, session := range association.Sessions {
+			for pdrId, spdrInfo := range session.PDRs {
+				if _, ok := changed[spdrInfo.ApplicationID]; spdrInfo.ApplicationID == "" || !ok {
+					continue
+				}
+				previous := spdrInfo
+				if err := connection.applicationPfds.resolveSdfFilter(&spdrInfo); err != nil {
+					log.Warn().Msgf("Can't resolve PDR %d of session %d: %s", pdrId, session.LocalSEID, err.Error())
+				}
+				session.PutPDR(pdrId, spdrInfo)
+				if !spdrInfo.isApplied() {
+					// The PDR stops matching the flows of the removed PFDs until the application is provisioned again
+					if err := removePDR(previous, connection.mapOperations); err != nil {
+						log.Warn().Msgf("Can't remove PDR %d of session %d: %s", pdrId, session.LocalSEID, err.Error())
+					}
+					continue
+				}
+				if err := applyPDR(spdrInfo, connection.mapOperations); err != nil {
+					log.Warn().Msgf("Can't apply PDR %d of session %d: %s", pdrId, session.LocalSEID, err.Error())
+				}
+			}
+		}
+	}
+}
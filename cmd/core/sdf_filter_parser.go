@@ -2,79 +2,410 @@ package core
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/edgecomllc/eupf/cmd/ebpf"
 )
 
-func ParseSdfFilter(flowDescription string) (ebpf.SdfFilter, error) {
-	re := regexp.MustCompile(`^permit out (icmp|ip|tcp|udp|\d+) from (any|[\d.]+|[\da-fA-F:]+)(?:/(\d+))?(?: (\d+|\d+-\d+))? to (assigned|any|[\d.]+|[\da-fA-F:]+)(?:/(\d+))?(?: (\d+|\d+-\d+))?$`)
+// IPFilterRule is a flow description in the IPFilterRule format of RFC 3588:
+//
+//	action dir proto from src [ports] to dst [ports] [options]
+type IPFilterRule struct {
+	Action      string // permit or deny
+	Direction   string // in or out
+	AnyProtocol bool   // ip keyword
+	Protocol    uint8  // IANA protocol number, unless AnyProtocol is set
+	Source      IPFilterAddress
+	Destination IPFilterAddress
+	Options     []IPFilterOption
 
-	sdfInfo := ebpf.SdfFilter{}
-	var err error
+	flowDescription   string
+	actionPosition    int
+	directionPosition int
+	protocolPosition  int
+}
+
+type IPFilterAddress struct {
+	Negated  bool
+	Assigned bool         // The assigned keyword is matched as any, see ParseSdfFilters
+	Address  ebpf.IpWMask // Type 0 for any and assigned
+	Ports    []ebpf.PortRange
+
+	position      int
+	portsPosition int
+}
+
+type IPFilterOption struct {
+	Name  string
+	Value string // Argument of ipoptions, tcpoptions, tcpflags and icmptypes
+
+	position int
+}
+
+// SdfFilterError reports a flow description which is malformed or which the datapath can't enforce.
+type SdfFilterError struct {
+	FlowDescription string
+	Position        int // Byte offset of the offending token
+	Token           string
+	Reason          string
+	// The flow description is well-formed, but the datapath can't enforce its semantics
+	Unsupported bool
+}
+
+func (e *SdfFilterError) Error() string {
+	if e.Unsupported {
+		return fmt.Sprintf("SDF Filter: not supported by the datapath: %s (%q at offset %d of %q)", e.Reason, e.Token, e.Position, e.FlowDescription)
+	}
+	return fmt.Sprintf("SDF Filter: %s (%q at offset %d of %q)", e.Reason, e.Token, e.Position, e.FlowDescription)
+}
+
+var ipFilterProtocols = map[string]uint8{
+	"icmp":      1,
+	"igmp":      2,
+	"tcp":       6,
+	"udp":       17,
+	"gre":       47,
+	"esp":       50,
+	"ah":        51,
+	"icmp6":     58,
+	"ipv6-icmp": 58,
+	"sctp":      132,
+}
+
+// sdfProtocols maps IANA protocol numbers to the protocol codes of the datapath.
+var sdfProtocols = map[uint8]uint8{
+	1:  0,
+	6:  2,
+	17: 3,
+	50: 5,
+	51: 6,
+	58: 4,
+}
+
+const sdfProtocolAny uint8 = 1
+
+var anyPortRange = ebpf.PortRange{LowerBound: 0, UpperBound: 65535}
+
+var ipFilterOptionValues = map[string][]string{
+	"ipoptions":  {"ssrr", "lsrr", "rr", "ts"},
+	"tcpoptions": {"mss", "window", "sack", "ts", "cc"},
+	"tcpflags":   {"fin", "syn", "rst", "psh", "ack", "urg"},
+	"icmptypes":  nil,
+}
+
+type ipFilterToken struct {
+	value    string
+	position int
+}
+
+type ipFilterParser struct {
+	flowDescription string
+	tokens          []ipFilterToken
+	next            int
+}
+
+// ParseSdfFilters parses the flow description into the SDF filters the datapath evaluates. Port lists
+// take a filter for each combination of the source and destination port ranges. The assigned keyword
+// is treated as any: the PDR is already looked up by the UE IP address or the tunnel of the UE.
+func ParseSdfFilters(flowDescription string) ([]ebpf.SdfFilter, error) {
+	rule, err := ParseIPFilterRule(flowDescription)
+	if err != nil {
+		return nil, err
+	}
+	return rule.SdfFilters()
+}
 
-	match := re.FindStringSubmatch(flowDescription)
-	log.Printf("Matched groups: %+q\n", match)
-	if len(match) == 0 {
-		return ebpf.SdfFilter{}, fmt.Errorf("SDF Filter: bad formatting. Should be compatible with regexp: %s", re.String())
+func ParseIPFilterRule(flowDescription string) (IPFilterRule, error) {
+	p := ipFilterParser{flowDescription: flowDescription, tokens: tokenizeFlowDescription(flowDescription)}
+	rule := IPFilterRule{flowDescription: flowDescription}
+
+	action, err := p.take("action")
+	if err != nil {
+		return IPFilterRule{}, err
+	}
+	if action.value != "permit" && action.value != "deny" {
+		return IPFilterRule{}, p.syntaxError(action, "action should be permit or deny")
+	}
+	rule.Action, rule.actionPosition = action.value, action.position
+
+	direction, err := p.take("direction")
+	if err != nil {
+		return IPFilterRule{}, err
+	}
+	if direction.value != "in" && direction.value != "out" {
+		return IPFilterRule{}, p.syntaxError(direction, "direction should be in or out")
+	}
+	rule.Direction, rule.directionPosition = direction.value, direction.position
+
+	protocol, err := p.take("protocol")
+	if err != nil {
+		return IPFilterRule{}, err
 	}
+	if rule.AnyProtocol, rule.Protocol, err = p.parseProtocol(protocol); err != nil {
+		return IPFilterRule{}, err
+	}
+	rule.protocolPosition = protocol.position
 
-	if sdfInfo.Protocol, err = ParseProtocol(match[1]); err != nil {
-		return ebpf.SdfFilter{}, err
+	if err := p.expect("from"); err != nil {
+		return IPFilterRule{}, err
+	}
+	if rule.Source, err = p.parseAddress(); err != nil {
+		return IPFilterRule{}, err
+	}
+	if err := p.expect("to"); err != nil {
+		return IPFilterRule{}, err
+	}
+	if rule.Destination, err = p.parseAddress(); err != nil {
+		return IPFilterRule{}, err
 	}
-	if match[2] == "any" {
-		if match[3] != "" {
-			return ebpf.SdfFilter{}, fmt.Errorf("<any> keyword should not be used with </mask>")
+
+	for p.next < len(p.tokens) {
+		option, err := p.parseOption()
+		if err != nil {
+			return IPFilterRule{}, err
 		}
-		sdfInfo.SrcAddress = ebpf.IpWMask{Type: 0}
-	} else {
-		if sdfInfo.SrcAddress, err = ParseCidrIp(match[2], match[3]); err != nil {
-			return ebpf.SdfFilter{}, err
+		rule.Options = append(rule.Options, option)
+	}
+	return rule, nil
+}
+
+// SdfFilters converts the rule to the SDF filters of the datapath or reports the semantics it can't enforce.
+func (rule IPFilterRule) SdfFilters() ([]ebpf.SdfFilter, error) {
+	if rule.Action != "permit" {
+		return nil, rule.unsupportedError(rule.actionPosition, rule.Action, "action deny")
+	}
+	if rule.Direction != "out" {
+		return nil, rule.unsupportedError(rule.directionPosition, rule.Direction, "direction in")
+	}
+	protocol := sdfProtocolAny
+	if !rule.AnyProtocol {
+		var ok bool
+		if protocol, ok = sdfProtocols[rule.Protocol]; !ok {
+			return nil, rule.unsupportedError(rule.protocolPosition, "", fmt.Sprintf("protocol %d", rule.Protocol))
 		}
 	}
-	sdfInfo.SrcPortRange = ebpf.PortRange{LowerBound: 0, UpperBound: 65535}
-	if match[4] != "" {
-		if sdfInfo.SrcPortRange, err = ParsePortRange(match[4]); err != nil {
-			return ebpf.SdfFilter{}, err
+	for _, address := range []IPFilterAddress{rule.Source, rule.Destination} {
+		if address.Negated {
+			return nil, rule.unsupportedError(address.position, "!", "address negation")
 		}
 	}
-	if match[5] == "assigned" || match[5] == "any" {
-		sdfInfo.DstAddress = ebpf.IpWMask{Type: 0}
-	} else {
-		if sdfInfo.DstAddress, err = ParseCidrIp(match[5], match[6]); err != nil {
-			return ebpf.SdfFilter{}, err
+	if len(rule.Options) != 0 {
+		option := rule.Options[0]
+		return nil, rule.unsupportedError(option.position, option.Name, "option "+option.Name)
+	}
+
+	srcPorts := portRangesOrAny(rule.Source.Ports)
+	dstPorts := portRangesOrAny(rule.Destination.Ports)
+	if count := len(srcPorts) * len(dstPorts); count > ebpf.SdfListSize {
+		position := rule.Source.portsPosition
+		if len(dstPorts) > 1 {
+			position = rule.Destination.portsPosition
 		}
+		return nil, rule.unsupportedError(position, "", fmt.Sprintf("port lists taking %d SDF filters, the limit is %d", count, ebpf.SdfListSize))
 	}
-	sdfInfo.DstPortRange = ebpf.PortRange{LowerBound: 0, UpperBound: 65535}
-	if match[7] != "" {
-		if sdfInfo.DstPortRange, err = ParsePortRange(match[7]); err != nil {
-			return ebpf.SdfFilter{}, err
+
+	sdfFilters := make([]ebpf.SdfFilter, 0, len(srcPorts)*len(dstPorts))
+	for _, srcPort := range srcPorts {
+		for _, dstPort := range dstPorts {
+			sdfFilters = append(sdfFilters, ebpf.SdfFilter{
+				Protocol:     protocol,
+				SrcAddress:   rule.Source.Address,
+				SrcPortRange: srcPort,
+				DstAddress:   rule.Destination.Address,
+				DstPortRange: dstPort,
+			})
 		}
 	}
+	return sdfFilters, nil
+}
 
-	return sdfInfo, nil
+func (rule IPFilterRule) unsupportedError(position int, token string, reason string) error {
+	if token == "" {
+		token = tokenAt(rule.flowDescription, position)
+	}
+	return &SdfFilterError{FlowDescription: rule.flowDescription, Position: position, Token: token, Reason: reason, Unsupported: true}
 }
 
-func ParseProtocol(protocol string) (uint8, error) {
-	if protocol == "58" {
-		protocol = "icmp6"
+func portRangesOrAny(ports []ebpf.PortRange) []ebpf.PortRange {
+	if len(ports) == 0 {
+		return []ebpf.PortRange{anyPortRange}
 	}
-	protocolMap := map[string]uint8{
-		"icmp":  0,
-		"ip":    1,
-		"tcp":   2,
-		"udp":   3,
-		"icmp6": 4,
+	return ports
+}
+
+func tokenizeFlowDescription(flowDescription string) []ipFilterToken {
+	var tokens []ipFilterToken
+	start := -1
+	for i, c := range flowDescription {
+		if c == ' ' || c == '\t' {
+			if start != -1 {
+				tokens = append(tokens, ipFilterToken{value: flowDescription[start:i], position: start})
+				start = -1
+			}
+		} else if start == -1 {
+			start = i
+		}
 	}
-	number, ok := protocolMap[protocol]
-	if ok {
-		return number, nil
-	} else {
-		return 0, fmt.Errorf("Unsupported protocol.")
+	if start != -1 {
+		tokens = append(tokens, ipFilterToken{value: flowDescription[start:], position: start})
+	}
+	return tokens
+}
+
+func tokenAt(flowDescription string, position int) string {
+	for _, token := range tokenizeFlowDescription(flowDescription) {
+		if token.position == position {
+			return token.value
+		}
+	}
+	return ""
+}
+
+func (p *ipFilterParser) syntaxError(token ipFilterToken, reason string) error {
+	return &SdfFilterError{FlowDescription: p.flowDescription, Position: token.position, Token: token.value, Reason: reason}
+}
+
+func (p *ipFilterParser) peek() (ipFilterToken, bool) {
+	if p.next >= len(p.tokens) {
+		return ipFilterToken{position: len(p.flowDescription)}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func (p *ipFilterParser) take(name string) (ipFilterToken, error) {
+	token, ok := p.peek()
+	if !ok {
+		return token, p.syntaxError(token, name+" is missing")
+	}
+	p.next++
+	return token, nil
+}
+
+func (p *ipFilterParser) expect(keyword string) error {
+	token, err := p.take(keyword + " keyword")
+	if err != nil {
+		return err
+	}
+	if token.value != keyword {
+		return p.syntaxError(token, keyword+" keyword expected")
+	}
+	return nil
+}
+
+func (p *ipFilterParser) parseProtocol(token ipFilterToken) (bool, uint8, error) {
+	if token.value == "ip" {
+		return true, 0, nil
+	}
+	if number, ok := ipFilterProtocols[token.value]; ok {
+		return false, number, nil
 	}
+	number, err := strconv.ParseUint(token.value, 10, 8)
+	if err != nil {
+		return false, 0, p.syntaxError(token, "protocol should be ip, a protocol name or a number in [0, 255]")
+	}
+	return false, uint8(number), nil
+}
+
+// parseAddress parses an address with an optional not modifier and an optional port list.
+func (p *ipFilterParser) parseAddress() (IPFilterAddress, error) {
+	address := IPFilterAddress{}
+	token, err := p.take("address")
+	if err != nil {
+		return address, err
+	}
+	address.position = token.position
+	if token.value == "!" {
+		if token, err = p.take("address"); err != nil {
+			return address, err
+		}
+		address.Negated = true
+	} else if strings.HasPrefix(token.value, "!") {
+		token.value = token.value[1:]
+		token.position++
+		address.Negated = true
+	}
+
+	ipStr, maskStr, hasMask := strings.Cut(token.value, "/")
+	switch ipStr {
+	case "any", "assigned":
+		if hasMask {
+			return address, p.syntaxError(token, fmt.Sprintf("%s keyword should not be used with a mask", ipStr))
+		}
+		address.Assigned = ipStr == "assigned"
+		address.Address = ebpf.IpWMask{Type: 0}
+	default:
+		if hasMask && maskStr == "" {
+			return address, p.syntaxError(token, "mask is missing after /")
+		}
+		if address.Address, err = ParseCidrIp(ipStr, maskStr); err != nil {
+			return address, p.syntaxError(token, err.Error())
+		}
+	}
+
+	if token, ok := p.peek(); ok && token.value != "" && token.value[0] >= '0' && token.value[0] <= '9' {
+		p.next++
+		address.portsPosition = token.position
+		if address.Ports, err = p.parsePorts(token); err != nil {
+			return address, err
+		}
+	}
+	return address, nil
+}
+
+// parsePorts parses a comma separated list of ports and port ranges.
+func (p *ipFilterParser) parsePorts(token ipFilterToken) ([]ebpf.PortRange, error) {
+	var ports []ebpf.PortRange
+	position := token.position
+	for _, item := range strings.Split(token.value, ",") {
+		portRange, err := ParsePortRange(item)
+		if err != nil {
+			return nil, p.syntaxError(ipFilterToken{value: item, position: position}, err.Error())
+		}
+		ports = append(ports, portRange)
+		position += len(item) + 1
+	}
+	return ports, nil
+}
+
+func (p *ipFilterParser) parseOption() (IPFilterOption, error) {
+	token, _ := p.take("option")
+	option := IPFilterOption{Name: token.value, position: token.position}
+	switch token.value {
+	case "frag", "established", "setup":
+		return option, nil
+	}
+	values, ok := ipFilterOptionValues[token.value]
+	if !ok {
+		return option, p.syntaxError(token, "unknown option")
+	}
+	spec, err := p.take(token.value + " argument")
+	if err != nil {
+		return option, err
+	}
+	option.Value = spec.value
+	for _, item := range strings.Split(spec.value, ",") {
+		if token.value == "icmptypes" {
+			if _, err := ParsePortRange(item); err != nil {
+				return option, p.syntaxError(spec, "ICMP types should be numbers or ranges")
+			}
+			continue
+		}
+		if !containsString(values, strings.TrimPrefix(item, "!")) {
+			return option, p.syntaxError(spec, fmt.Sprintf("%s argument should be a list of %s", token.value, strings.Join(values, ", ")))
+		}
+	}
+	return option, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func ParseCidrIp(ipStr, maskStr string) (ebpf.IpWMask, error) {
@@ -88,11 +419,11 @@ func ParseCidrIp(ipStr, maskStr string) (ebpf.IpWMask, error) {
 		}
 		mask := net.CIDRMask(8*len(ip), 8*len(ip))
 		if maskStr != "" {
-			if maskUint, err := strconv.ParseUint(maskStr, 10, 64); err == nil {
+			if maskUint, err := strconv.ParseUint(maskStr, 10, 8); err == nil && int(maskUint) <= 8*len(ip) {
 				mask = net.CIDRMask(int(maskUint), 8*len(ip))
 				ip = ip.Mask(mask)
 			} else {
-				return ebpf.IpWMask{}, fmt.Errorf("Bad IP mask formatting.")
+				return ebpf.IpWMask{}, fmt.Errorf("mask should be a number of bits in [0, %d]", 8*len(ip))
 			}
 		}
 		return ebpf.IpWMask{
@@ -101,38 +432,37 @@ func ParseCidrIp(ipStr, maskStr string) (ebpf.IpWMask, error) {
 			Mask: mask,
 		}, nil
 	} else {
-		return ebpf.IpWMask{}, fmt.Errorf("Bad IP formatting.")
+		return ebpf.IpWMask{}, fmt.Errorf("address should be any, assigned or an IP address")
 	}
 }
 
 func ParsePortRange(str string) (ebpf.PortRange, error) {
-	re := regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
-	match := re.FindStringSubmatch(str)
 	portRange := ebpf.PortRange{}
+	lower, upper, isRange := strings.Cut(str, "-")
 	var err error
-	if portRange.LowerBound, err = ParsePort(match[1]); err != nil {
+	if portRange.LowerBound, err = ParsePort(lower); err != nil {
 		return ebpf.PortRange{}, err
 	}
-	if match[2] != "" {
-		if portRange.UpperBound, err = ParsePort(match[2]); err != nil {
+	if isRange {
+		if portRange.UpperBound, err = ParsePort(upper); err != nil {
 			return ebpf.PortRange{}, err
 		}
 	} else {
 		portRange.UpperBound = portRange.LowerBound
 	}
 	if portRange.LowerBound > portRange.UpperBound {
-		return ebpf.PortRange{}, fmt.Errorf("Invalid port range. Left port should be less or equal to right port.")
+		return ebpf.PortRange{}, fmt.Errorf("lower port of a range should be less or equal to the upper port")
 	}
 	return portRange, nil
 }
 
 func ParsePort(str string) (uint16, error) {
-	if port64, err := strconv.ParseUint(str, 10, 64); err == nil {
-		if port64 > 65535 {
-			return 0, fmt.Errorf("Invalid port. Port must be inside bounds [0, 65535].")
-		}
-		return uint16(port64), nil
-	} else {
-		return 0, err
+	port64, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("port should be a number")
+	}
+	if port64 > 65535 {
+		return 0, fmt.Errorf("port should be inside bounds [0, 65535]")
 	}
+	return uint16(port64), nil
 }
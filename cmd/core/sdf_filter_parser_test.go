@@ -1,7 +1,9 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/edgecomllc/eupf/cmd/ebpf"
@@ -33,8 +35,10 @@ func TestSdfFilterParseValid(t *testing.T) {
 	}
 
 	for i := 0; i < len(fds); i++ {
-		if sdfFilter, err := ParseSdfFilter(fds[i].FlowDescription); err == nil {
-			if err := CheckSdfFilterEquality(&sdfFilter, fds[i]); err != nil {
+		if sdfFilters, err := ParseSdfFilters(fds[i].FlowDescription); err == nil {
+			if len(sdfFilters) != 1 {
+				t.Errorf("Iteration %d.\nFlowDescription: %s\nUnexpected SDF filter count: %d", i, fds[i].FlowDescription, len(sdfFilters))
+			} else if err := CheckSdfFilterEquality(&sdfFilters[0], fds[i]); err != nil {
 				t.Errorf("Iteration %d.\nFlowDescription: %s\nError: %s", i, fds[i].FlowDescription, err.Error())
 			}
 		} else {
@@ -69,12 +73,88 @@ func TestSdfFilterParseInvalid(t *testing.T) {
 	}
 
 	for i := 0; i < len(fds); i++ {
-		if _, err := ParseSdfFilter(fds[i]); err == nil {
+		if _, err := ParseSdfFilters(fds[i]); err == nil {
 			t.Errorf("Iteration %d.\nFlowDescription: %s\nAn error should appear when parsing SDF", i, fds[i])
 		}
 	}
 }
 
+func TestSdfFilterParsePortListsAndProtocolNumbers(t *testing.T) {
+	sdfFilters, err := ParseSdfFilters("permit out 6 from 10.60.0.0/16 80,443 to any 1000-2000,3000")
+	if err != nil {
+		t.Fatalf("Unexpected error while parsing SDF filter: %s", err.Error())
+	}
+	if len(sdfFilters) != 4 {
+		t.Fatalf("Unexpected SDF filter count: %d", len(sdfFilters))
+	}
+	expected := []SdfFilterTestStruct{
+		{Protocol: 2, SrcType: 1, SrcAddress: "10.60.0.0", SrcMask: "ffff0000", SrcPortLower: 80, SrcPortUpper: 80,
+			DstType: 0, DstAddress: "<nil>", DstMask: "<nil>", DstPortLower: 1000, DstPortUpper: 2000},
+		{Protocol: 2, SrcType: 1, SrcAddress: "10.60.0.0", SrcMask: "ffff0000", SrcPortLower: 80, SrcPortUpper: 80,
+			DstType: 0, DstAddress: "<nil>", DstMask: "<nil>", DstPortLower: 3000, DstPortUpper: 3000},
+		{Protocol: 2, SrcType: 1, SrcAddress: "10.60.0.0", SrcMask: "ffff0000", SrcPortLower: 443, SrcPortUpper: 443,
+			DstType: 0, DstAddress: "<nil>", DstMask: "<nil>", DstPortLower: 1000, DstPortUpper: 2000},
+		{Protocol: 2, SrcType: 1, SrcAddress: "10.60.0.0", SrcMask: "ffff0000", SrcPortLower: 443, SrcPortUpper: 443,
+			DstType: 0, DstAddress: "<nil>", DstMask: "<nil>", DstPortLower: 3000, DstPortUpper: 3000},
+	}
+	for i := range expected {
+		if err := CheckSdfFilterEquality(&sdfFilters[i], expected[i]); err != nil {
+			t.Errorf("Filter %d: %s", i, err.Error())
+		}
+	}
+
+	for flowDescription, protocol := range map[string]uint8{
+		"permit out 1 from any to assigned":     0,
+		"permit out 17 from any to assigned":    3,
+		"permit out icmp6 from any to assigned": 4,
+	} {
+		if sdfFilters, err := ParseSdfFilters(flowDescription); err != nil {
+			t.Errorf("Unexpected error while parsing %s: %s", flowDescription, err.Error())
+		} else if sdfFilters[0].Protocol != protocol {
+			t.Errorf("Unexpected protocol of %s: %d", flowDescription, sdfFilters[0].Protocol)
+		}
+	}
+}
+
+func TestSdfFilterParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		FlowDescription string
+		Position        int
+		Token           string
+		Unsupported     bool
+	}{
+		// Well-formed, but not enforced by the datapath
+		{"deny out ip from any to assigned", 0, "deny", true},
+		{"permit in ip from assigned to any", 7, "in", true},
+		{"permit out gre from any to assigned", 11, "gre", true},
+		{"permit out 47 from any to assigned", 11, "47", true},
+		{"permit out ip from !10.0.0.0/8 to assigned", 19, "!", true},
+		{"permit out ip from ! 10.0.0.0/8 to assigned", 19, "!", true},
+		{"permit out ip from any to assigned frag", 35, "frag", true},
+		{"permit out tcp from any to assigned setup tcpflags syn,!ack", 36, "setup", true},
+		{"permit out tcp from any 1,2,3 to assigned 4,5", 42, "4,5", true},
+		// Malformed
+		{"permit out udp from any to assigned option 2confidential", 36, "option", false},
+		{"permit out tcp from any to assigned tcpflags fin,bad", 45, "fin,bad", false},
+		{"permit out ip from any 80,90-70 to assigned", 26, "90-70", false},
+		{"permit out ip from 10.62.0.1/33 to assigned", 19, "10.62.0.1/33", false},
+		{"permit out ip from 10.62.0.1", 28, "", false},
+		{"permit out ip to 10.62.0.1 from 8.8.8.8/32", 14, "to", false},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSdfFilters(test.FlowDescription)
+		var sdfFilterError *SdfFilterError
+		if !errors.As(err, &sdfFilterError) {
+			t.Errorf("FlowDescription: %s\nSdfFilterError expected, got: %v", test.FlowDescription, err)
+			continue
+		}
+		if sdfFilterError.Position != test.Position || sdfFilterError.Token != test.Token || sdfFilterError.Unsupported != test.Unsupported {
+			t.Errorf("FlowDescription: %s\nUnexpected error: %+v", test.FlowDescription, *sdfFilterError)
+		}
+	}
+}
+
 type SdfFilterTestStruct struct {
 	FlowDescription string
 	Protocol        uint8
@@ -129,3 +209,25 @@ func CheckSdfFilterEquality(sdfFilter *ebpf.SdfFilter, fd SdfFilterTestStruct) e
 	}
 	return nil
 }
+
+func TestSdfFilterParseAssignedIsAny(t *testing.T) {
+	rule, err := ParseIPFilterRule("permit out udp from 8.8.8.8 53 to assigned")
+	if err != nil {
+		t.Fatalf("Unexpected error while parsing assigned address: %s", err.Error())
+	}
+	if !rule.Destination.Assigned {
+		t.Errorf("Assigned keyword is not recorded")
+	}
+
+	assigned, err := rule.SdfFilters()
+	if err != nil {
+		t.Fatalf("Unexpected error while building SDF filters: %s", err.Error())
+	}
+	anyFilters, err := ParseSdfFilters("permit out udp from 8.8.8.8 53 to any")
+	if err != nil {
+		t.Fatalf("Unexpected error while parsing any address: %s", err.Error())
+	}
+	if !reflect.DeepEqual(assigned, anyFilters) {
+		t.Errorf("Assigned SDF filters %+v differ from any %+v", assigned, anyFilters)
+	}
+}
@@ -15,13 +15,13 @@ type ResourceManager struct {
 
 type FTEIDM struct {
 	freeTEIDs []uint32
-	busyTEIDs map[uint64]map[uint32]uint32 // map[seID]map[pdrID]teid
+	busyTEIDs map[uint64]map[uint32]uint32 // map[seID]map[teid]pdrID
 	sync.RWMutex
 }
 
 type IPAM struct {
 	freeIPs []net.IP
-	busyIPs map[uint64]net.IP
+	busyIPs map[uint64][]net.IP
 	sync.RWMutex
 }
 
@@ -44,7 +44,7 @@ func NewResourceManager(ipRange string, teidRange uint32) (*ResourceManager, err
 
 		ipam = IPAM{
 			freeIPs: freeIPs,
-			busyIPs: make(map[uint64]net.IP),
+			busyIPs: make(map[uint64][]net.IP),
 		}
 	}
 
@@ -77,7 +77,7 @@ func (ipam *IPAM) AllocateIP(key uint64) (net.IP, error) {
 	if len(ipam.freeIPs) > 0 {
 		ip := ipam.freeIPs[0]
 		ipam.freeIPs = ipam.freeIPs[1:]
-		ipam.busyIPs[key] = ip
+		ipam.busyIPs[key] = append(ipam.busyIPs[key], ip)
 		return ip, nil
 	} else {
 		return nil, errors.New("no free ip available")
@@ -93,10 +93,10 @@ func (ipam *FTEIDM) AllocateTEID(seID uint64, pdrID uint32) (uint32, error) {
 		ipam.freeTEIDs = ipam.freeTEIDs[1:]
 		if _, ok := ipam.busyTEIDs[seID]; !ok {
 			pdr := make(map[uint32]uint32)
-			pdr[pdrID] = teid
+			pdr[teid] = pdrID
 			ipam.busyTEIDs[seID] = pdr
 		} else {
-			ipam.busyTEIDs[seID][pdrID] = teid
+			ipam.busyTEIDs[seID][teid] = pdrID
 		}
 		return teid, nil
 	} else {
@@ -107,20 +107,53 @@ func (ipam *FTEIDM) AllocateTEID(seID uint64, pdrID uint32) (uint32, error) {
 func (ipam *IPAM) ReleaseIP(seID uint64) {
 	ipam.Lock()
 	defer ipam.Unlock()
-	if ip, ok := ipam.busyIPs[seID]; ok {
-		ipam.freeIPs = append(ipam.freeIPs, ip)
+	if ips, ok := ipam.busyIPs[seID]; ok {
+		ipam.freeIPs = append(ipam.freeIPs, ips...)
 		delete(ipam.busyIPs, seID)
 	}
 }
 
+// ReleaseSessionIP frees one of the IPs allocated to the session.
+func (ipam *IPAM) ReleaseSessionIP(seID uint64, ip net.IP) {
+	ipam.Lock()
+	defer ipam.Unlock()
+	ips := ipam.busyIPs[seID]
+	for i, busy := range ips {
+		if busy.Equal(ip) {
+			ipam.freeIPs = append(ipam.freeIPs, busy)
+			ips = append(ips[:i], ips[i+1:]...)
+			break
+		}
+	}
+	if len(ips) == 0 {
+		delete(ipam.busyIPs, seID)
+	} else {
+		ipam.busyIPs[seID] = ips
+	}
+}
+
 func (fteidm *FTEIDM) ReleaseTEID(seID uint64) {
 	fteidm.Lock()
 	defer fteidm.Unlock()
 
 	if teid, ok := fteidm.busyTEIDs[seID]; ok {
-		for _, t := range teid {
+		for t := range teid {
 			fteidm.freeTEIDs = append(fteidm.freeTEIDs, t)
 		}
 		delete(fteidm.busyTEIDs, seID)
 	}
 }
+
+// ReleaseSessionTEID frees one of the TEIDs allocated to the session.
+func (fteidm *FTEIDM) ReleaseSessionTEID(seID uint64, teid uint32) {
+	fteidm.Lock()
+	defer fteidm.Unlock()
+
+	if _, ok := fteidm.busyTEIDs[seID][teid]; ok {
+		fteidm.freeTEIDs = append(fteidm.freeTEIDs, teid)
+		delete(fteidm.busyTEIDs[seID], teid)
+		if len(fteidm.busyTEIDs[seID]) == 0 {
+			delete(fteidm.busyTEIDs, seID)
+		}
+	}
+}
@@ -61,3 +61,32 @@ func TestAllocateIP(t *testing.T) {
 	}
 
 }
+
+func TestReleaseSessionResources(t *testing.T) {
+	resourceManager, err := NewResourceManager("10.61.0.0/16", 65536)
+	if err != nil {
+		t.Fatalf("NewResourceManager err: %v", err)
+	}
+
+	ip1, _ := resourceManager.IPAM.AllocateIP(12)
+	ip2, _ := resourceManager.IPAM.AllocateIP(12)
+	resourceManager.IPAM.ReleaseSessionIP(12, ip1)
+	if ips := resourceManager.IPAM.busyIPs[12]; len(ips) != 1 || !ips[0].Equal(ip2) {
+		t.Errorf("Expected: [%v], but got: %v", ip2, ips)
+	}
+	resourceManager.IPAM.ReleaseIP(12)
+	if _, ok := resourceManager.IPAM.busyIPs[12]; ok {
+		t.Errorf("IPs of session not released")
+	}
+
+	teid1, _ := resourceManager.FTEIDM.AllocateTEID(12, 1)
+	teid2, _ := resourceManager.FTEIDM.AllocateTEID(12, 1)
+	resourceManager.FTEIDM.ReleaseSessionTEID(12, teid1)
+	if teids := resourceManager.FTEIDM.busyTEIDs[12]; len(teids) != 1 || teids[teid2] != 1 {
+		t.Errorf("Expected: map[%d:1], but got: %v", teid2, teids)
+	}
+	resourceManager.FTEIDM.ReleaseTEID(12)
+	if _, ok := resourceManager.FTEIDM.busyTEIDs[12]; ok {
+		t.Errorf("TEIDs of session not released")
+	}
+}
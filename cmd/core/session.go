@@ -2,8 +2,10 @@ package core
 
 import (
 	"net"
+	"time"
 
 	"github.com/edgecomllc/eupf/cmd/ebpf"
+	"github.com/wmnsk/go-pfcp/ie"
 )
 
 type Session struct {
@@ -13,6 +15,12 @@ type Session struct {
 	FARs       map[uint32]SFarInfo
 	QERs       map[uint32]SQerInfo
 	URRs       map[uint32]SUrrInfo
+	CpFQCSID   FQCSID
+	// IP addresses of the CP F-SEID
+	CpIPv4 net.IP
+	CpIPv6 net.IP
+	// Downlink packets waiting for the FARs to forward them, nil until the first one arrives
+	downlinkBuffer *downlinkBuffer
 }
 
 func NewSession(localSEID uint64, remoteSEID uint64) *Session {
@@ -26,6 +34,13 @@ func NewSession(localSEID uint64, remoteSEID uint64) *Session {
 	}
 }
 
+// SetCpFSEID stores the F-SEID allocated to the session by the CP function.
+func (s *Session) SetCpFSEID(fseid *ie.FSEIDFields) {
+	s.RemoteSEID = fseid.SEID
+	s.CpIPv4 = fseid.IPv4Address
+	s.CpIPv6 = fseid.IPv6Address
+}
+
 type SPDRInfo struct {
 	PdrID     uint32
 	PdrInfo   ebpf.PdrInfo
@@ -33,6 +48,19 @@ type SPDRInfo struct {
 	Ipv4      net.IP
 	Ipv6      net.IP
 	Allocated bool
+	// Application ID of the PDI. Its SDF filter is resolved from the provisioned PFDs.
+	ApplicationID string
+}
+
+// isApplied reports whether the PDR is installed in the datapath. PDRs of an application
+// without flow description PFDs would match all traffic, so they are kept only in the session.
+func (spdrInfo SPDRInfo) isApplied() bool {
+	return spdrInfo.ApplicationID == "" || len(spdrInfo.PdrInfo.SdfFilters) != 0
+}
+
+// downlinkNetworkInstance returns the network instance of the UE address the downlink PDR is keyed by.
+func (spdrInfo SPDRInfo) downlinkNetworkInstance() uint32 {
+	return downlinkNetworkInstance(spdrInfo.PdrInfo.NetworkInstance)
 }
 
 type SFarInfo struct {
@@ -46,9 +74,33 @@ type SQerInfo struct {
 }
 
 type SUrrInfo struct {
-	UrrInfo         ebpf.UrrInfo
-	GlobalId        uint32
-	ReportSeqNumber uint32
+	UrrInfo           ebpf.UrrInfo
+	GlobalId          uint32
+	ReportSeqNumber   uint32
+	MeasurementMethod uint8
+	ReportingTriggers uint32
+	VolumeThreshold   UrrVolume
+	VolumeQuota       UrrVolume
+	QuotaExhausted    bool
+	// Counters already covered by the previous usage reports.
+	ReportedVolume     UrrVolume
+	TimeThreshold      time.Duration
+	TimeQuota          time.Duration
+	TimeQuotaStart     time.Time
+	TimeQuotaExhausted bool
+	// Start of the ongoing measurement, the end of the previously reported one.
+	StartTime          time.Time
+	MeasurementPeriod  time.Duration
+	NextPeriodicReport time.Time
+}
+
+// UrrVolume describes a volume threshold, quota or measurement. Flags use the
+// TOVOL, ULVOL and DLVOL bits of the Volume Threshold IE.
+type UrrVolume struct {
+	Flags    uint8
+	Total    uint64
+	Uplink   uint64
+	Downlink uint64
 }
 
 func (s *Session) NewFar(id uint32, internalId uint32, farInfo ebpf.FarInfo) {
@@ -97,16 +149,12 @@ func (s *Session) RemoveQer(id uint32) SQerInfo {
 	return sQerInfo
 }
 
-func (s *Session) NewUrr(id uint32, internalId uint32, urrInfo ebpf.UrrInfo) {
-	s.URRs[id] = SUrrInfo{
-		UrrInfo:  urrInfo,
-		GlobalId: internalId,
-	}
+func (s *Session) NewUrr(id uint32, internalId uint32, sUrrInfo SUrrInfo) {
+	sUrrInfo.GlobalId = internalId
+	s.URRs[id] = sUrrInfo
 }
 
-func (s *Session) UpdateUrr(id uint32, urrInfo ebpf.UrrInfo) {
-	sUrrInfo := s.URRs[id]
-	sUrrInfo.UrrInfo = urrInfo
+func (s *Session) UpdateUrr(id uint32, sUrrInfo SUrrInfo) {
 	s.URRs[id] = sUrrInfo
 }
 
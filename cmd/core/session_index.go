@@ -0,0 +1,120 @@
+package core
+
+const (
+	// Bits of the local SEID left to the counter below the instance prefix
+	seidPrefixShift = 48
+	// Lowest counter value, keeping the numbering of the former per-association counters
+	firstLocalSEID = 2
+)
+
+type indexedSession struct {
+	association *NodeAssociation
+	session     *Session
+	// Global IDs of the URRs and FARs the session had when it was added
+	urrIds []uint32
+	farIds []uint32
+}
+
+// sessionIndex allocates local SEIDs unique across all associations of the node
+// and finds sessions by them, or by the global IDs of their URRs and FARs.
+type sessionIndex struct {
+	prefix   uint64
+	lastSEID uint64
+	sessions map[uint64]indexedSession
+	urrs     map[uint32]uint64 // URR global ID -> local SEID
+	fars     map[uint32]uint64 // FAR global ID -> local SEID
+}
+
+func newSessionIndex(prefix uint32) sessionIndex {
+	return sessionIndex{
+		prefix:   uint64(prefix) << seidPrefixShift,
+		sessions: map[uint64]indexedSession{},
+		urrs:     map[uint32]uint64{},
+		fars:     map[uint32]uint64{},
+	}
+}
+
+// NewLocalSEID returns a SEID not used by any session of the node. The counter wraps
+// around skipping the SEIDs still in use.
+func (index *sessionIndex) NewLocalSEID() uint64 {
+	const counterMask = 1<<seidPrefixShift - 1
+	for {
+		index.lastSEID = max((index.lastSEID+1)&counterMask, firstLocalSEID)
+		seid := index.prefix | index.lastSEID
+		if _, ok := index.sessions[seid]; !ok {
+			return seid
+		}
+	}
+}
+
+// Add stores the session under its local SEID, or moves it to another association. A session already stored
+// is added again once its URRs or FARs are changed.
+func (index *sessionIndex) Add(association *NodeAssociation, session *Session) {
+	if index.sessions == nil {
+		index.sessions = map[uint64]indexedSession{}
+		index.urrs = map[uint32]uint64{}
+		index.fars = map[uint32]uint64{}
+	}
+	index.removeRules(session.LocalSEID)
+	indexed := indexedSession{association: association, session: session}
+	for _, sUrrInfo := range session.URRs {
+		index.urrs[sUrrInfo.GlobalId] = session.LocalSEID
+		indexed.urrIds = append(indexed.urrIds, sUrrInfo.GlobalId)
+	}
+	for _, sFarInfo := range session.FARs {
+		index.fars[sFarInfo.GlobalId] = session.LocalSEID
+		indexed.farIds = append(indexed.farIds, sFarInfo.GlobalId)
+	}
+	index.sessions[session.LocalSEID] = indexed
+}
+
+func (index *sessionIndex) Remove(seid uint64) {
+	index.removeRules(seid)
+	delete(index.sessions, seid)
+}
+
+// removeRules drops the URRs and FARs of the session, unless their global IDs are already reused by another session.
+func (index *sessionIndex) removeRules(seid uint64) {
+	for _, urrId := range index.sessions[seid].urrIds {
+		if index.urrs[urrId] == seid {
+			delete(index.urrs, urrId)
+		}
+	}
+	for _, farId := range index.sessions[seid].farIds {
+		if index.fars[farId] == seid {
+			delete(index.fars, farId)
+		}
+	}
+}
+
+// Find returns the session with the local SEID together with its association.
+func (index *sessionIndex) Find(seid uint64) (*NodeAssociation, *Session) {
+	if indexed, ok := index.sessions[seid]; ok {
+		return indexed.association, indexed.session
+	}
+	return nil, nil
+}
+
+// FindUrr returns the session with the URR of the global ID together with its association.
+func (index *sessionIndex) FindUrr(globalId uint32) (*NodeAssociation, *Session) {
+	if seid, ok := index.urrs[globalId]; ok {
+		return index.Find(seid)
+	}
+	return nil, nil
+}
+
+// FindFar returns the session with the FAR of the global ID together with its association, and the FAR ID
+// within the session.
+func (index *sessionIndex) FindFar(globalId uint32) (*NodeAssociation, *Session, uint32) {
+	seid, ok := index.fars[globalId]
+	if !ok {
+		return nil, nil, 0
+	}
+	association, session := index.Find(seid)
+	for farId, sFarInfo := range session.FARs {
+		if sFarInfo.GlobalId == globalId {
+			return association, session, farId
+		}
+	}
+	return nil, nil, 0
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// sessionModification stages the changes of a Session Modification Request. Either all of them are
+// committed, or the map writes are undone and the session is restored as it was before the request.
+type sessionModification struct {
+	conn     *PfcpConnection
+	session  *Session
+	previous Session
+	// Map writes to undo, in the order they were made
+	undo []func() error
+	// Rules removed from the session, deleted from the maps only once all changes are applied
+	removedFARs []SFarInfo
+	removedQERs []SQerInfo
+	removedURRs []removedURR
+	removedPDRs []SPDRInfo
+	// FARs updated by the request, the CP function may be notified about their buffered packets again
+	updatedFARs []uint32
+	// Type of the IE being applied, reported as the Offending IE if it fails
+	offendingIE uint16
+}
+
+type removedURR struct {
+	urrId    uint32
+	sUrrInfo SUrrInfo
+}
+
+func newSessionModification(conn *PfcpConnection, session *Session) *sessionModification {
+	return &sessionModification{
+		conn:     conn,
+		session:  session,
+		previous: session.clone(),
+	}
+}
+
+// clone copies the session along with its rule tables.
+func (s *Session) clone() Session {
+	clone := *s
+	clone.PDRs = make(map[uint32]SPDRInfo, len(s.PDRs))
+	for id, pdr := range s.PDRs {
+		clone.PDRs[id] = pdr
+	}
+	clone.FARs = make(map[uint32]SFarInfo, len(s.FARs))
+	for id, far := range s.FARs {
+		clone.FARs[id] = far
+	}
+	clone.QERs = make(map[uint32]SQerInfo, len(s.QERs))
+	for id, qer := range s.QERs {
+		clone.QERs[id] = qer
+	}
+	clone.URRs = make(map[uint32]SUrrInfo, len(s.URRs))
+	for id, urr := range s.URRs {
+		clone.URRs[id] = urr
+	}
+	return clone
+}
+
+// Apply records the IE type being applied to report it as the Offending IE.
+func (modification *sessionModification) Apply(ieType uint16) {
+	modification.offendingIE = ieType
+}
+
+// Record adds the undo operation of a map write.
+func (modification *sessionModification) Record(undo func() error) {
+	modification.undo = append(modification.undo, undo)
+}
+
+// Allocated records the release of a TEID or UE IP allocated to the session, undone along with the map writes.
+func (modification *sessionModification) Allocated(release func()) {
+	modification.Record(func() error {
+		release()
+		return nil
+	})
+}
+
+// releaseUnused frees the TEIDs and UE IPs allocated to the PDRs before the modification, which no PDR uses anymore.
+func (modification *sessionModification) releaseUnused() {
+	resourceManager := modification.conn.ResourceManager
+	if resourceManager == nil {
+		return
+	}
+	session := modification.session
+	for _, previous := range modification.previous.PDRs {
+		if !previous.Allocated {
+			continue
+		}
+		if previous.Teid != 0 && resourceManager.FTEIDM != nil && !session.usesTEID(previous.Teid) {
+			resourceManager.FTEIDM.ReleaseSessionTEID(session.LocalSEID, previous.Teid)
+		}
+		if previous.Ipv4 != nil && resourceManager.IPAM != nil && !session.usesUEIP(previous.Ipv4) {
+			resourceManager.IPAM.ReleaseSessionIP(session.LocalSEID, previous.Ipv4)
+		}
+	}
+}
+
+// usesTEID and usesUEIP report whether any PDR of the session matches the TEID or the UE IP.
+func (s *Session) usesTEID(teid uint32) bool {
+	for _, spdrInfo := range s.PDRs {
+		if spdrInfo.Teid == teid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Session) usesUEIP(ip net.IP) bool {
+	for _, spdrInfo := range s.PDRs {
+		if spdrInfo.Ipv4.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rollback undoes the map writes and allocations in reverse order and restores the session.
+func (modification *sessionModification) Rollback() {
+	for i := len(modification.undo) - 1; i >= 0; i-- {
+		if err := modification.undo[i](); err != nil {
+			log.Error().Err(err).Msgf("Failed to roll back modification of session: %d", modification.session.LocalSEID)
+		}
+	}
+	*modification.session = modification.previous
+}
+
+// Commit deletes the removed rules from the maps and returns the usage reports of the removed URRs.
+func (modification *sessionModification) Commit() []*ie.IE {
+	mapOperations := modification.conn.mapOperations
+	modification.releaseUnused()
+	for _, far := range modification.removedFARs {
+		if err := mapOperations.DeleteFar(far.GlobalId); err != nil {
+			log.Error().Err(err).Msg("Can't remove FAR")
+		}
+	}
+	for _, qer := range modification.removedQERs {
+		if err := mapOperations.DeleteQer(qer.GlobalId); err != nil {
+			log.Error().Err(err).Msg("Can't remove QER")
+		}
+	}
+	usageReports := make([]*ie.IE, 0, len(modification.removedURRs))
+	for _, removed := range modification.removedURRs {
+		err, urrInfo := mapOperations.DeleteUrr(removed.sUrrInfo.GlobalId)
+		if err != nil {
+			log.Error().Err(err).Msg("Can't remove URR")
+			continue
+		}
+		usageReports = append(usageReports, ie.NewUsageReportWithinSessionModificationResponse(
+			removed.sUrrInfo.newUsageReport(removed.urrId, usageReportTriggerTERMR, urrInfo, time.Now())...,
+		))
+	}
+	return usageReports
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// parseSessionRetentionInformation returns the CP PFCP entity IP addresses of the PFCP Session Retention Information.
+func parseSessionRetentionInformation(retention *ie.IE) ([]net.IP, error) {
+	ies, err := retention.PFCPSessionRetentionInformation()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []net.IP
+	for _, cpEntityIPAddress := range ies {
+		if cpEntityIPAddress.Type != ie.CPPFCPEntityIPAddress {
+			continue
+		}
+		fields, err := cpEntityIPAddress.CPPFCPEntityIPAddress()
+		if err != nil {
+			return nil, err
+		}
+		if fields.IPv4Address != nil {
+			addresses = append(addresses, fields.IPv4Address)
+		}
+		if fields.IPv6Address != nil {
+			addresses = append(addresses, fields.IPv6Address)
+		}
+	}
+	return addresses, nil
+}
+
+// isRetained reports whether the CP F-SEID of the session contains any of the CP PFCP entity IP addresses.
+// Without addresses all sessions of the association are retained.
+func (s *Session) isRetained(cpAddresses []net.IP) bool {
+	if len(cpAddresses) == 0 {
+		return true
+	}
+	for _, address := range cpAddresses {
+		if address.Equal(s.CpIPv4) || address.Equal(s.CpIPv6) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplaceAssociation replaces the existing association of a CP function that set up the PFCP association again.
+// The sessions requested to be retained move to the new association, the other sessions are deleted.
+func (connection *PfcpConnection) ReplaceAssociation(existing *NodeAssociation, association *NodeAssociation, retain bool, cpAddresses []net.IP) {
+	existing.StopHeartbeat()
+	for sessionId, session := range existing.Sessions {
+		connection.sessionSets.Remove(session)
+		if retain && session.isRetained(cpAddresses) {
+			log.Info().Msgf("Retaining session: %d", sessionId)
+			association.Sessions[sessionId] = session
+			connection.sessions.Add(association, session)
+			connection.sessionSets.Add(association, session)
+			continue
+		}
+		log.Info().Msgf("Deleting session: %d", sessionId)
+		connection.DeleteSession(session)
+		connection.ReleaseResources(sessionId)
+	}
+	connection.NodeAssociations[association.ID] = association
+}
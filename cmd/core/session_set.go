@@ -0,0 +1,78 @@
+package core
+
+import (
+	"net"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// FQCSID identifies the set of sessions a CP function allocated the same CSIDs to.
+type FQCSID struct {
+	NodeAddress string
+	CSIDs       []uint16
+}
+
+type csidKey struct {
+	NodeAddress string
+	CSID        uint16
+}
+
+func parseFQCSID(fqcsid *ie.IE) (FQCSID, error) {
+	nodeAddress, err := fqcsid.NodeAddress()
+	if err != nil {
+		return FQCSID{}, err
+	}
+	csids, err := fqcsid.CSIDs()
+	if err != nil {
+		return FQCSID{}, err
+	}
+	return FQCSID{
+		NodeAddress: net.IP(nodeAddress).String(),
+		CSIDs:       csids,
+	}, nil
+}
+
+func (fqcsid FQCSID) keys() []csidKey {
+	keys := make([]csidKey, 0, len(fqcsid.CSIDs))
+	for _, csid := range fqcsid.CSIDs {
+		keys = append(keys, csidKey{NodeAddress: fqcsid.NodeAddress, CSID: csid})
+	}
+	return keys
+}
+
+// sessionSetIndex finds sessions by the CP FQ-CSID received in Session Establishment and Modification.
+type sessionSetIndex struct {
+	sessions map[csidKey]map[*Session]*NodeAssociation
+}
+
+func (index *sessionSetIndex) Add(association *NodeAssociation, session *Session) {
+	if index.sessions == nil {
+		index.sessions = map[csidKey]map[*Session]*NodeAssociation{}
+	}
+	for _, key := range session.CpFQCSID.keys() {
+		if _, ok := index.sessions[key]; !ok {
+			index.sessions[key] = map[*Session]*NodeAssociation{}
+		}
+		index.sessions[key][session] = association
+	}
+}
+
+func (index *sessionSetIndex) Remove(session *Session) {
+	for _, key := range session.CpFQCSID.keys() {
+		delete(index.sessions[key], session)
+		if len(index.sessions[key]) == 0 {
+			delete(index.sessions, key)
+		}
+	}
+}
+
+// Find returns the sessions matching any CSID of the FQ-CSID together with their associations.
+func (index *sessionSetIndex) Find(fqcsid FQCSID) map[*Session]*NodeAssociation {
+	found := map[*Session]*NodeAssociation{}
+	for _, key := range fqcsid.keys() {
+		for session, association := range index.sessions[key] {
+			found[session] = association
+		}
+	}
+	return found
+}
@@ -53,7 +53,7 @@ func TestSessionUEIpOverwrite(t *testing.T) {
 	if nodeId != "test-node" {
 		t.Errorf("Unexpected node ID in association setup response: %s", nodeId)
 	}
-	if _, ok := pfcpConn.NodeAssociations[smfIP]; !ok {
+	if _, ok := pfcpConn.NodeAssociations["test"]; !ok {
 		t.Errorf("Association not created")
 	}
 
@@ -106,10 +106,10 @@ func TestSessionUEIpOverwrite(t *testing.T) {
 	}
 
 	// Check that session PDRs are correct
-	if pfcpConn.NodeAssociations[smfIP].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
+	if pfcpConn.NodeAssociations["test"].Sessions[2].PDRs[1].Ipv4.String() != "1.1.1.1" {
 		t.Errorf("Session 1, got broken")
 	}
-	if pfcpConn.NodeAssociations[smfIP].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
+	if pfcpConn.NodeAssociations["test"].Sessions[3].PDRs[1].Ipv4.String() != "2.2.2.2" {
 		t.Errorf("Session 2, got broken")
 	}
 
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// InSameSMFSet reports whether both CP functions announced the same SMF Set ID.
+func (association *NodeAssociation) InSameSMFSet(other *NodeAssociation) bool {
+	return association.SMFSetID != "" && association.SMFSetID == other.SMFSetID
+}
+
+// findSMFSetPeer returns another association with an SMF of the same SMF set.
+func (connection *PfcpConnection) findSMFSetPeer(association *NodeAssociation) *NodeAssociation {
+	for _, peer := range connection.NodeAssociations {
+		if peer != association && peer.InSameSMFSet(association) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// takeOverSession moves the session to the association of another SMF of the same SMF set.
+func (connection *PfcpConnection) takeOverSession(owner *NodeAssociation, association *NodeAssociation, session *Session) {
+	log.Info().Msgf("Session %d taken over from NodeID: %s by NodeID: %s", session.LocalSEID, owner.ID, association.ID)
+	delete(owner.Sessions, session.LocalSEID)
+	association.Sessions[session.LocalSEID] = session
+	connection.sessions.Add(association, session)
+	connection.sessionSets.Remove(session)
+	connection.sessionSets.Add(association, session)
+}
+
+// FailAssociation deletes the association with a failed CP function. Its sessions are kept by
+// another SMF of the same SMF set, which is expected to take them over.
+func (connection *PfcpConnection) FailAssociation(nodeID string) {
+	association := connection.GetAssociation(nodeID)
+	if association == nil {
+		return
+	}
+	if peer := connection.findSMFSetPeer(association); peer != nil {
+		for _, session := range association.Sessions {
+			connection.takeOverSession(association, peer, session)
+		}
+	}
+	connection.DeleteAssociation(nodeID)
+}
@@ -0,0 +1,346 @@
+package core
+
+import (
+	"time"
+
+	"github.com/edgecomllc/eupf/cmd/ebpf"
+	"github.com/rs/zerolog/log"
+	"github.com/wmnsk/go-pfcp/ie"
+	"github.com/wmnsk/go-pfcp/message"
+)
+
+// Reporting Triggers and Usage Report Trigger flags, TS 29.244 8.2.19 and 8.2.41.
+// Bit N of octet 5 + M is stored as bit N + 8*M.
+const (
+	reportingTriggerPERIO uint32 = 1 << 0
+	reportingTriggerVOLTH uint32 = 1 << 1
+	reportingTriggerTIMTH uint32 = 1 << 2
+	reportingTriggerVOLQU uint32 = 1 << 8
+
+	usageReportTriggerPERIO uint32 = 1 << 0
+	usageReportTriggerVOLTH uint32 = 1 << 1
+	usageReportTriggerTIMTH uint32 = 1 << 2
+	usageReportTriggerIMMER uint32 = 1 << 7
+	usageReportTriggerVOLQU uint32 = 1 << 8
+	usageReportTriggerTIMQU uint32 = 1 << 9
+	usageReportTriggerTERMR uint32 = 1 << 11
+)
+
+// Measurement Method flags, TS 29.244 8.2.40.
+const (
+	measurementMethodDURAT uint8 = 1 << 0
+	measurementMethodVOLUM uint8 = 1 << 1
+)
+
+const (
+	volumeFlagTOVOL uint8 = 1 << 0
+	volumeFlagULVOL uint8 = 1 << 1
+	volumeFlagDLVOL uint8 = 1 << 2
+)
+
+func composeTriggers(octets []byte) uint32 {
+	triggers := uint32(0)
+	for i, octet := range octets {
+		if i > 3 {
+			break
+		}
+		triggers |= uint32(octet) << (8 * i)
+	}
+	return triggers
+}
+
+func newUsageReportTrigger(trigger uint32) *ie.IE {
+	return ie.NewUsageReportTrigger(uint8(trigger), uint8(trigger>>8), uint8(trigger>>16))
+}
+
+func newUrrVolume(counters ebpf.UrrInfo) UrrVolume {
+	return UrrVolume{
+		Flags:    volumeFlagTOVOL | volumeFlagULVOL | volumeFlagDLVOL,
+		Total:    counters.UplinkVolume + counters.DownlinkVolume,
+		Uplink:   counters.UplinkVolume,
+		Downlink: counters.DownlinkVolume,
+	}
+}
+
+// Sub returns the volume measured since the previous one.
+func (volume UrrVolume) Sub(previous UrrVolume) UrrVolume {
+	return UrrVolume{
+		Flags:    volume.Flags,
+		Total:    volume.Total - previous.Total,
+		Uplink:   volume.Uplink - previous.Uplink,
+		Downlink: volume.Downlink - previous.Downlink,
+	}
+}
+
+// Reaches reports whether any of the limits set in the flags is reached by the measured volume.
+func (volume UrrVolume) Reaches(measured UrrVolume) bool {
+	return (volume.Flags&volumeFlagTOVOL != 0 && measured.Total >= volume.Total) ||
+		(volume.Flags&volumeFlagULVOL != 0 && measured.Uplink >= volume.Uplink) ||
+		(volume.Flags&volumeFlagDLVOL != 0 && measured.Downlink >= volume.Downlink)
+}
+
+// Consume decreases the limit by the measured volume, it never goes below zero.
+func (volume UrrVolume) Consume(measured UrrVolume) UrrVolume {
+	saturatingSub := func(a, b uint64) uint64 {
+		if a < b {
+			return 0
+		}
+		return a - b
+	}
+	return UrrVolume{
+		Flags:    volume.Flags,
+		Total:    saturatingSub(volume.Total, measured.Total),
+		Uplink:   saturatingSub(volume.Uplink, measured.Uplink),
+		Downlink: saturatingSub(volume.Downlink, measured.Downlink),
+	}
+}
+
+// usageReportTrigger checks the URR counters and the measured duration against the provisioned thresholds and quotas.
+// Zero is returned when no report is needed.
+func (sUrrInfo *SUrrInfo) usageReportTrigger(counters ebpf.UrrInfo, now time.Time) uint32 {
+	measured := newUrrVolume(counters).Sub(sUrrInfo.ReportedVolume)
+	trigger := uint32(0)
+	if sUrrInfo.ReportingTriggers&reportingTriggerPERIO != 0 && sUrrInfo.MeasurementPeriod != 0 &&
+		!now.Before(sUrrInfo.NextPeriodicReport) {
+		trigger |= usageReportTriggerPERIO
+	}
+	if sUrrInfo.ReportingTriggers&reportingTriggerVOLTH != 0 && sUrrInfo.VolumeThreshold.Flags != 0 &&
+		sUrrInfo.VolumeThreshold.Reaches(measured) {
+		trigger |= usageReportTriggerVOLTH
+	}
+	// Quota exhaustion is reported even if the CP function didn't set VOLQU explicitly.
+	if sUrrInfo.VolumeQuota.Flags != 0 && !sUrrInfo.QuotaExhausted && sUrrInfo.VolumeQuota.Reaches(measured) {
+		trigger |= usageReportTriggerVOLQU
+	}
+	if sUrrInfo.MeasurementMethod&measurementMethodDURAT != 0 {
+		if sUrrInfo.ReportingTriggers&reportingTriggerTIMTH != 0 && sUrrInfo.TimeThreshold != 0 &&
+			now.Sub(sUrrInfo.StartTime) >= sUrrInfo.TimeThreshold {
+			trigger |= usageReportTriggerTIMTH
+		}
+		if sUrrInfo.TimeQuota != 0 && !sUrrInfo.TimeQuotaExhausted && now.Sub(sUrrInfo.TimeQuotaStart) >= sUrrInfo.TimeQuota {
+			trigger |= usageReportTriggerTIMQU
+		}
+	}
+	return trigger
+}
+
+// reportsVolume and reportsDuration keep reporting both measurements for URRs provisioned without Measurement Method.
+func (sUrrInfo *SUrrInfo) reportsVolume() bool {
+	return sUrrInfo.MeasurementMethod == 0 || sUrrInfo.MeasurementMethod&measurementMethodVOLUM != 0
+}
+
+func (sUrrInfo *SUrrInfo) reportsDuration() bool {
+	return sUrrInfo.MeasurementMethod == 0 || sUrrInfo.MeasurementMethod&measurementMethodDURAT != 0
+}
+
+// newUsageReport builds the content of a Usage Report IE for the volume measured since the previous report
+// and starts a new measurement.
+func (sUrrInfo *SUrrInfo) newUsageReport(urrId uint32, trigger uint32, counters ebpf.UrrInfo, now time.Time) []*ie.IE {
+	volume := newUrrVolume(counters)
+	measured := volume.Sub(sUrrInfo.ReportedVolume)
+
+	if sUrrInfo.VolumeQuota.Flags != 0 {
+		sUrrInfo.VolumeQuota = sUrrInfo.VolumeQuota.Consume(measured)
+	}
+	if trigger&usageReportTriggerVOLQU != 0 {
+		sUrrInfo.QuotaExhausted = true
+	}
+	if trigger&usageReportTriggerTIMQU != 0 {
+		sUrrInfo.TimeQuotaExhausted = true
+	}
+	if trigger&usageReportTriggerPERIO != 0 {
+		// Periods are not shifted by reports sent for other triggers
+		for !now.Before(sUrrInfo.NextPeriodicReport) {
+			sUrrInfo.NextPeriodicReport = sUrrInfo.NextPeriodicReport.Add(sUrrInfo.MeasurementPeriod)
+		}
+	}
+	startTime := sUrrInfo.StartTime
+	sUrrInfo.ReportedVolume = volume
+	sUrrInfo.ReportSeqNumber = sUrrInfo.ReportSeqNumber + 1
+	sUrrInfo.StartTime = now
+
+	usageReport := []*ie.IE{
+		ie.NewURRID(urrId),
+		ie.NewURSEQN(sUrrInfo.ReportSeqNumber),
+		newUsageReportTrigger(trigger),
+		ie.NewStartTime(startTime),
+		ie.NewEndTime(now),
+	}
+	if sUrrInfo.reportsVolume() {
+		usageReport = append(usageReport, ie.NewVolumeMeasurement(measured.Flags, measured.Total, measured.Uplink, measured.Downlink, 0, 0, 0))
+	}
+	if sUrrInfo.reportsDuration() {
+		usageReport = append(usageReport, ie.NewDurationMeasurement(now.Sub(startTime)))
+	}
+	return usageReport
+}
+
+// updateVolumeLimits translates the volume threshold and the remaining quota to the absolute counter values
+// enforced by the datapath.
+func (sUrrInfo *SUrrInfo) updateVolumeLimits() {
+	urrInfo := &sUrrInfo.UrrInfo
+	reported := sUrrInfo.ReportedVolume
+	urrInfo.VolumeFlags = 0
+
+	threshold := sUrrInfo.VolumeThreshold
+	if sUrrInfo.ReportingTriggers&reportingTriggerVOLTH != 0 {
+		if threshold.Flags&volumeFlagTOVOL != 0 {
+			urrInfo.TotalThreshold = reported.Total + threshold.Total
+			urrInfo.VolumeFlags |= ebpf.UrrTotalThreshold
+		}
+		if threshold.Flags&volumeFlagULVOL != 0 {
+			urrInfo.UplinkThreshold = reported.Uplink + threshold.Uplink
+			urrInfo.VolumeFlags |= ebpf.UrrUplinkThreshold
+		}
+		if threshold.Flags&volumeFlagDLVOL != 0 {
+			urrInfo.DownlinkThreshold = reported.Downlink + threshold.Downlink
+			urrInfo.VolumeFlags |= ebpf.UrrDownlinkThreshold
+		}
+	}
+
+	quota := sUrrInfo.VolumeQuota
+	if quota.Flags&volumeFlagTOVOL != 0 {
+		urrInfo.TotalQuota = reported.Total + quota.Total
+		urrInfo.VolumeFlags |= ebpf.UrrTotalQuota
+	}
+	if quota.Flags&volumeFlagULVOL != 0 {
+		urrInfo.UplinkQuota = reported.Uplink + quota.Uplink
+		urrInfo.VolumeFlags |= ebpf.UrrUplinkQuota
+	}
+	if quota.Flags&volumeFlagDLVOL != 0 {
+		urrInfo.DownlinkQuota = reported.Downlink + quota.Downlink
+		urrInfo.VolumeFlags |= ebpf.UrrDownlinkQuota
+	}
+
+	urrInfo.Status = 0
+	if sUrrInfo.QuotaExhausted || sUrrInfo.TimeQuotaExhausted {
+		urrInfo.Status |= ebpf.UrrStatusQuotaExhausted
+	}
+}
+
+// collectUsageReports builds Usage Reports for every URR of the session which reached its threshold, quota
+// or the end of its measurement period.
+func collectUsageReports(session *Session, mapOperations ebpf.ForwardingPlaneController, now time.Time) []*ie.IE {
+	usageReports := []*ie.IE{}
+	for urrId, sUrrInfo := range session.URRs {
+		counters, err := mapOperations.GetUrr(sUrrInfo.GlobalId)
+		if err != nil {
+			log.Warn().Msgf("Can't read URR counters: %d, %s", urrId, err.Error())
+			continue
+		}
+		trigger := sUrrInfo.usageReportTrigger(counters, now)
+		if trigger == 0 {
+			continue
+		}
+		usageReports = append(usageReports, ie.NewUsageReportWithinSessionReportRequest(
+			reportUrr(session, mapOperations, urrId, trigger, counters, now)...,
+		))
+	}
+	return usageReports
+}
+
+// reportUrr builds the content of a Usage Report IE of the session URR and starts a new measurement.
+func reportUrr(session *Session, mapOperations ebpf.ForwardingPlaneController, urrId uint32, trigger uint32, counters ebpf.UrrInfo, now time.Time) []*ie.IE {
+	sUrrInfo := session.GetUrr(urrId)
+	usageReport := sUrrInfo.newUsageReport(urrId, trigger, counters, now)
+	// Rearm the threshold and keep the datapath blocking traffic once the quota is exhausted
+	sUrrInfo.updateVolumeLimits()
+	if err := mapOperations.UpdateUrr(sUrrInfo.GlobalId, sUrrInfo.UrrInfo); err != nil {
+		log.Warn().Msgf("Can't update URR: %d, %s", urrId, err.Error())
+	}
+	session.UpdateUrr(urrId, sUrrInfo)
+	return usageReport
+}
+
+// queryUsageReports builds immediate Usage Reports for the URRs queried in a Session Modification Request,
+// either by Query URR IEs or, with the QAURR flag, all URRs of the session. The URRs keep measuring.
+func queryUsageReports(session *Session, req *message.SessionModificationRequest, mapOperations ebpf.ForwardingPlaneController, now time.Time) []*ie.IE {
+	var urrIds []uint32
+	if req.PFCPSMReqFlags != nil && req.PFCPSMReqFlags.HasQAURR() {
+		for urrId := range session.URRs {
+			urrIds = append(urrIds, urrId)
+		}
+	} else {
+		for _, queryUrr := range req.QueryURR {
+			urrId, err := queryUrr.URRID()
+			if err != nil {
+				log.Warn().Msgf("Ignoring Query URR without URR ID: %s", err.Error())
+				continue
+			}
+			if _, ok := session.URRs[urrId]; !ok {
+				log.Warn().Msgf("Ignoring Query URR of unknown URR: %d", urrId)
+				continue
+			}
+			urrIds = append(urrIds, urrId)
+		}
+	}
+
+	usageReports := make([]*ie.IE, 0, len(urrIds))
+	for _, urrId := range urrIds {
+		sUrrInfo := session.GetUrr(urrId)
+		counters, err := mapOperations.GetUrr(sUrrInfo.GlobalId)
+		if err != nil {
+			log.Warn().Msgf("Can't read URR counters: %d, %s", urrId, err.Error())
+			continue
+		}
+		// Triggers met at the same time are reported along with the immediate report
+		trigger := usageReportTriggerIMMER | sUrrInfo.usageReportTrigger(counters, now)
+		usageReport := reportUrr(session, mapOperations, urrId, trigger, counters, now)
+		if req.QueryURRReference != nil {
+			if reference, err := req.QueryURRReference.QueryURRReference(); err == nil {
+				usageReport = append(usageReport, ie.NewQueryURRReference(reference))
+			}
+		}
+		usageReports = append(usageReports, ie.NewUsageReportWithinSessionModificationResponse(usageReport...))
+	}
+	return usageReports
+}
+
+// ReportUsage sends Session Report Requests for the sessions having URRs which reached their thresholds, quotas
+// or the end of their measurement periods.
+func (connection *PfcpConnection) ReportUsage() {
+	now := time.Now()
+	for _, association := range connection.NodeAssociations {
+		for _, session := range association.Sessions {
+			connection.reportSessionUsage(association, session, now)
+		}
+	}
+}
+
+// HandleUrrEvent reports the usage of the URR which has been signalled by the datapath without waiting for the next poll.
+func (connection *PfcpConnection) HandleUrrEvent(event ebpf.UrrEvent) {
+	log.Debug().Msgf("Got URR event: %+v", event)
+	if association, session := connection.sessions.FindUrr(event.UrrId); session != nil {
+		connection.reportSessionUsage(association, session, time.Now())
+	}
+}
+
+func (connection *PfcpConnection) reportSessionUsage(association *NodeAssociation, session *Session, now time.Time) {
+	previous := make(map[uint32]SUrrInfo, len(session.URRs))
+	for urrId, sUrrInfo := range session.URRs {
+		previous[urrId] = sUrrInfo
+	}
+	usageReports := collectUsageReports(session, connection.mapOperations, now)
+	if len(usageReports) == 0 {
+		return
+	}
+	if err := SendSessionReportRequest(connection, association, session, usageReports); err != nil {
+		// The usage is reported again once the report can be sent
+		restoreUrrs(session, previous, connection.mapOperations)
+	}
+}
+
+// restoreUrrs returns the reported URRs of the session to their state before the report: the measurement,
+// the remaining quota and the report sequence.
+func restoreUrrs(session *Session, previous map[uint32]SUrrInfo, mapOperations ebpf.ForwardingPlaneController) {
+	for urrId, sUrrInfo := range previous {
+		if session.URRs[urrId].ReportSeqNumber == sUrrInfo.ReportSeqNumber {
+			continue
+		}
+		sUrrInfo.updateVolumeLimits()
+		if err := mapOperations.UpdateUrr(sUrrInfo.GlobalId, sUrrInfo.UrrInfo); err != nil {
+			log.Warn().Msgf("Can't restore URR: %d, %s", urrId, err.Error())
+		}
+		session.UpdateUrr(urrId, sUrrInfo)
+	}
+}
@@ -0,0 +1,121 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// Size of the per-CPU buffers of buffered_packets, which should fit a burst of full-sized packets.
+const bufferedPacketsPages = 64
+
+// BufferedPacket is a downlink packet handed to user space by the datapath, because its FAR buffers
+// the packets or notifies the CP function about them.
+type BufferedPacket struct {
+	FarId   uint32
+	PdrId   uint32
+	Ifindex uint32 // Interface the packet is received on
+	Packet  []byte // Packet as received starting from the ethernet header
+}
+
+// ListenBufferedPackets starts forwarding the downlink packets from the buffered_packets perf buffer to the channel.
+func (bpfObjects *BpfObjects) ListenBufferedPackets(packets chan<- BufferedPacket) error {
+	reader, err := perf.NewReader(bpfObjects.BufferedPackets, bufferedPacketsPages*os.Getpagesize())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer reader.Close()
+		for {
+			record, err := reader.Read()
+			if err != nil {
+				if errors.Is(err, perf.ErrClosed) {
+					return
+				}
+				log.Warn().Msgf("Can't read buffered packet: %s", err.Error())
+				continue
+			}
+			if record.LostSamples != 0 {
+				log.Warn().Msgf("Lost %d downlink packets to buffer", record.LostSamples)
+				continue
+			}
+			packet, err := parseBufferedPacket(record.RawSample)
+			if err != nil {
+				log.Warn().Msgf("Got malformed buffered packet: %s", err.Error())
+				continue
+			}
+			packets <- packet
+		}
+	}()
+	return nil
+}
+
+// ReinjectPacket runs the datapath on the packet as if it is received again on the interface, so that the packet
+// is forwarded by the current rules of its session. Requires Linux 5.18 or newer.
+func (bpfObjects *BpfObjects) ReinjectPacket(ifindex uint32, packet []byte) error {
+	_, err := bpfObjects.UpfIpEntrypointFunc.Run(&ebpf.RunOptions{
+		Data:    packet,
+		Context: xdpMd{DataEnd: uint32(len(packet)), IngressIfindex: ifindex},
+		Flags:   unix.BPF_F_TEST_XDP_LIVE_FRAMES,
+	})
+	return err
+}
+
+// xdpMd mirrors struct xdp_md, the context of a test run of the XDP program
+type xdpMd struct {
+	Data           uint32
+	DataEnd        uint32
+	DataMeta       uint32
+	IngressIfindex uint32
+	RxQueueIndex   uint32
+	EgressIfindex  uint32
+}
+
+// Size of struct buffered_packet
+const bufferedPacketHeaderSize = 16
+
+// parseBufferedPacket decodes struct buffered_packet and the packet following it. Perf samples are padded,
+// so the packet is cut to the length of its IP header.
+func parseBufferedPacket(sample []byte) (BufferedPacket, error) {
+	if len(sample) < bufferedPacketHeaderSize {
+		return BufferedPacket{}, fmt.Errorf("truncated header: %x", sample)
+	}
+	offset := bufferedPacketHeaderSize + int(binary.NativeEndian.Uint32(sample[8:12]))
+	if offset >= len(sample) {
+		return BufferedPacket{}, fmt.Errorf("packet offset %d is out of sample of %d bytes", offset, len(sample))
+	}
+	packet := sample[offset:]
+
+	var length int
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return BufferedPacket{}, errors.New("truncated IPv4 header")
+		}
+		length = int(binary.BigEndian.Uint16(packet[2:4]))
+	case 6:
+		if len(packet) < 40 {
+			return BufferedPacket{}, errors.New("truncated IPv6 header")
+		}
+		length = 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+	default:
+		return BufferedPacket{}, fmt.Errorf("unknown IP version %d", packet[0]>>4)
+	}
+	if length > len(packet) {
+		return BufferedPacket{}, fmt.Errorf("IP length %d exceeds packet of %d bytes", length, len(packet))
+	}
+
+	return BufferedPacket{
+		FarId:   binary.NativeEndian.Uint32(sample[0:4]),
+		PdrId:   binary.NativeEndian.Uint32(sample[4:8]),
+		Ifindex: binary.NativeEndian.Uint32(sample[12:16]),
+		Packet:  append([]byte(nil), sample[bufferedPacketHeaderSize:offset+length]...),
+	}, nil
+}
@@ -20,7 +20,7 @@ import (
 //		- enable routing decision cache
 //
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cflags "$BPF_CFLAGS" -target bpf IpEntrypoint 	xdp/n3n6_entrypoint.c -- -I. -O2 -Wall -g
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cflags "$BPF_CFLAGS" -target bpf -type pdr_rule -type network_instance IpEntrypoint 	xdp/n3n6_entrypoint.c -- -I. -O2 -Wall -g
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpf ZeroEntrypoint 	xdp/zero_entrypoint.c -- -I. -O2 -Wall
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpf N3Entrypoint 	xdp/n3_entrypoint.c -- -I. -O2 -Wall
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpf N6Entrypoint 	xdp/n6_entrypoint.c -- -I. -O2 -Wall
@@ -30,9 +30,11 @@ type BpfObjects struct {
 	farIdTracker *IdTracker
 	qerIdTracker *IdTracker
 	urrIdTracker *IdTracker
+	sdfIdTracker *IdTracker
 	farMutex     sync.Mutex
 	qerMutex     sync.Mutex
 	urrMutex     sync.Mutex
+	sdfMutex     sync.Mutex
 
 	qerMapSize uint32
 	farMapSize uint32
@@ -45,6 +47,7 @@ func NewBpfObjects() *BpfObjects {
 		farMutex:   sync.Mutex{},
 		qerMutex:   sync.Mutex{},
 		urrMutex:   sync.Mutex{},
+		sdfMutex:   sync.Mutex{},
 		qerMapSize: 1024,
 		farMapSize: 1024,
 		pdrMapSize: 1024,
@@ -87,6 +90,8 @@ func (bpfObjects *BpfObjects) Load() error {
 		"pdr_map_downlink_ip6": bpfObjects.pdrMapSize,
 		"pdr_map_teid_ip4":     bpfObjects.pdrMapSize,
 		"urr_map":              bpfObjects.urrMapSize,
+		"urr_limit_map":        bpfObjects.urrMapSize,
+		"sdf_map":              bpfObjects.pdrMapSize,
 	}
 
 	replacements := make(map[string]*ebpf.Map)
@@ -130,6 +135,13 @@ func (bpfObjects *BpfObjects) Load() error {
 		return err
 	}
 
+	return bpfObjects.initIdTrackers()
+}
+
+// initIdTrackers creates the ID trackers of the FAR, QER, URR and SDF maps sized to the maps.
+func (bpfObjects *BpfObjects) initIdTrackers() error {
+	bpfObjects.farMutex.Lock()
+	defer bpfObjects.farMutex.Unlock()
 	if info, err := bpfObjects.FarMap.Info(); err == nil {
 		bpfObjects.farIdTracker = NewIdTracker(info.MaxEntries)
 
@@ -137,14 +149,30 @@ func (bpfObjects *BpfObjects) Load() error {
 		return err
 	}
 
+	bpfObjects.qerMutex.Lock()
+	defer bpfObjects.qerMutex.Unlock()
 	if info, err := bpfObjects.QerMap.Info(); err == nil {
 		bpfObjects.qerIdTracker = NewIdTracker(info.MaxEntries)
 	} else {
 		return err
 	}
 
+	bpfObjects.urrMutex.Lock()
+	defer bpfObjects.urrMutex.Unlock()
 	if info, err := bpfObjects.UrrMap.Info(); err == nil {
 		bpfObjects.urrIdTracker = NewIdTracker(info.MaxEntries)
+		// URR ID 0 is reserved for PDRs without URRs
+		bpfObjects.urrIdTracker.Reserve(0)
+	} else {
+		return err
+	}
+
+	bpfObjects.sdfMutex.Lock()
+	defer bpfObjects.sdfMutex.Unlock()
+	if info, err := bpfObjects.SdfMap.Info(); err == nil {
+		bpfObjects.sdfIdTracker = NewIdTracker(info.MaxEntries)
+		// SDF ID 0 is reserved for PDRs without SDF filters
+		bpfObjects.sdfIdTracker.Reserve(0)
 	} else {
 		return err
 	}
@@ -255,13 +283,29 @@ func (bpfObjects *BpfObjects) ResizeAllMaps(qerMapSize uint32, farMapSize uint32
 		return err
 	}
 
+	// SDF, sized as the PDR maps
+	if err := ResizeEbpfMap(&bpfObjects.SdfMap, bpfObjects.UpfIpEntrypointFunc, pdrMapSize); err != nil {
+		log.Info().Msgf("Failed to resize SDF map: %s", err)
+		return err
+	}
+
 	// URR
 	if err := ResizeEbpfMap(&bpfObjects.UrrMap, bpfObjects.UpfIpEntrypointFunc, urrMapSize); err != nil {
 		log.Info().Msgf("Failed to resize URR map: %s", err)
 		return err
 	}
+	if err := ResizeEbpfMap(&bpfObjects.UrrLimitMap, bpfObjects.UpfIpEntrypointFunc, urrMapSize); err != nil {
+		log.Info().Msgf("Failed to resize URR map: %s", err)
+		return err
+	}
 
-	return nil
+	bpfObjects.qerMapSize = qerMapSize
+	bpfObjects.farMapSize = farMapSize
+	bpfObjects.pdrMapSize = pdrMapSize
+	bpfObjects.urrMapSize = urrMapSize
+
+	// The resized maps are empty, so the IDs are allocated anew up to the new sizes
+	return bpfObjects.initIdTrackers()
 }
 
 func (bpfObjects *BpfObjects) GetNextQER() (uint32, error) {
@@ -282,6 +326,12 @@ func (bpfObjects *BpfObjects) GetNextURR() (uint32, error) {
 	return bpfObjects.urrIdTracker.GetNext()
 }
 
+func (bpfObjects *BpfObjects) GetNextSDF() (uint32, error) {
+	bpfObjects.sdfMutex.Lock()
+	defer bpfObjects.sdfMutex.Unlock()
+	return bpfObjects.sdfIdTracker.GetNext()
+}
+
 func (bpfObjects *BpfObjects) ReleaseQER(qerId uint32) {
 	bpfObjects.qerMutex.Lock()
 	defer bpfObjects.qerMutex.Unlock()
@@ -300,9 +350,38 @@ func (bpfObjects *BpfObjects) ReleaseURR(urrId uint32) {
 	bpfObjects.urrIdTracker.Release(urrId)
 }
 
+func (bpfObjects *BpfObjects) ReleaseSDF(sdfId uint32) {
+	bpfObjects.sdfMutex.Lock()
+	defer bpfObjects.sdfMutex.Unlock()
+	bpfObjects.sdfIdTracker.Release(sdfId)
+}
+
+// MapOccupancy returns the largest share of FAR, QER, URR and SDF IDs in use.
+func (bpfObjects *BpfObjects) MapOccupancy() float64 {
+	bpfObjects.farMutex.Lock()
+	farOccupancy := bpfObjects.farIdTracker.Occupancy()
+	bpfObjects.farMutex.Unlock()
+
+	bpfObjects.qerMutex.Lock()
+	qerOccupancy := bpfObjects.qerIdTracker.Occupancy()
+	bpfObjects.qerMutex.Unlock()
+
+	bpfObjects.urrMutex.Lock()
+	urrOccupancy := bpfObjects.urrIdTracker.Occupancy()
+	bpfObjects.urrMutex.Unlock()
+
+	bpfObjects.sdfMutex.Lock()
+	sdfOccupancy := bpfObjects.sdfIdTracker.Occupancy()
+	bpfObjects.sdfMutex.Unlock()
+
+	return max(farOccupancy, qerOccupancy, urrOccupancy, sdfOccupancy)
+}
+
 type IdTracker struct {
 	bitmap  *roaring.Bitmap
 	maxSize uint32
+	// IDs never handed out, such as ID 0 meaning no rule
+	reserved *roaring.Bitmap
 }
 
 func NewIdTracker(size uint32) *IdTracker {
@@ -310,8 +389,9 @@ func NewIdTracker(size uint32) *IdTracker {
 	newBitmap.Flip(0, uint64(size))
 
 	return &IdTracker{
-		bitmap:  newBitmap,
-		maxSize: size,
+		bitmap:   newBitmap,
+		maxSize:  size,
+		reserved: roaring.NewBitmap(),
 	}
 }
 
@@ -327,10 +407,31 @@ func (t *IdTracker) GetNext() (next uint32, err error) {
 	return 0, errors.New("pool is empty")
 }
 
-func (t *IdTracker) Release(id uint32) {
+// Reserve takes the ID out of the pool without counting it as used.
+func (t *IdTracker) Reserve(id uint32) {
 	if id >= t.maxSize {
 		return
 	}
+	t.bitmap.Remove(id)
+	t.reserved.Add(id)
+}
+
+func (t *IdTracker) Release(id uint32) {
+	if id >= t.maxSize || t.reserved.Contains(id) {
+		return
+	}
 
 	t.bitmap.Add(id)
 }
+
+// Occupancy returns the share of IDs in use, the reserved IDs are left out.
+func (t *IdTracker) Occupancy() float64 {
+	if t == nil {
+		return 0
+	}
+	available := uint64(t.maxSize) - t.reserved.GetCardinality()
+	if available == 0 {
+		return 0
+	}
+	return float64(available-t.bitmap.GetCardinality()) / float64(available)
+}
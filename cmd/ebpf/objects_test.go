@@ -189,7 +189,7 @@ func testGtpWithPDRBenchmark(bpfObjects *BpfObjects, repeat int) (int64, error)
 	if err := bpfObjects.QerMap.Put(uint32(1), unsafe.Pointer(&qer)); err != nil {
 		return 0, fmt.Errorf("benchmark run failed: %v", err)
 	}
-	if err := bpfObjects.PdrMapTeidIp4.Put(teid, unsafe.Pointer(&pdr)); err != nil {
+	if err := bpfObjects.PutPdrUplink(teid, pdr); err != nil {
 		return 0, fmt.Errorf("benchmark run failed: %v", err)
 	}
 
@@ -310,7 +310,7 @@ func testGtpWithSDFFilter(bpfObjects *BpfObjects) error {
 		return fmt.Errorf("serializing input packet failed: %v", err)
 	}
 
-	pdr := PdrInfo{OuterHeaderRemoval: 0, FarId: 1, QerId: 1}
+	pdr := PdrInfo{PdrId: 1, Precedence: 255, OuterHeaderRemoval: 0, FarId: 1, QerId: 1}
 	farForward := FarInfo{Action: 2, OuterHeaderCreation: 1, RemoteIP: 1, Teid: 2, TransportLevelMarking: 0}
 	farDrop := FarInfo{Action: 1, OuterHeaderCreation: 1, RemoteIP: 1, Teid: 2, TransportLevelMarking: 0}
 	qer := QerInfo{GateStatusUL: 0, GateStatusDL: 0, Qfi: 0, MaxBitrateUL: 1000000, MaxBitrateDL: 100000, StartUL: 0, StartDL: 0}
@@ -336,7 +336,12 @@ func testGtpWithSDFFilter(bpfObjects *BpfObjects) error {
 		SrcPortRange: PortRange{LowerBound: 0, UpperBound: 65535},
 		DstPortRange: PortRange{LowerBound: 0, UpperBound: 65535},
 	}
-	pdr.SdfFilter = &sdf
+	// The packet matches the second of the filters
+	otherSdf := sdf
+	otherSdf.DstAddress = IpWMask{Type: 1, Ip: net.IP{8, 8, 8, 8}, Mask: net.IPMask{255, 255, 255, 255}}
+	pdr.SdfFilters = []SdfFilter{otherSdf, sdf}
+	pdr.PdrId = 2
+	pdr.Precedence = 100
 	pdr.FarId = 2
 	if err := bpfObjects.PutPdrUplink(teid, pdr); err != nil {
 		return fmt.Errorf("can't set uplink PDR: %v", err)
@@ -400,7 +405,7 @@ func testGtpExtHeader(t *testing.T, bpfObjects *BpfObjects) error {
 		return fmt.Errorf("can't set QER: %v", err)
 	}
 
-	if err := bpfObjects.PutPdrDownlink(net.IP{10, 60, 0, 1}, pdr); err != nil {
+	if err := bpfObjects.PutPdrDownlink(0, net.IP{10, 60, 0, 1}, pdr); err != nil {
 		return fmt.Errorf("can't set downlink PDR: %v", err)
 	}
 
@@ -502,7 +507,7 @@ func testDLwithGTPPort(t *testing.T, bpfObjects *BpfObjects) error {
 		return fmt.Errorf("can't set QER: %v", err)
 	}
 
-	if err := bpfObjects.PutPdrDownlink(net.IP{10, 60, 0, 1}, pdr); err != nil {
+	if err := bpfObjects.PutPdrDownlink(0, net.IP{10, 60, 0, 1}, pdr); err != nil {
 		return fmt.Errorf("can't set downlink PDR: %v", err)
 	}
 
@@ -680,3 +685,30 @@ func TestEntrypointBenchmark(t *testing.T) {
 		t.Logf("%s result: %d ns", t.Name(), duration)
 	})
 }
+
+func TestIdTrackerReservedId(t *testing.T) {
+	tracker := NewIdTracker(4)
+	tracker.Reserve(0)
+	if occupancy := tracker.Occupancy(); occupancy != 0 {
+		t.Errorf("Reserved ID should not be counted as used, occupancy: %f", occupancy)
+	}
+
+	for expected := uint32(1); expected < 4; expected++ {
+		id, err := tracker.GetNext()
+		if err != nil || id != expected {
+			t.Fatalf("Unexpected ID %d (%v), expected %d", id, err, expected)
+		}
+	}
+	if occupancy := tracker.Occupancy(); occupancy != 1 {
+		t.Errorf("All IDs should be used, occupancy: %f", occupancy)
+	}
+	if _, err := tracker.GetNext(); err == nil {
+		t.Errorf("Reserved ID should not be handed out")
+	}
+
+	// Releasing the reserved ID doesn't return it to the pool
+	tracker.Release(0)
+	if _, err := tracker.GetNext(); err == nil {
+		t.Errorf("Released reserved ID should not be handed out")
+	}
+}
@@ -14,22 +14,44 @@ import (
 
 // The BPF_ARRAY map type has no delete operation. The only way to delete an element is to replace it with a new one.
 
+// SdfListSize is the number of SDF filters per PDR the datapath evaluates, SDF_LIST_SIZE of xdp/sizing.h.
+const SdfListSize = 5
+
+// PdrRuleListSize is the number of PDRs sharing a TEID or UE IP address, PDR_RULE_LIST_SIZE of xdp/sizing.h.
+const PdrRuleListSize = 8
+
 type PdrInfo struct {
+	PdrId              uint32
+	Precedence         uint32
 	OuterHeaderRemoval uint8
 	FarId              uint32
 	QerId              uint32
 	Urr1Id             uint32
 	Urr2Id             uint32
-	SdfFilter          *SdfFilter
+	NetworkInstance    uint32 // Source network instance, 0 for the default one
+	SdfFilters         []SdfFilter
 }
 
 type SdfFilter struct {
-	Protocol     uint8 // 0: icmp, 1: ip, 2: tcp, 3: udp, 4: icmp6
+	Protocol     uint8 // 0: icmp, 1: ip, 2: tcp, 3: udp, 4: icmp6, 5: esp, 6: ah
 	SrcAddress   IpWMask
 	SrcPortRange PortRange
 	DstAddress   IpWMask
 	DstPortRange PortRange
-}
+	// Fields of the SDF Filter IE besides the flow description, matched if set in MatchFlags
+	MatchFlags             uint8
+	ToSTrafficClass        uint8
+	ToSTrafficClassMask    uint8
+	SecurityParameterIndex uint32
+	FlowLabel              uint32
+}
+
+// SDF filter match flags, the flags of the SDF Filter IE
+const (
+	SdfMatchToSTrafficClass        uint8 = 0x02
+	SdfMatchSecurityParameterIndex uint8 = 0x04
+	SdfMatchFlowLabel              uint8 = 0x08
+)
 
 type IpWMask struct {
 	Type uint8 // 0: any, 1: ip4, 2: ip6
@@ -42,112 +64,195 @@ type PortRange struct {
 	UpperBound uint16
 }
 
-func PreprocessPdrWithSdf(lookup func(interface{}, interface{}) error, key interface{}, pdrInfo PdrInfo) (IpEntrypointPdrInfo, error) {
-	var defaultPdr IpEntrypointPdrInfo
-	if err := lookup(key, &defaultPdr); err != nil {
-		return CombinePdrWithSdf(nil, pdrInfo), nil
-	}
-
-	return CombinePdrWithSdf(&defaultPdr, pdrInfo), nil
-}
-
 func (bpfObjects *BpfObjects) PutPdrUplink(teid uint32, pdrInfo PdrInfo) error {
 	log.Debug().Msgf("EBPF: Put PDR Uplink: teid=%d, pdrInfo=%+v", teid, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
-	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapTeidIp4.Lookup, teid, pdrInfo); err != nil {
-			return err
-		}
-	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
-	}
-	return bpfObjects.PdrMapTeidIp4.Put(teid, unsafe.Pointer(&pdrToStore))
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapTeidIp4, teid, pdrInfo, ebpf.UpdateAny)
 }
 
-func (bpfObjects *BpfObjects) PutPdrDownlink(ipv4 net.IP, pdrInfo PdrInfo) error {
-	log.Debug().Msgf("EBPF: Put PDR Downlink: ipv4=%s, pdrInfo=%+v", ipv4, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
-	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapDownlinkIp4.Lookup, ipv4, pdrInfo); err != nil {
-			return err
-		}
-	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
-	}
-	return bpfObjects.PdrMapDownlinkIp4.Put(ipv4, unsafe.Pointer(&pdrToStore))
+func (bpfObjects *BpfObjects) PutPdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo PdrInfo) error {
+	log.Debug().Msgf("EBPF: Put PDR Downlink: networkInstance=%d, ipv4=%s, pdrInfo=%+v", networkInstance, ipv4, pdrInfo)
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapDownlinkIp4, ueIp4Key(networkInstance, ipv4), pdrInfo, ebpf.UpdateAny)
 }
 
 func (bpfObjects *BpfObjects) UpdatePdrUplink(teid uint32, pdrInfo PdrInfo) error {
 	log.Debug().Msgf("EBPF: Update PDR Uplink: teid=%d, pdrInfo=%+v", teid, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
-	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapTeidIp4.Lookup, teid, pdrInfo); err != nil {
-			return err
-		}
-	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
-	}
-	return bpfObjects.PdrMapTeidIp4.Update(teid, unsafe.Pointer(&pdrToStore), ebpf.UpdateExist)
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapTeidIp4, teid, pdrInfo, ebpf.UpdateExist)
 }
 
-func (bpfObjects *BpfObjects) UpdatePdrDownlink(ipv4 net.IP, pdrInfo PdrInfo) error {
-	log.Debug().Msgf("EBPF: Update PDR Downlink: ipv4=%s, pdrInfo=%+v", ipv4, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
-	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapDownlinkIp4.Lookup, ipv4, pdrInfo); err != nil {
-			return err
-		}
-	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
-	}
-	return bpfObjects.PdrMapDownlinkIp4.Update(ipv4, unsafe.Pointer(&pdrToStore), ebpf.UpdateExist)
+func (bpfObjects *BpfObjects) UpdatePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo PdrInfo) error {
+	log.Debug().Msgf("EBPF: Update PDR Downlink: networkInstance=%d, ipv4=%s, pdrInfo=%+v", networkInstance, ipv4, pdrInfo)
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapDownlinkIp4, ueIp4Key(networkInstance, ipv4), pdrInfo, ebpf.UpdateExist)
 }
 
-func (bpfObjects *BpfObjects) DeletePdrUplink(teid uint32) error {
-	log.Debug().Msgf("EBPF: Delete PDR Uplink: teid=%d", teid)
-	return bpfObjects.PdrMapTeidIp4.Delete(teid)
+func (bpfObjects *BpfObjects) DeletePdrUplink(teid uint32, pdrId uint32) error {
+	log.Debug().Msgf("EBPF: Delete PDR Uplink: teid=%d, pdrId=%d", teid, pdrId)
+	return bpfObjects.deletePdrRule(bpfObjects.PdrMapTeidIp4, teid, pdrId)
 }
 
-func (bpfObjects *BpfObjects) DeletePdrDownlink(ipv4 net.IP) error {
-	log.Debug().Msgf("EBPF: Delete PDR Downlink: ipv4=%s", ipv4)
-	return bpfObjects.PdrMapDownlinkIp4.Delete(ipv4)
+func (bpfObjects *BpfObjects) DeletePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrId uint32) error {
+	log.Debug().Msgf("EBPF: Delete PDR Downlink: networkInstance=%d, ipv4=%s, pdrId=%d", networkInstance, ipv4, pdrId)
+	return bpfObjects.deletePdrRule(bpfObjects.PdrMapDownlinkIp4, ueIp4Key(networkInstance, ipv4), pdrId)
 }
 
-func (bpfObjects *BpfObjects) PutDownlinkPdrIp6(ipv6 net.IP, pdrInfo PdrInfo) error {
-	log.Debug().Msgf("EBPF: Put PDR Ipv6 Downlink: ipv6=%s, pdrInfo=%+v", ipv6, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
-	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapDownlinkIp6.Lookup, ipv6, pdrInfo); err != nil {
-			return err
-		}
-	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
+func (bpfObjects *BpfObjects) PutDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo PdrInfo) error {
+	log.Debug().Msgf("EBPF: Put PDR Ipv6 Downlink: networkInstance=%d, ipv6=%s, pdrInfo=%+v", networkInstance, ipv6, pdrInfo)
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapDownlinkIp6, ueIp6Key(networkInstance, ipv6), pdrInfo, ebpf.UpdateAny)
+}
+
+func (bpfObjects *BpfObjects) UpdateDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo PdrInfo) error {
+	log.Debug().Msgf("EBPF: Update PDR Ipv6 Downlink: networkInstance=%d, ipv6=%s, pdrInfo=%+v", networkInstance, ipv6, pdrInfo)
+	return bpfObjects.putPdrRule(bpfObjects.PdrMapDownlinkIp6, ueIp6Key(networkInstance, ipv6), pdrInfo, ebpf.UpdateExist)
+}
+
+func (bpfObjects *BpfObjects) DeleteDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrId uint32) error {
+	log.Debug().Msgf("EBPF: Delete PDR Ipv6 Downlink: networkInstance=%d, ipv6=%s, pdrId=%d", networkInstance, ipv6, pdrId)
+	return bpfObjects.deletePdrRule(bpfObjects.PdrMapDownlinkIp6, ueIp6Key(networkInstance, ipv6), pdrId)
+}
+
+// Downlink PDRs are keyed by the UE address within the network instance, the address spaces of network instances may overlap.
+func ueIp4Key(networkInstance uint32, ipv4 net.IP) IpEntrypointUeIp4Key {
+	return IpEntrypointUeIp4Key{NetworkInstance: networkInstance, UeIp: binary.LittleEndian.Uint32(ipv4.To4())}
+}
+
+func ueIp6Key(networkInstance uint32, ipv6 net.IP) IpEntrypointUeIp6Key {
+	key := IpEntrypointUeIp6Key{NetworkInstance: networkInstance}
+	copy(key.UeIp[:], ipv6.To16())
+	return key
+}
+
+// putPdrRule stores the PDR among the other PDRs of the key in precedence order.
+// The rule previously stored for the same PDR ID is replaced.
+func (bpfObjects *BpfObjects) putPdrRule(pdrMap *ebpf.Map, key interface{}, pdrInfo PdrInfo, flags ebpf.MapUpdateFlags) error {
+	var stored IpEntrypointPdrInfo
+	if err := pdrMap.Lookup(key, unsafe.Pointer(&stored)); err != nil && flags == ebpf.UpdateExist {
+		return err
 	}
-	return bpfObjects.PdrMapDownlinkIp6.Put(ipv6, unsafe.Pointer(&pdrToStore))
+
+	rule, err := bpfObjects.newPdrRule(pdrInfo)
+	if err != nil {
+		return err
+	}
+	pdrToStore, replaced, err := InsertPdrRule(stored, rule)
+	if err == nil {
+		err = pdrMap.Update(key, unsafe.Pointer(&pdrToStore), flags)
+	}
+	if err != nil {
+		bpfObjects.deleteSdfRules(rule.SdfId)
+		return err
+	}
+	if replaced != nil {
+		bpfObjects.deleteSdfRules(replaced.SdfId)
+	}
+	return nil
 }
 
-func (bpfObjects *BpfObjects) UpdateDownlinkPdrIp6(ipv6 net.IP, pdrInfo PdrInfo) error {
-	log.Debug().Msgf("EBPF: Update PDR Ipv6 Downlink: ipv6=%s, pdrInfo=%+v", ipv6, pdrInfo)
-	var pdrToStore IpEntrypointPdrInfo
+// deletePdrRule removes the PDR from the rules of the key. The key is deleted with its last PDR.
+func (bpfObjects *BpfObjects) deletePdrRule(pdrMap *ebpf.Map, key interface{}, pdrId uint32) error {
+	var stored IpEntrypointPdrInfo
+	if err := pdrMap.Lookup(key, unsafe.Pointer(&stored)); err != nil {
+		return err
+	}
+
+	pdrToStore, removed := RemovePdrRule(stored, pdrId)
+	if removed == nil {
+		return fmt.Errorf("PDR %d is not stored", pdrId)
+	}
 	var err error
-	if pdrInfo.SdfFilter != nil {
-		if pdrToStore, err = PreprocessPdrWithSdf(bpfObjects.PdrMapDownlinkIp6.Lookup, ipv6, pdrInfo); err != nil {
-			return err
-		}
+	if pdrToStore.RuleCount == 0 {
+		err = pdrMap.Delete(key)
 	} else {
-		pdrToStore = ToIpEntrypointPdrInfo(pdrInfo)
+		err = pdrMap.Update(key, unsafe.Pointer(&pdrToStore), ebpf.UpdateExist)
+	}
+	if err != nil {
+		return err
 	}
-	return bpfObjects.PdrMapDownlinkIp6.Update(ipv6, unsafe.Pointer(&pdrToStore), ebpf.UpdateExist)
+	bpfObjects.deleteSdfRules(removed.SdfId)
+	return nil
 }
 
-func (bpfObjects *BpfObjects) DeleteDownlinkPdrIp6(ipv6 net.IP) error {
-	log.Debug().Msgf("EBPF: Delete PDR Ipv6 Downlink: ipv6=%s", ipv6)
-	return bpfObjects.PdrMapDownlinkIp6.Delete(ipv6)
+func (bpfObjects *BpfObjects) newPdrRule(pdrInfo PdrInfo) (IpEntrypointPdrRule, error) {
+	sdfId, err := bpfObjects.newSdfRules(pdrInfo.SdfFilters)
+	if err != nil {
+		return IpEntrypointPdrRule{}, err
+	}
+	return IpEntrypointPdrRule{
+		PdrId:              pdrInfo.PdrId,
+		Precedence:         pdrInfo.Precedence,
+		FarId:              pdrInfo.FarId,
+		QerId:              pdrInfo.QerId,
+		Urr1Id:             pdrInfo.Urr1Id,
+		Urr2Id:             pdrInfo.Urr2Id,
+		SdfId:              sdfId,
+		NetworkInstance:    pdrInfo.NetworkInstance,
+		OuterHeaderRemoval: pdrInfo.OuterHeaderRemoval,
+	}, nil
+}
+
+// newSdfRules stores the SDF filters of a PDR. SDF ID 0 stands for a PDR without SDF filters.
+func (bpfObjects *BpfObjects) newSdfRules(sdfFilters []SdfFilter) (uint32, error) {
+	if len(sdfFilters) == 0 {
+		return 0, nil
+	}
+	sdfRules, err := ToIpEntrypointSdfRules(sdfFilters)
+	if err != nil {
+		return 0, err
+	}
+	internalId, err := bpfObjects.GetNextSDF()
+	if err != nil {
+		return 0, err
+	}
+	log.Debug().Msgf("EBPF: Put SDF: internalId=%d, sdfFilters=%+v", internalId, sdfFilters)
+	if err := bpfObjects.SdfMap.Put(internalId, unsafe.Pointer(&sdfRules)); err != nil {
+		bpfObjects.ReleaseSDF(internalId)
+		return 0, err
+	}
+	return internalId, nil
+}
+
+func (bpfObjects *BpfObjects) deleteSdfRules(internalId uint32) {
+	if internalId == 0 {
+		return
+	}
+	log.Debug().Msgf("EBPF: Delete SDF: internalId=%d", internalId)
+	bpfObjects.ReleaseSDF(internalId)
+	if err := bpfObjects.SdfMap.Update(internalId, unsafe.Pointer(&IpEntrypointSdfRules{}), ebpf.UpdateExist); err != nil {
+		log.Warn().Msgf("Can't clear SDF %d: %s", internalId, err.Error())
+	}
+}
+
+// InsertPdrRule places the rule after the rules of the same or higher priority, that is of the same or lower
+// precedence value. It returns the replaced rule of the same PDR ID if there was one.
+func InsertPdrRule(stored IpEntrypointPdrInfo, rule IpEntrypointPdrRule) (IpEntrypointPdrInfo, *IpEntrypointPdrRule, error) {
+	pdrToStore, replaced := RemovePdrRule(stored, rule.PdrId)
+	if int(pdrToStore.RuleCount) == PdrRuleListSize {
+		return stored, nil, fmt.Errorf("%d PDRs are already stored for the key", PdrRuleListSize)
+	}
+
+	position := int(pdrToStore.RuleCount)
+	for i := 0; i < int(pdrToStore.RuleCount); i++ {
+		if pdrToStore.Rules[i].Precedence > rule.Precedence {
+			position = i
+			break
+		}
+	}
+	copy(pdrToStore.Rules[position+1:], pdrToStore.Rules[position:pdrToStore.RuleCount])
+	pdrToStore.Rules[position] = rule
+	pdrToStore.RuleCount++
+	return pdrToStore, replaced, nil
+}
+
+// RemovePdrRule returns the rules without the one of the PDR ID and the removed rule if there was one.
+func RemovePdrRule(stored IpEntrypointPdrInfo, pdrId uint32) (IpEntrypointPdrInfo, *IpEntrypointPdrRule) {
+	for i := 0; i < int(stored.RuleCount); i++ {
+		if stored.Rules[i].PdrId == pdrId {
+			removed := stored.Rules[i]
+			copy(stored.Rules[i:], stored.Rules[i+1:stored.RuleCount])
+			stored.RuleCount--
+			stored.Rules[stored.RuleCount] = IpEntrypointPdrRule{}
+			return stored, &removed
+		}
+	}
+	return stored, nil
 }
 
 type FarInfo struct {
@@ -156,8 +261,17 @@ type FarInfo struct {
 	Teid                  uint32
 	RemoteIP              uint32
 	TransportLevelMarking uint16
+	NetworkInstance       uint32 // Destination network instance routing the packet, 0 for the default one
 }
 
+// FAR apply action flags, the flags of the first octet of the Apply Action IE
+const (
+	FarDrop uint8 = 1 << iota
+	FarForward
+	FarBuffer
+	FarNotifyCp
+)
+
 func (f FarInfo) MarshalJSON() ([]byte, error) {
 	remoteIP := make(net.IP, 4)
 	binary.LittleEndian.PutUint32(remoteIP, f.RemoteIP)
@@ -167,6 +281,7 @@ func (f FarInfo) MarshalJSON() ([]byte, error) {
 		"teid":                    f.Teid,
 		"remote_ip":               remoteIP.String(),
 		"transport_level_marking": f.TransportLevelMarking,
+		"network_instance":        f.NetworkInstance,
 	}
 	return json.Marshal(data)
 }
@@ -191,6 +306,22 @@ func (bpfObjects *BpfObjects) DeleteFar(intenalId uint32) error {
 	return bpfObjects.FarMap.Update(intenalId, unsafe.Pointer(&FarInfo{}), ebpf.UpdateExist)
 }
 
+// PutNetworkInstance routes the packets of the network instance in the routing table, 0 for the table of the
+// interface, and through the interface of the ifindex, 0 for the ingress interface.
+func (bpfObjects *BpfObjects) PutNetworkInstance(networkInstance uint32, tableId uint32, ifindex uint32) error {
+	log.Debug().Msgf("EBPF: Put network instance: id=%d, table=%d, ifindex=%d", networkInstance, tableId, ifindex)
+	instance := IpEntrypointNetworkInstance{TableId: tableId, Ifindex: ifindex}
+	return bpfObjects.NetworkInstanceMap.Put(networkInstance, unsafe.Pointer(&instance))
+}
+
+// PutN6Ingress assigns the packets received on N6 through the interface of the ifindex, 0 for any interface,
+// with the VLAN ID, 0 for untagged packets, to the network instance.
+func (bpfObjects *BpfObjects) PutN6Ingress(ifindex uint32, vlanId uint16, networkInstance uint32) error {
+	log.Debug().Msgf("EBPF: Put N6 ingress: ifindex=%d, vlan=%d, networkInstance=%d", ifindex, vlanId, networkInstance)
+	ingress := IpEntrypointN6Ingress{Ifindex: ifindex, VlanId: uint32(vlanId)}
+	return bpfObjects.N6IngressMap.Put(ingress, networkInstance)
+}
+
 type QerInfo struct {
 	GateStatusUL uint8
 	GateStatusDL uint8
@@ -221,34 +352,146 @@ func (bpfObjects *BpfObjects) DeleteQer(internalId uint32) error {
 	return bpfObjects.QerMap.Update(internalId, unsafe.Pointer(&QerInfo{}), ebpf.UpdateExist)
 }
 
-// TODO: add required fields and implement methods
+// UrrInfo is a URR as seen by the control plane. Thresholds and quotas are absolute values of the volume counters,
+// only the limits set in VolumeFlags are enforced by the datapath. The datapath keeps the counters in urr_map, and
+// the limits are kept apart in urr_limit_map, so updating the limits never overwrites the counted volume.
 type UrrInfo struct {
+	UplinkVolume      uint64
+	DownlinkVolume    uint64
+	TotalThreshold    uint64
+	UplinkThreshold   uint64
+	DownlinkThreshold uint64
+	TotalQuota        uint64
+	UplinkQuota       uint64
+	DownlinkQuota     uint64
+	QuotaFarId        uint32
+	Status            uint32
+	VolumeFlags       uint8
+	QuotaAction       uint8
+}
+
+// urrCounters mirrors struct urr_info.
+type urrCounters struct {
 	UplinkVolume   uint64
 	DownlinkVolume uint64
+	Status         uint32
+	Generation     uint32
+}
+
+// urrLimits mirrors struct urr_limits.
+type urrLimits struct {
+	TotalThreshold    uint64
+	UplinkThreshold   uint64
+	DownlinkThreshold uint64
+	TotalQuota        uint64
+	UplinkQuota       uint64
+	DownlinkQuota     uint64
+	QuotaFarId        uint32
+	Status            uint32
+	Generation        uint32
+	VolumeFlags       uint8
+	QuotaAction       uint8
+}
+
+func toUrrLimits(urrInfo UrrInfo, generation uint32) urrLimits {
+	return urrLimits{
+		TotalThreshold:    urrInfo.TotalThreshold,
+		UplinkThreshold:   urrInfo.UplinkThreshold,
+		DownlinkThreshold: urrInfo.DownlinkThreshold,
+		TotalQuota:        urrInfo.TotalQuota,
+		UplinkQuota:       urrInfo.UplinkQuota,
+		DownlinkQuota:     urrInfo.DownlinkQuota,
+		QuotaFarId:        urrInfo.QuotaFarId,
+		Status:            urrInfo.Status,
+		Generation:        generation,
+		VolumeFlags:       urrInfo.VolumeFlags,
+		QuotaAction:       urrInfo.QuotaAction,
+	}
 }
 
+func toUrrInfo(counters urrCounters, limits urrLimits) UrrInfo {
+	return UrrInfo{
+		UplinkVolume:      counters.UplinkVolume,
+		DownlinkVolume:    counters.DownlinkVolume,
+		TotalThreshold:    limits.TotalThreshold,
+		UplinkThreshold:   limits.UplinkThreshold,
+		DownlinkThreshold: limits.DownlinkThreshold,
+		TotalQuota:        limits.TotalQuota,
+		UplinkQuota:       limits.UplinkQuota,
+		DownlinkQuota:     limits.DownlinkQuota,
+		QuotaFarId:        limits.QuotaFarId,
+		Status:            counters.Status | limits.Status,
+		VolumeFlags:       limits.VolumeFlags,
+		QuotaAction:       limits.QuotaAction,
+	}
+}
+
+const (
+	UrrTotalThreshold uint8 = 1 << iota
+	UrrUplinkThreshold
+	UrrDownlinkThreshold
+	UrrTotalQuota
+	UrrUplinkQuota
+	UrrDownlinkQuota
+)
+
+const (
+	UrrStatusThresholdReached uint32 = 0x01
+	UrrStatusQuotaExhausted   uint32 = 0x02
+)
+
+const (
+	UrrQuotaActionDrop     uint8 = 0
+	UrrQuotaActionApplyFar uint8 = 1
+)
+
 func (bpfObjects *BpfObjects) NewUrr(urrInfo UrrInfo) (uint32, error) {
 	internalId, err := bpfObjects.GetNextURR()
 	if err != nil {
 		return 0, err
 	}
 	log.Debug().Msgf("EBPF: Put URR: internalId=%d, urrInfo=%+v", internalId, urrInfo)
-	return internalId, bpfObjects.UrrMap.Put(internalId, unsafe.Pointer(&urrInfo))
+	counters := urrCounters{UplinkVolume: urrInfo.UplinkVolume, DownlinkVolume: urrInfo.DownlinkVolume}
+	if err := bpfObjects.UrrMap.Put(internalId, unsafe.Pointer(&counters)); err != nil {
+		return internalId, err
+	}
+	limits := toUrrLimits(urrInfo, 0)
+	return internalId, bpfObjects.UrrLimitMap.Put(internalId, unsafe.Pointer(&limits))
 }
 
+// UpdateUrr replaces the limits of the URR. The volume counters and the status latched by the datapath are kept,
+// the datapath rearms its events against the new limits.
 func (bpfObjects *BpfObjects) UpdateUrr(internalId uint32, urrInfo UrrInfo) error {
 	log.Debug().Msgf("EBPF: Update URR: internalId=%d, urrInfo=%+v", internalId, urrInfo)
-	return bpfObjects.UrrMap.Update(internalId, unsafe.Pointer(&urrInfo), ebpf.UpdateExist)
+	current := urrLimits{}
+	if err := bpfObjects.UrrLimitMap.Lookup(internalId, unsafe.Pointer(&current)); err != nil {
+		return err
+	}
+	limits := toUrrLimits(urrInfo, current.Generation+1)
+	return bpfObjects.UrrLimitMap.Update(internalId, unsafe.Pointer(&limits), ebpf.UpdateExist)
+}
+
+func (bpfObjects *BpfObjects) GetUrr(internalId uint32) (UrrInfo, error) {
+	counters := urrCounters{}
+	if err := bpfObjects.UrrMap.Lookup(internalId, unsafe.Pointer(&counters)); err != nil {
+		return UrrInfo{}, err
+	}
+	limits := urrLimits{}
+	err := bpfObjects.UrrLimitMap.Lookup(internalId, unsafe.Pointer(&limits))
+	return toUrrInfo(counters, limits), err
 }
 
 func (bpfObjects *BpfObjects) DeleteUrr(internalId uint32) (error, UrrInfo) {
 	log.Debug().Msgf("EBPF: Delete URR: internalId=%d", internalId)
-	urrInfo := UrrInfo{}
-	if err := bpfObjects.UrrMap.Lookup(internalId, unsafe.Pointer(&urrInfo)); err != nil {
+	urrInfo, err := bpfObjects.GetUrr(internalId)
+	if err != nil {
 		return err, UrrInfo{}
 	}
 	bpfObjects.ReleaseURR(internalId)
-	if err := bpfObjects.UrrMap.Update(internalId, unsafe.Pointer(&UrrInfo{}), ebpf.UpdateExist); err != nil {
+	if err := bpfObjects.UrrLimitMap.Update(internalId, unsafe.Pointer(&urrLimits{}), ebpf.UpdateExist); err != nil {
+		return err, UrrInfo{}
+	}
+	if err := bpfObjects.UrrMap.Update(internalId, unsafe.Pointer(&urrCounters{}), ebpf.UpdateExist); err != nil {
 		return err, UrrInfo{}
 	}
 
@@ -257,14 +500,14 @@ func (bpfObjects *BpfObjects) DeleteUrr(internalId uint32) (error, UrrInfo) {
 
 type ForwardingPlaneController interface {
 	PutPdrUplink(teid uint32, pdrInfo PdrInfo) error
-	PutPdrDownlink(ipv4 net.IP, pdrInfo PdrInfo) error
+	PutPdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo PdrInfo) error
 	UpdatePdrUplink(teid uint32, pdrInfo PdrInfo) error
-	UpdatePdrDownlink(ipv4 net.IP, pdrInfo PdrInfo) error
-	DeletePdrUplink(teid uint32) error
-	DeletePdrDownlink(ipv4 net.IP) error
-	PutDownlinkPdrIp6(ipv6 net.IP, pdrInfo PdrInfo) error
-	UpdateDownlinkPdrIp6(ipv6 net.IP, pdrInfo PdrInfo) error
-	DeleteDownlinkPdrIp6(ipv6 net.IP) error
+	UpdatePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrInfo PdrInfo) error
+	DeletePdrUplink(teid uint32, pdrId uint32) error
+	DeletePdrDownlink(networkInstance uint32, ipv4 net.IP, pdrId uint32) error
+	PutDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo PdrInfo) error
+	UpdateDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrInfo PdrInfo) error
+	DeleteDownlinkPdrIp6(networkInstance uint32, ipv6 net.IP, pdrId uint32) error
 	NewFar(farInfo FarInfo) (uint32, error)
 	UpdateFar(internalId uint32, farInfo FarInfo) error
 	DeleteFar(internalId uint32) error
@@ -273,45 +516,43 @@ type ForwardingPlaneController interface {
 	DeleteQer(internalId uint32) error
 	NewUrr(urrInfo UrrInfo) (uint32, error)
 	UpdateUrr(internalId uint32, urrInfo UrrInfo) error
+	GetUrr(internalId uint32) (UrrInfo, error)
 	DeleteUrr(internalId uint32) (error, UrrInfo)
+	ReinjectPacket(ifindex uint32, packet []byte) error
+	MapOccupancy() float64
 }
 
-func CombinePdrWithSdf(defaultPdr *IpEntrypointPdrInfo, sdfPdr PdrInfo) IpEntrypointPdrInfo {
-	var pdrToStore IpEntrypointPdrInfo
-	// Default mapping options.
-	if defaultPdr != nil {
-		pdrToStore.OuterHeaderRemoval = defaultPdr.OuterHeaderRemoval
-		pdrToStore.FarId = defaultPdr.FarId
-		pdrToStore.QerId = defaultPdr.QerId
-		pdrToStore.SdfMode = 2
-	} else {
-		pdrToStore.SdfMode = 1
-	}
-
-	// SDF mapping options.
-	pdrToStore.SdfRules.SdfFilter.Protocol = sdfPdr.SdfFilter.Protocol
-	pdrToStore.SdfRules.SdfFilter.SrcAddr.Type = sdfPdr.SdfFilter.SrcAddress.Type
-	pdrToStore.SdfRules.SdfFilter.SrcAddr.Ip = Copy16Ip(sdfPdr.SdfFilter.SrcAddress.Ip)
-	pdrToStore.SdfRules.SdfFilter.SrcAddr.Mask = Copy16Ip(sdfPdr.SdfFilter.SrcAddress.Mask)
-	pdrToStore.SdfRules.SdfFilter.SrcPort.LowerBound = sdfPdr.SdfFilter.SrcPortRange.LowerBound
-	pdrToStore.SdfRules.SdfFilter.SrcPort.UpperBound = sdfPdr.SdfFilter.SrcPortRange.UpperBound
-	pdrToStore.SdfRules.SdfFilter.DstAddr.Type = sdfPdr.SdfFilter.DstAddress.Type
-	pdrToStore.SdfRules.SdfFilter.DstAddr.Ip = Copy16Ip(sdfPdr.SdfFilter.DstAddress.Ip)
-	pdrToStore.SdfRules.SdfFilter.DstAddr.Mask = Copy16Ip(sdfPdr.SdfFilter.DstAddress.Mask)
-	pdrToStore.SdfRules.SdfFilter.DstPort.LowerBound = sdfPdr.SdfFilter.DstPortRange.LowerBound
-	pdrToStore.SdfRules.SdfFilter.DstPort.UpperBound = sdfPdr.SdfFilter.DstPortRange.UpperBound
-	pdrToStore.SdfRules.OuterHeaderRemoval = sdfPdr.OuterHeaderRemoval
-	pdrToStore.SdfRules.FarId = sdfPdr.FarId
-	pdrToStore.SdfRules.QerId = sdfPdr.QerId
-	return pdrToStore
-}
-
-func ToIpEntrypointPdrInfo(defaultPdr PdrInfo) IpEntrypointPdrInfo {
-	var pdrToStore IpEntrypointPdrInfo
-	pdrToStore.OuterHeaderRemoval = defaultPdr.OuterHeaderRemoval
-	pdrToStore.FarId = defaultPdr.FarId
-	pdrToStore.QerId = defaultPdr.QerId
-	return pdrToStore
+func ToIpEntrypointSdfRules(sdfFilters []SdfFilter) (IpEntrypointSdfRules, error) {
+	var sdfRules IpEntrypointSdfRules
+	if len(sdfFilters) > SdfListSize {
+		return sdfRules, fmt.Errorf("%d SDF filters exceed the limit of %d per PDR", len(sdfFilters), SdfListSize)
+	}
+	for i, sdfFilter := range sdfFilters {
+		sdfRules.SdfFilters[i] = toIpEntrypointSdfFilter(sdfFilter)
+		sdfRules.SdfFilterCount++
+	}
+	return sdfRules, nil
+}
+
+func toIpEntrypointSdfFilter(sdfFilter SdfFilter) IpEntrypointSdfFilter {
+	var sdfToStore IpEntrypointSdfFilter
+	sdfToStore.Protocol = sdfFilter.Protocol
+	sdfToStore.SrcAddr.Type = sdfFilter.SrcAddress.Type
+	sdfToStore.SrcAddr.Ip = Copy16Ip(sdfFilter.SrcAddress.Ip)
+	sdfToStore.SrcAddr.Mask = Copy16Ip(sdfFilter.SrcAddress.Mask)
+	sdfToStore.SrcPort.LowerBound = sdfFilter.SrcPortRange.LowerBound
+	sdfToStore.SrcPort.UpperBound = sdfFilter.SrcPortRange.UpperBound
+	sdfToStore.DstAddr.Type = sdfFilter.DstAddress.Type
+	sdfToStore.DstAddr.Ip = Copy16Ip(sdfFilter.DstAddress.Ip)
+	sdfToStore.DstAddr.Mask = Copy16Ip(sdfFilter.DstAddress.Mask)
+	sdfToStore.DstPort.LowerBound = sdfFilter.DstPortRange.LowerBound
+	sdfToStore.DstPort.UpperBound = sdfFilter.DstPortRange.UpperBound
+	sdfToStore.MatchFlags = sdfFilter.MatchFlags
+	sdfToStore.TosTrafficClass = sdfFilter.ToSTrafficClass
+	sdfToStore.TosTrafficClassMask = sdfFilter.ToSTrafficClassMask
+	sdfToStore.Spi = sdfFilter.SecurityParameterIndex
+	sdfToStore.FlowLabel = sdfFilter.FlowLabel
+	return sdfToStore
 }
 
 func Copy16Ip[T ~[]byte](arr T) [16]byte {
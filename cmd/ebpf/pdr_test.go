@@ -0,0 +1,88 @@
+package ebpf
+
+import (
+	"testing"
+)
+
+func TestPdrRulesPrecedenceOrder(t *testing.T) {
+	var stored IpEntrypointPdrInfo
+	var err error
+	for _, rule := range []IpEntrypointPdrRule{
+		{PdrId: 1, Precedence: 255, FarId: 1},
+		{PdrId: 2, Precedence: 100, FarId: 2, SdfId: 1},
+		{PdrId: 3, Precedence: 200, FarId: 3, SdfId: 2},
+		{PdrId: 4, Precedence: 100, FarId: 4, SdfId: 3},
+	} {
+		if stored, _, err = InsertPdrRule(stored, rule); err != nil {
+			t.Fatalf("Can't insert PDR %d: %s", rule.PdrId, err.Error())
+		}
+	}
+	checkPdrIds(t, stored, []uint32{2, 4, 3, 1})
+
+	// Updated PDR replaces its rule and moves to its new precedence
+	stored, replaced, err := InsertPdrRule(stored, IpEntrypointPdrRule{PdrId: 1, Precedence: 50, FarId: 5})
+	if err != nil {
+		t.Fatalf("Can't update PDR 1: %s", err.Error())
+	}
+	if replaced == nil || replaced.FarId != 1 {
+		t.Errorf("Replaced rule of PDR 1 is expected, got %+v", replaced)
+	}
+	checkPdrIds(t, stored, []uint32{1, 2, 4, 3})
+
+	stored, removed := RemovePdrRule(stored, 4)
+	if removed == nil || removed.SdfId != 3 {
+		t.Errorf("Removed rule of PDR 4 is expected, got %+v", removed)
+	}
+	checkPdrIds(t, stored, []uint32{1, 2, 3})
+	if stored.Rules[3] != (IpEntrypointPdrRule{}) {
+		t.Errorf("Rule after the last one should be cleared, got %+v", stored.Rules[3])
+	}
+
+	if _, removed := RemovePdrRule(stored, 4); removed != nil {
+		t.Errorf("PDR 4 is already removed")
+	}
+}
+
+func TestPdrRulesLimit(t *testing.T) {
+	var stored IpEntrypointPdrInfo
+	var err error
+	for i := uint32(1); i <= PdrRuleListSize; i++ {
+		if stored, _, err = InsertPdrRule(stored, IpEntrypointPdrRule{PdrId: i, Precedence: i}); err != nil {
+			t.Fatalf("Can't insert PDR %d: %s", i, err.Error())
+		}
+	}
+	if _, _, err := InsertPdrRule(stored, IpEntrypointPdrRule{PdrId: PdrRuleListSize + 1}); err == nil {
+		t.Errorf("PDR over the limit should be rejected")
+	}
+	// Replacing a stored PDR doesn't need a free rule
+	if _, _, err := InsertPdrRule(stored, IpEntrypointPdrRule{PdrId: 1, Precedence: 1000}); err != nil {
+		t.Errorf("Can't update PDR 1: %s", err.Error())
+	}
+}
+
+func TestSdfRulesLimit(t *testing.T) {
+	sdfFilters := make([]SdfFilter, SdfListSize)
+	sdfRules, err := ToIpEntrypointSdfRules(sdfFilters)
+	if err != nil {
+		t.Fatalf("Can't store %d SDF filters: %s", SdfListSize, err.Error())
+	}
+	if int(sdfRules.SdfFilterCount) != SdfListSize {
+		t.Errorf("Expected %d SDF filters, got %d", SdfListSize, sdfRules.SdfFilterCount)
+	}
+	// SDF filters over the limit are rejected rather than cut off
+	if _, err := ToIpEntrypointSdfRules(append(sdfFilters, SdfFilter{})); err == nil {
+		t.Errorf("SDF filters over the limit should be rejected")
+	}
+}
+
+func checkPdrIds(t *testing.T, stored IpEntrypointPdrInfo, pdrIds []uint32) {
+	t.Helper()
+	if int(stored.RuleCount) != len(pdrIds) {
+		t.Fatalf("Expected %d rules, got %d", len(pdrIds), stored.RuleCount)
+	}
+	for i, pdrId := range pdrIds {
+		if stored.Rules[i].PdrId != pdrId {
+			t.Errorf("Rule %d: expected PDR %d, got %d", i, pdrId, stored.Rules[i].PdrId)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+)
+
+// ProbeFibLookupTbid checks that bpf_fib_lookup supports BPF_FIB_LOOKUP_TBID (Linux 6.8+), the lookup in the routing
+// table of a network instance. Older kernels reject the flag with -EINVAL, so their lookups would never see the table.
+func ProbeFibLookupTbid() error {
+	const fibParamsOffset = -64 // struct bpf_fib_lookup on the stack
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:    "probe_fib_tbid",
+		Type:    ebpf.XDP,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Reg(asm.R6, asm.R1),
+			asm.StoreImm(asm.RFP, fibParamsOffset, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+8, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+16, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+24, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+32, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+40, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+48, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset+56, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, fibParamsOffset, 2, asm.Byte),      // family = AF_INET
+			asm.StoreImm(asm.RFP, fibParamsOffset+8, 1, asm.Word),    // ifindex = loopback
+			asm.StoreImm(asm.RFP, fibParamsOffset+48, 254, asm.Word), // tbid = main table
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, fibParamsOffset),
+			asm.Mov.Imm(asm.R3, 64),
+			asm.Mov.Imm(asm.R4, 1|8), // BPF_FIB_LOOKUP_DIRECT | BPF_FIB_LOOKUP_TBID
+			asm.FnFibLookup.Call(),
+			asm.JEq.Imm(asm.R0, -22, "unsupported"), // -EINVAL
+			asm.Mov.Imm(asm.R0, 2),                  // XDP_PASS
+			asm.Return(),
+			asm.Mov.Imm(asm.R0, 1).WithSymbol("unsupported"), // XDP_DROP
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't load probe program: %w", err)
+	}
+	defer prog.Close()
+
+	ret, err := prog.Run(&ebpf.RunOptions{Data: make([]byte, 64)})
+	if err != nil {
+		return fmt.Errorf("can't run probe program: %w", err)
+	}
+	if ret != 2 {
+		return errors.New("bpf_fib_lookup doesn't support routing table lookups, Linux 6.8 or newer is required")
+	}
+	return nil
+}
+
+// ProbeXdpLiveFrames checks that XDP programs can be run on packets as if they are received (Linux 5.18+), which
+// ReinjectPacket relies on to forward the buffered downlink packets. Older kernels reject BPF_F_TEST_XDP_LIVE_FRAMES.
+func ProbeXdpLiveFrames() error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:    "probe_live_frames",
+		Type:    ebpf.XDP,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 1), // XDP_DROP
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't load probe program: %w", err)
+	}
+	defer prog.Close()
+
+	if _, err := prog.Run(&ebpf.RunOptions{Data: make([]byte, 64), Flags: unix.BPF_F_TEST_XDP_LIVE_FRAMES}); err != nil {
+		return fmt.Errorf("XDP programs can't be run on live frames, Linux 5.18 or newer is required: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/rs/zerolog/log"
+)
+
+// UrrEvent mirrors struct urr_event. It is sent by the datapath when a URR reaches its threshold or quota.
+type UrrEvent struct {
+	UrrId  uint32
+	Status uint32
+}
+
+// ListenUrrEvents starts forwarding URR events from the urr_events ring buffer to the channel.
+func (bpfObjects *BpfObjects) ListenUrrEvents(events chan<- UrrEvent) error {
+	reader, err := ringbuf.NewReader(bpfObjects.UrrEvents)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer reader.Close()
+		for {
+			record, err := reader.Read()
+			if err != nil {
+				if errors.Is(err, ringbuf.ErrClosed) {
+					return
+				}
+				log.Warn().Msgf("Can't read URR event: %s", err.Error())
+				continue
+			}
+			if len(record.RawSample) < 8 {
+				log.Warn().Msgf("Got truncated URR event: %x", record.RawSample)
+				continue
+			}
+			events <- UrrEvent{
+				UrrId:  binary.NativeEndian.Uint32(record.RawSample[0:4]),
+				Status: binary.NativeEndian.Uint32(record.RawSample[4:8]),
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,59 @@
+/**
+ * Copyright 2023-2025 Edgecom LLC
+ * 
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ * 
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * 
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#pragma once
+
+#include <bpf/bpf_helpers.h>
+#include <linux/bpf.h>
+
+#include "xdp/utils/packet_context.h"
+#include "xdp/utils/trace.h"
+
+/* Header of a downlink packet handed to user space, the packet itself follows it starting from the ethernet header */
+struct buffered_packet {
+    __u32 far_id;
+    __u32 pdr_id;
+    /* Offset of the IP header, past the VLAN tag if any */
+    __u32 packet_offset;
+    /* Interface the packet is received on, the packet is reinjected there */
+    __u32 ifindex;
+};
+
+/* Downlink packets of BUFF and NOCP FARs for user space */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, sizeof(__u32));
+} buffered_packets SEC(".maps");
+
+
+/* User space keeps the packet until the FAR is updated to forward it and notifies the CP function about it */
+static __always_inline enum xdp_action buffer_downlink_packet(struct packet_context *ctx, __u32 far_id, __u32 pdr_id)
+{
+    const char *ip = ctx->ip4 ? (const char *)ctx->ip4 : (const char *)ctx->ip6;
+    struct buffered_packet meta = {
+        .far_id = far_id,
+        .pdr_id = pdr_id,
+        .packet_offset = ip - (const char *)(long)ctx->xdp_ctx->data,
+        .ifindex = ctx->xdp_ctx->ingress_ifindex,
+    };
+    const __u64 packet_size = ctx->xdp_ctx->data_end - ctx->xdp_ctx->data;
+
+    if (bpf_perf_event_output(ctx->xdp_ctx, &buffered_packets, BPF_F_CURRENT_CPU | (packet_size << 32), &meta, sizeof(meta)))
+        upf_printk("upf: can't buffer packet far:%u pdr:%u", far_id, pdr_id);
+    return XDP_DROP;
+}
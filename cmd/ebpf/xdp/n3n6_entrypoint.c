@@ -30,6 +30,7 @@
 #include "xdp/statistics.h"
 #include "xdp/qer.h"
 #include "xdp/urr.h"
+#include "xdp/downlink_buffer.h"
 #include "xdp/pdr.h"
 #include "xdp/sdf_filter.h"
 
@@ -55,37 +56,44 @@ static __always_inline int is_local_ip(__u32 ip)
     return (ip == global_config.n3_ipv4_address || ip == global_config.n9_ipv4_address);
 }
 
-static __always_inline enum xdp_action send_to_gtp_tunnel(struct packet_context *ctx, int srcip, int dstip, __u8 tos, __u8 qfi, int teid) {
+static __always_inline enum xdp_action send_to_gtp_tunnel(struct packet_context *ctx, int srcip, int dstip, __u8 tos, __u8 qfi, int teid, __u32 network_instance) {
     if (-1 == add_gtp_over_ip4_headers(ctx, srcip, dstip, tos, qfi, teid))
         return XDP_ABORTED;
     upf_printk("upf: send gtp pdu %pI4 -> %pI4", &ctx->ip4->saddr, &ctx->ip4->daddr);
     increment_counter(ctx->n3_n6_counter, tx_n3);
-    return route_ipv4(ctx->xdp_ctx, ctx->eth, ctx->ip4);
+    return route_ipv4(ctx->xdp_ctx, ctx->eth, ctx->ip4, network_instance);
 }
 
 
 
-static __always_inline __u16 handle_n6_packet_ipv4(struct packet_context *ctx) {
+/* Network instance of the N6 packet by its ingress interface and VLAN */
+static __always_inline __u32 get_packet_network_instance(const struct packet_context *ctx) {
+    __u16 vlan_id = ctx->vlan ? bpf_ntohs(ctx->vlan->tci) & VLAN_VID_MASK : 0;
+    return get_n6_network_instance(ctx->xdp_ctx->ingress_ifindex, vlan_id);
+}
+
+static __always_inline __u16 handle_n6_packet_ipv4(struct packet_context *ctx, __u32 network_instance) {
     const struct iphdr *ip4 = ctx->ip4;
-    struct pdr_info *pdr = bpf_map_lookup_elem(&pdr_map_downlink_ip4, &ip4->daddr);
+    struct ue_ip4_key key = {.network_instance = network_instance, .ue_ip = ip4->daddr};
+    struct pdr_info *pdr = bpf_map_lookup_elem(&pdr_map_downlink_ip4, &key);
     if (!pdr) {
-        upf_printk("upf: [n6] no downlink session for ip:%pI4", &ip4->daddr);
+        upf_printk("upf: [n6] no downlink session for ip:%pI4 network instance:%d", &ip4->daddr, network_instance);
         return DEFAULT_XDP_ACTION;
     }
 
-    __u32 far_id = pdr->far_id;
-    __u32 qer_id = pdr->qer_id;
-    //__u8 outer_header_removal = pdr->outer_header_removal;
-    if (pdr->sdf_mode) {
-        struct sdf_filter *sdf = &pdr->sdf_rules.sdf_filter;
-        if(match_sdf_filter_ipv4(ctx, sdf)) {
-            upf_printk(" [n6] Packet with source ip:%pI4 and destination ip:%pI4 matches SDF filter", &ip4->saddr, &ip4->daddr);
-            far_id = pdr->sdf_rules.far_id;
-            qer_id = pdr->sdf_rules.qer_id;
-            //outer_header_removal = pdr->sdf_rules.outer_header_removal;
-        } else if(pdr->sdf_mode & 1) {
-            return DEFAULT_XDP_ACTION;
-        }
+    const struct pdr_rule *rule = match_pdr_rule_ipv4(ctx, pdr);
+    if (!rule) {
+        upf_printk("upf: [n6] no downlink PDR matches packet for ip:%pI4", &ip4->daddr);
+        return DEFAULT_XDP_ACTION;
+    }
+    upf_printk("upf: [n6] packet with source ip:%pI4 matches PDR:%d", &ip4->saddr, rule->pdr_id);
+
+    __u32 far_id = rule->far_id;
+    __u32 qer_id = rule->qer_id;
+
+    if (-1 == apply_urr_quota(rule->urr1_id, &far_id) || -1 == apply_urr_quota(rule->urr2_id, &far_id)) {
+        upf_printk("upf: [n6] quota exhausted for ip:%pI4", &ip4->daddr);
+        return XDP_DROP;
     }
 
     struct far_info *far = bpf_map_lookup_elem(&far_map, &far_id);
@@ -96,9 +104,12 @@ static __always_inline __u16 handle_n6_packet_ipv4(struct packet_context *ctx) {
 
     upf_printk("upf: [n6] downlink session for ip:%pI4  far:%d action:%d", &ip4->daddr, far_id, far->action);
 
-    // Only forwarding action is supported at the moment
-    if (!(far->action & FAR_FORW))
+    if (!(far->action & FAR_FORW)) {
+        // Packets of idle UEs wait in user space for the FAR to be updated
+        if (far->action & (FAR_BUFF | FAR_NOCP))
+            return buffer_downlink_packet(ctx, far_id, rule->pdr_id);
         return XDP_DROP;
+    }
 
     // Only outer header GTP/UDP/IPv4 is supported at the moment
     if (!(far->outer_header_creation & OHC_GTP_U_UDP_IPv4))
@@ -121,34 +132,36 @@ static __always_inline __u16 handle_n6_packet_ipv4(struct packet_context *ctx) {
 
     __u8 tos = far->transport_level_marking >> 8;
 
-    update_urr(pdr->urr1_id, 0, packet_size);
-    update_urr(pdr->urr2_id, 0, packet_size);
+    update_urr(rule->urr1_id, 0, packet_size);
+    update_urr(rule->urr2_id, 0, packet_size);
 
     upf_printk("upf: [n6] use mapping %pI4 -> teid:%u", &ip4->daddr, far->teid);
-    return send_to_gtp_tunnel(ctx, global_config.n3_ipv4_address, far->remoteip, tos, qer->qfi, far->teid);
+    return send_to_gtp_tunnel(ctx, global_config.n3_ipv4_address, far->remoteip, tos, qer->qfi, far->teid, far->network_instance);
 }
 
-static __always_inline enum xdp_action handle_n6_packet_ipv6(struct packet_context *ctx) {
+static __always_inline enum xdp_action handle_n6_packet_ipv6(struct packet_context *ctx, __u32 network_instance) {
     const struct ipv6hdr *ip6 = ctx->ip6;
-    struct pdr_info *pdr = bpf_map_lookup_elem(&pdr_map_downlink_ip6, &ip6->daddr);
+    struct ue_ip6_key key = {.network_instance = network_instance};
+    __builtin_memcpy(key.ue_ip, &ip6->daddr, sizeof(key.ue_ip));
+    struct pdr_info *pdr = bpf_map_lookup_elem(&pdr_map_downlink_ip6, &key);
     if (!pdr) {
-        upf_printk("upf: [n6] no downlink session for ip:%pI6c", &ip6->daddr);
+        upf_printk("upf: [n6] no downlink session for ip:%pI6c network instance:%d", &ip6->daddr, network_instance);
         return DEFAULT_XDP_ACTION;
     }
 
-    __u32 far_id = pdr->far_id;
-    __u32 qer_id = pdr->qer_id;
-    //__u8 outer_header_removal = pdr->outer_header_removal;
-    if (pdr->sdf_mode) {
-        struct sdf_filter *sdf = &pdr->sdf_rules.sdf_filter;
-        if(match_sdf_filter_ipv6(ctx, sdf)) {
-            upf_printk(" [n6] Packet with source ip:%pI6c and destination ip:%pI6c matches SDF filter", &ip6->saddr, &ip6->daddr);
-            far_id = pdr->sdf_rules.far_id;
-            qer_id = pdr->sdf_rules.qer_id;
-            //outer_header_removal = pdr->sdf_rules.outer_header_removal;
-        } else if(pdr->sdf_mode & 1) {
-            return DEFAULT_XDP_ACTION;
-        }
+    const struct pdr_rule *rule = match_pdr_rule_ipv6(ctx, pdr);
+    if (!rule) {
+        upf_printk("upf: [n6] no downlink PDR matches packet for ip:%pI6c", &ip6->daddr);
+        return DEFAULT_XDP_ACTION;
+    }
+    upf_printk("upf: [n6] packet with source ip:%pI6c matches PDR:%d", &ip6->saddr, rule->pdr_id);
+
+    __u32 far_id = rule->far_id;
+    __u32 qer_id = rule->qer_id;
+
+    if (-1 == apply_urr_quota(rule->urr1_id, &far_id) || -1 == apply_urr_quota(rule->urr2_id, &far_id)) {
+        upf_printk("upf: [n6] quota exhausted for ip:%pI6c", &ip6->daddr);
+        return XDP_DROP;
     }
 
     struct far_info *far = bpf_map_lookup_elem(&far_map, &far_id);
@@ -159,9 +172,12 @@ static __always_inline enum xdp_action handle_n6_packet_ipv6(struct packet_conte
 
     upf_printk("upf: [n6] downlink session for ip:%pI6c far:%d action:%d", &ip6->daddr, far_id, far->action);
 
-    // Only forwarding action supported at the moment
-    if (!(far->action & FAR_FORW))
+    if (!(far->action & FAR_FORW)) {
+        // Packets of idle UEs wait in user space for the FAR to be updated
+        if (far->action & (FAR_BUFF | FAR_NOCP))
+            return buffer_downlink_packet(ctx, far_id, rule->pdr_id);
         return XDP_DROP;
+    }
 
     // Only outer header GTP/UDP/IPv4 is supported at the moment
     if (!(far->outer_header_creation & OHC_GTP_U_UDP_IPv4))
@@ -184,11 +200,11 @@ static __always_inline enum xdp_action handle_n6_packet_ipv6(struct packet_conte
 
     __u8 tos = far->transport_level_marking >> 8;
 
-    update_urr(pdr->urr1_id, 0, packet_size);
-    update_urr(pdr->urr2_id, 0, packet_size);
+    update_urr(rule->urr1_id, 0, packet_size);
+    update_urr(rule->urr2_id, 0, packet_size);
 
     upf_printk("upf: [n6] use mapping %pI6c -> teid:%u", &ip6->daddr, far->teid);
-    return send_to_gtp_tunnel(ctx, global_config.n3_ipv4_address, far->remoteip, tos, qer->qfi, far->teid);
+    return send_to_gtp_tunnel(ctx, global_config.n3_ipv4_address, far->remoteip, tos, qer->qfi, far->teid, far->network_instance);
 }
 
 static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *ctx) {
@@ -207,11 +223,9 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
         return DEFAULT_XDP_ACTION;
     }
 
-    __u32 far_id = pdr->far_id;
-    __u32 qer_id = pdr->qer_id;
-    __u8 outer_header_removal = pdr->outer_header_removal;
-
-    if (pdr->sdf_mode) {
+    // The inner packet is parsed only if the highest priority PDR has SDF filters
+    const struct pdr_rule *rule = NULL;
+    if (pdr->rules[0].sdf_id) {
         struct packet_context inner_context = {
             .data = (char *)(long)ctx->data,
             .data_end = (const char *)(long)ctx->data_end,
@@ -234,17 +248,7 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
                     return DEFAULT_XDP_ACTION;
                 }
 
-                const struct sdf_filter *sdf = &pdr->sdf_rules.sdf_filter;
-                if(match_sdf_filter_ipv4(&inner_context, sdf)) {
-                    upf_printk("upf: [n3] sdf filter matches teid:%u", teid);
-                    far_id = pdr->sdf_rules.far_id;
-                    qer_id = pdr->sdf_rules.qer_id;
-                    outer_header_removal = pdr->sdf_rules.outer_header_removal;
-                } else {
-                    upf_printk("upf: [n3] sdf filter doesn't match teid:%u", teid);
-                    if(pdr->sdf_mode & 1)
-                        return DEFAULT_XDP_ACTION;
-                }
+                rule = match_pdr_rule_ipv4(&inner_context, pdr);
                 break;
             }
             case ETH_P_IPV6_BE:
@@ -260,25 +264,31 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
                     return DEFAULT_XDP_ACTION;
                 }
 
-                const struct sdf_filter *sdf = &pdr->sdf_rules.sdf_filter;
-                if(match_sdf_filter_ipv6(&inner_context, sdf)) {
-                    upf_printk("upf: [n3] sdf filter matches teid:%u", teid);
-                    far_id = pdr->sdf_rules.far_id;
-                    qer_id = pdr->sdf_rules.qer_id;
-                    outer_header_removal = pdr->sdf_rules.outer_header_removal;
-                } else {
-                    upf_printk("upf: [n3] sdf filter doesn't match teid:%u", teid);
-                    if(pdr->sdf_mode & 1)
-                        return DEFAULT_XDP_ACTION;
-                }
+                rule = match_pdr_rule_ipv6(&inner_context, pdr);
                 break;
             }
             default:
                 upf_printk("upf: [n3] unsupported inner ethernet protocol: %d", eth_protocol);
-                if(pdr->sdf_mode & 1)
-                    return DEFAULT_XDP_ACTION;
+                rule = match_pdr_rule_no_sdf(pdr);
                 break;
         }
+    } else {
+        rule = match_pdr_rule_no_sdf(pdr);
+    }
+
+    if (!rule) {
+        upf_printk("upf: [n3] no PDR matches packet for teid:%u", teid);
+        return DEFAULT_XDP_ACTION;
+    }
+    upf_printk("upf: [n3] packet for teid:%u matches PDR:%d", teid, rule->pdr_id);
+
+    __u32 far_id = rule->far_id;
+    __u32 qer_id = rule->qer_id;
+    __u8 outer_header_removal = rule->outer_header_removal;
+
+    if (-1 == apply_urr_quota(rule->urr1_id, &far_id) || -1 == apply_urr_quota(rule->urr2_id, &far_id)) {
+        upf_printk("upf: [n3] quota exhausted for teid:%u", teid);
+        return XDP_DROP;
     }
 
     /*
@@ -314,10 +324,10 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
     if (XDP_DROP == limit_rate_sliding_window(packet_size, &qer->ul_start, qer->ul_maximum_bitrate))
         return XDP_DROP;
 
-    update_urr(pdr->urr1_id, packet_size, 0);
-    update_urr(pdr->urr2_id, packet_size, 0);
+    update_urr(rule->urr1_id, packet_size, 0);
+    update_urr(rule->urr2_id, packet_size, 0);
 
-    upf_printk("upf: [n3] session for teid:%u far:%d outer_header_removal:%d", teid, pdr->far_id, outer_header_removal);
+    upf_printk("upf: [n3] session for teid:%u far:%d outer_header_removal:%d", teid, far_id, outer_header_removal);
 
     // N9: Only outer header GTP/UDP/IPv4 is supported at the moment
     if (far->outer_header_creation & OHC_GTP_U_UDP_IPv4)
@@ -354,7 +364,11 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
             return XDP_ABORTED;
 
         upf_printk("upf: [n3] send icmp ping reply %pI4 -> %pI4", &ctx->ip4->saddr, &ctx->ip4->daddr);
-        return handle_n6_packet_ipv4(ctx);
+        // The UE is in the network instance its uplink packets are forwarded to, unless it shares the default UE addresses
+        struct ue_ip4_key key = {.network_instance = far->network_instance, .ue_ip = ctx->ip4->daddr};
+        if (key.network_instance && !bpf_map_lookup_elem(&pdr_map_downlink_ip4, &key))
+            key.network_instance = 0;
+        return handle_n6_packet_ipv4(ctx, key.network_instance);
     }
 
     /*
@@ -362,10 +376,10 @@ static __always_inline enum xdp_action handle_gtp_packet(struct packet_context *
      */
     if (ctx->ip4) {
         increment_counter(ctx->n3_n6_counter, tx_n6);
-        return route_ipv4(ctx->xdp_ctx, ctx->eth, ctx->ip4);
+        return route_ipv4(ctx->xdp_ctx, ctx->eth, ctx->ip4, far->network_instance);
     } else if (ctx->ip6) {
         increment_counter(ctx->n3_n6_counter, tx_n6);
-        return route_ipv6(ctx->xdp_ctx, ctx->eth, ctx->ip6);
+        return route_ipv6(ctx->xdp_ctx, ctx->eth, ctx->ip6, far->network_instance);
     } else {
         return XDP_ABORTED;
     }
@@ -377,6 +391,10 @@ static __always_inline enum xdp_action handle_gtpu(struct packet_context *ctx) {
     switch (pdu_type) {
         case GTPU_G_PDU:
             increment_counter(ctx->counters, rx_gtp_pdu);
+            if (ctx->vlan && remove_vlan_header(ctx)) {
+                upf_printk("upf: can't remove vlan header of gtp-u packet");
+                return XDP_ABORTED;
+            }
             return handle_gtp_packet(ctx);
         case GTPU_ECHO_REQUEST:
             increment_counter(ctx->counters, rx_gtp_echo);
@@ -425,7 +443,7 @@ static __always_inline enum xdp_action handle_ip4(struct packet_context *ctx) {
     }
 
     increment_counter(ctx->n3_n6_counter, rx_n6);
-    return handle_n6_packet_ipv4(ctx);
+    return handle_n6_packet_ipv4(ctx, get_packet_network_instance(ctx));
 }
 
 static __always_inline enum xdp_action handle_ip6(struct packet_context *ctx) {
@@ -453,7 +471,7 @@ static __always_inline enum xdp_action handle_ip6(struct packet_context *ctx) {
             return DEFAULT_XDP_ACTION;
     }
     increment_counter(ctx->n3_n6_counter, rx_n6);
-    return handle_n6_packet_ipv6(ctx);
+    return handle_n6_packet_ipv6(ctx, get_packet_network_instance(ctx));
 }
 
 static __always_inline enum xdp_action process_packet(struct packet_context *ctx) {
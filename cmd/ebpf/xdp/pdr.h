@@ -38,43 +38,127 @@ enum outer_header_removal_values {
 };
 
 // Possible optimizations:
-// 0. Store SDFs in a separate map. PDR will have only id of corresponding SDF.
 // 1. Combine SrcAddress.Type and DstAddress.Type into one __u8 field. Then to retrieve and put data will be used operators & and | .
 // 2. Put all fields into one big structure. Sort in specific order to reduce paddings inside structure.
 
 struct sdf_rules {
-    struct sdf_filter sdf_filter;
-    __u8 outer_header_removal;
-    __u32 far_id;
-    __u32 qer_id;
-    __u32 urr1_id;
-    __u32 urr2_id;
+    struct sdf_filter sdf_filters[SDF_LIST_SIZE];
+    __u8 sdf_filter_count; // Number of filters set in sdf_filters
 };
 
-struct pdr_info {
+/* sdf id -> SDF filters of a PDR */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, struct sdf_rules);
+    __uint(max_entries, SDF_MAP_SIZE);
+} sdf_map SEC(".maps");
+
+/* Packet matches the SDF rules if it matches any of their filters */
+static __always_inline __u8 match_sdf_rules_ipv4(const struct packet_context *ctx, const struct sdf_rules *rules) {
+    for (int i = 0; i < SDF_LIST_SIZE; i++) {
+        if (i >= rules->sdf_filter_count)
+            break;
+        if (match_sdf_filter_ipv4(ctx, &rules->sdf_filters[i]))
+            return 1;
+    }
+    return 0;
+}
+
+static __always_inline __u8 match_sdf_rules_ipv6(const struct packet_context *ctx, const struct sdf_rules *rules) {
+    for (int i = 0; i < SDF_LIST_SIZE; i++) {
+        if (i >= rules->sdf_filter_count)
+            break;
+        if (match_sdf_filter_ipv6(ctx, &rules->sdf_filters[i]))
+            return 1;
+    }
+    return 0;
+}
+
+struct pdr_rule {
+    __u32 pdr_id;
+    __u32 precedence;
     __u32 far_id;
     __u32 qer_id;
     __u32 urr1_id;
     __u32 urr2_id;
+    __u32 sdf_id; // 0 - no SDF filters, the rule matches all packets
+    __u32 network_instance; // 0 - default network instance
     __u8 outer_header_removal;
-    __u8 sdf_mode; // 0 - no sdf, 1 - sdf only, 2 - sdf + default
-    struct sdf_rules sdf_rules;
 };
 
-/* ipv4 -> PDR */
+/* All PDRs sharing a TEID or UE IP address */
+struct pdr_info {
+    struct pdr_rule rules[PDR_RULE_LIST_SIZE]; // Sorted by precedence, the highest priority first
+    __u8 rule_count;
+};
+
+/* Rules are sorted by precedence, so the first matching one is the PDR to apply */
+static __always_inline const struct pdr_rule *match_pdr_rule_ipv4(const struct packet_context *ctx, const struct pdr_info *pdr) {
+    for (int i = 0; i < PDR_RULE_LIST_SIZE; i++) {
+        if (i >= pdr->rule_count)
+            break;
+        const struct pdr_rule *rule = &pdr->rules[i];
+        if (!rule->sdf_id)
+            return rule;
+        const struct sdf_rules *sdf_rules = bpf_map_lookup_elem(&sdf_map, &rule->sdf_id);
+        if (sdf_rules && match_sdf_rules_ipv4(ctx, sdf_rules))
+            return rule;
+    }
+    return NULL;
+}
+
+static __always_inline const struct pdr_rule *match_pdr_rule_ipv6(const struct packet_context *ctx, const struct pdr_info *pdr) {
+    for (int i = 0; i < PDR_RULE_LIST_SIZE; i++) {
+        if (i >= pdr->rule_count)
+            break;
+        const struct pdr_rule *rule = &pdr->rules[i];
+        if (!rule->sdf_id)
+            return rule;
+        const struct sdf_rules *sdf_rules = bpf_map_lookup_elem(&sdf_map, &rule->sdf_id);
+        if (sdf_rules && match_sdf_rules_ipv6(ctx, sdf_rules))
+            return rule;
+    }
+    return NULL;
+}
+
+/* Packets which SDF filters can't be applied to match only the rules without SDF filters */
+static __always_inline const struct pdr_rule *match_pdr_rule_no_sdf(const struct pdr_info *pdr) {
+    for (int i = 0; i < PDR_RULE_LIST_SIZE; i++) {
+        if (i >= pdr->rule_count)
+            break;
+        if (!pdr->rules[i].sdf_id)
+            return &pdr->rules[i];
+    }
+    return NULL;
+}
+
+/* UE addresses of different network instances may overlap */
+struct ue_ip4_key {
+    __u32 network_instance;
+    __u32 ue_ip;
+};
+
+struct ue_ip6_key {
+    __u32 network_instance;
+    __u8 ue_ip[16];
+};
+
+/* network instance, ipv4 -> PDR */
 struct
 {
     __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, __u32);
+    __type(key, struct ue_ip4_key);
     __type(value, struct pdr_info);
     __uint(max_entries, PDR_MAP_SIZE);
 } pdr_map_downlink_ip4 SEC(".maps");
 
-/* ipv6 -> PDR */
+/* network instance, ipv6 -> PDR */
 struct
 {
     __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, struct in6_addr);
+    __type(key, struct ue_ip6_key);
     __type(value, struct pdr_info);
     __uint(max_entries, PDR_MAP_SIZE);
 } pdr_map_downlink_ip6 SEC(".maps");
@@ -114,6 +198,8 @@ struct far_info {
     __u32 remoteip;
     /* first octet DSCP value in the Type-of-Service, second octet shall contain the ToS/Traffic Class mask field, which shall be set to "0xFC". */
     __u16 transport_level_marking;
+    /* Destination network instance, the packet is routed in its routing table. 0 - default routing table */
+    __u32 network_instance;
 };
 
 /* FAR ID -> FAR */
@@ -46,12 +46,24 @@ struct port_range {
     __u16 upper_bound; // If not specified in SDF: 65535
 };
 
+/* Fields of the SDF Filter IE matched besides the flow description, as its flags */
+enum sdf_match_flags {
+    SDF_MATCH_TTC = 0x02, // ToS/Traffic Class
+    SDF_MATCH_SPI = 0x04, // Security Parameter Index
+    SDF_MATCH_FL = 0x08,  // Flow Label
+};
+
 struct sdf_filter {
-    __u8 protocol; // Required by SDF. 0: icmp, 1: ip, 2: tcp, 3: udp
+    __u8 protocol; // Required by SDF. 0: icmp, 1: ip, 2: tcp, 3: udp, 4: icmp6, 5: esp, 6: ah
     struct ip_subnet src_addr;
     struct port_range src_port;
     struct ip_subnet dst_addr;
     struct port_range dst_port;
+    __u8 match_flags;
+    __u8 tos_traffic_class;
+    __u8 tos_traffic_class_mask;
+    __u32 spi;
+    __u32 flow_label; // Lower 20 bits
 };
 
 
@@ -61,10 +73,36 @@ static __always_inline __u8 get_sdf_protocol(__u8 ip_protocol) {
         case IPPROTO_ICMP: return 0;
         case IPPROTO_TCP: return 2;
         case IPPROTO_UDP: return 3;
+        case IPPROTO_ICMPV6: return 4;
+        case IPPROTO_ESP: return 5;
+        case IPPROTO_AH: return 6;
         default: return 1;
     }
 }
 
+/* SPI of the ESP or AH header following the IP header, 0 (reserved SPI) for other packets */
+static __always_inline __u32 get_packet_spi(const struct packet_context *ctx, __u8 ip_protocol) {
+    const char *spi = ctx->data;
+    if (ip_protocol == IPPROTO_AH)
+        spi += 4;
+    else if (ip_protocol != IPPROTO_ESP)
+        return 0;
+    if (spi + sizeof(__u32) > ctx->data_end)
+        return 0;
+    return bpf_ntohl(*(const __u32 *)spi);
+}
+
+static __always_inline __u8 match_sdf_fields(const struct sdf_filter *sdf, __u8 tos_traffic_class, __u32 spi, __u8 has_flow_label, __u32 flow_label) {
+    if ((sdf->match_flags & SDF_MATCH_TTC) &&
+        (tos_traffic_class & sdf->tos_traffic_class_mask) != (sdf->tos_traffic_class & sdf->tos_traffic_class_mask))
+        return 0;
+    if ((sdf->match_flags & SDF_MATCH_SPI) && spi != sdf->spi)
+        return 0;
+    if ((sdf->match_flags & SDF_MATCH_FL) && (!has_flow_label || flow_label != sdf->flow_label))
+        return 0;
+    return 1;
+}
+
 static __always_inline __u8 match_sdf_filter_ipv4(const struct packet_context *ctx, const struct sdf_filter *sdf) {
     if(!ctx || !ctx->ip4 || !sdf)
         return 0;
@@ -103,6 +141,10 @@ static __always_inline __u8 match_sdf_filter_ipv4(const struct packet_context *c
     {
         return 0;
     }
+
+    // IPv4 packets have no flow label
+    if (sdf->match_flags && !match_sdf_fields(sdf, ip4->tos, get_packet_spi(ctx, ip4->protocol), 0, 0))
+        return 0;
     
     upf_printk("Packet with source ip: %pI4, destination ip: %pI4 matches SDF filter",
                &ip4->saddr, &ip4->daddr);
@@ -145,6 +187,13 @@ static __always_inline __u8 match_sdf_filter_ipv6(const struct packet_context *c
         return 0;
     }
 
+    if (sdf->match_flags) {
+        __u8 traffic_class = (ipv6->priority << 4) | (ipv6->flow_lbl[0] >> 4);
+        __u32 flow_label = ((__u32)(ipv6->flow_lbl[0] & 0x0f) << 16) | ((__u32)ipv6->flow_lbl[1] << 8) | ipv6->flow_lbl[2];
+        if (!match_sdf_fields(sdf, traffic_class, get_packet_spi(ctx, ipv6->nexthdr), 1, flow_label))
+            return 0;
+    }
+
     upf_printk("SDF: packet with source ip:%pI6c, destination ip:%pI6c matches SDF filter",
                &packet_src_ip_128, &packet_dst_ip_128);
 
@@ -24,6 +24,8 @@
 #define URR_LIST_SIZE 2               //  2 URR per session
 #define URR_MAP_SIZE MAX_SESSIONS *URR_LIST_SIZE
 #define SDF_LIST_SIZE 5
+#define SDF_MAP_SIZE PDR_MAP_SIZE     //  1 SDF filter list per PDR
+#define PDR_RULE_LIST_SIZE 8          //  8 PDR per TEID or UE IP
 
 #define XSTR(x) STR(x)
 #define STR(x) #x
@@ -32,4 +34,5 @@
 #pragma message "Max configured FARs:       " XSTR(FAR_MAP_SIZE)
 #pragma message "Max configured QERs:       " XSTR(QER_MAP_SIZE)
 #pragma message "Max configured URRs:       " XSTR(URR_MAP_SIZE)
-#pragma message "Max configured SDF per PDR: " XSTR(SDF_LIST_SIZE)
\ No newline at end of file
+#pragma message "Max configured SDF per PDR: " XSTR(SDF_LIST_SIZE)
+#pragma message "Max configured PDR per key: " XSTR(PDR_RULE_LIST_SIZE)
\ No newline at end of file
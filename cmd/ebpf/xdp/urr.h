@@ -22,9 +22,55 @@
 #include "xdp/utils/trace.h"
 #include "xdp/sizing.h"
 
+enum urr_volume_flags {
+    URR_TOTAL_THRESHOLD = 0x01,
+    URR_UL_THRESHOLD = 0x02,
+    URR_DL_THRESHOLD = 0x04,
+    URR_TOTAL_QUOTA = 0x08,
+    URR_UL_QUOTA = 0x10,
+    URR_DL_QUOTA = 0x20,
+};
+
+enum urr_status_flags {
+    URR_STATUS_THRESHOLD_REACHED = 0x01,
+    URR_STATUS_QUOTA_EXHAUSTED = 0x02,
+};
+
+enum urr_quota_action {
+    URR_QUOTA_ACTION_DROP = 0,
+    URR_QUOTA_ACTION_APPLY_FAR = 1,
+};
+
+/* Volume counters and the status latched by the datapath */
 struct urr_info {
     __u64 ul;
     __u64 dl;
+    __u32 status;
+    /* Generation of the limits the status refers to */
+    __u32 generation;
+};
+
+/* Limits provisioned by the control plane, the datapath never writes them */
+struct urr_limits {
+    /* Thresholds and quotas are absolute values of the ul/dl counters. Only limits set in volume_flags are checked. */
+    __u64 total_threshold;
+    __u64 ul_threshold;
+    __u64 dl_threshold;
+    __u64 total_quota;
+    __u64 ul_quota;
+    __u64 dl_quota;
+    __u32 quota_far_id;
+    /* Status set by the control plane, e.g. when the time quota is exhausted */
+    __u32 status;
+    /* Changed on every update of the limits, the datapath then checks the counters against the new limits */
+    __u32 generation;
+    __u8 volume_flags;
+    __u8 quota_action;
+};
+
+struct urr_event {
+    __u32 urr_id;
+    __u32 status;
 };
 
 
@@ -37,13 +83,92 @@ struct
     __uint(max_entries, URR_MAP_SIZE);
 } urr_map SEC(".maps");
 
+/* URR ID -> URR limits */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, struct urr_limits);
+    __uint(max_entries, URR_MAP_SIZE);
+} urr_limit_map SEC(".maps");
+
+/* URR status changes for the control plane */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 1 << 16);
+} urr_events SEC(".maps");
+
+
+static __always_inline __u32 check_urr_limits(const struct urr_info *urr, const struct urr_limits *limits)
+{
+    __u64 total = urr->ul + urr->dl;
+    __u32 status = 0;
+
+    if (((limits->volume_flags & URR_TOTAL_THRESHOLD) && total >= limits->total_threshold) ||
+        ((limits->volume_flags & URR_UL_THRESHOLD) && urr->ul >= limits->ul_threshold) ||
+        ((limits->volume_flags & URR_DL_THRESHOLD) && urr->dl >= limits->dl_threshold))
+        status |= URR_STATUS_THRESHOLD_REACHED;
+
+    if (((limits->volume_flags & URR_TOTAL_QUOTA) && total >= limits->total_quota) ||
+        ((limits->volume_flags & URR_UL_QUOTA) && urr->ul >= limits->ul_quota) ||
+        ((limits->volume_flags & URR_DL_QUOTA) && urr->dl >= limits->dl_quota))
+        status |= URR_STATUS_QUOTA_EXHAUSTED;
+
+    return status;
+}
+
+/* URR ID 0 is never allocated, PDRs without URRs refer to it */
+static __always_inline int apply_urr_quota(__u32 urr_id, __u32 *far_id)
+{
+    if (!urr_id)
+        return 0;
+
+    struct urr_info *urr = bpf_map_lookup_elem(&urr_map, &urr_id);
+    struct urr_limits *limits = bpf_map_lookup_elem(&urr_limit_map, &urr_id);
+    if (!urr || !limits)
+        return 0;
+
+    /* The quota is checked against the current limits, the latched status may refer to the previous ones */
+    if (!((limits->status | check_urr_limits(urr, limits)) & URR_STATUS_QUOTA_EXHAUSTED))
+        return 0;
+
+    upf_printk("upf: urr:%u quota exhausted action:%u far:%u", urr_id, limits->quota_action, limits->quota_far_id);
+    if (limits->quota_action == URR_QUOTA_ACTION_APPLY_FAR) {
+        *far_id = limits->quota_far_id;
+        return 0;
+    }
+    return -1;
+}
 
 static __always_inline void update_urr(__u32 urr_id, __u64 uplink_bytes, __u64 downlink_bytes)
 {
-    struct urr_info *urr = bpf_map_lookup_elem(&urr_map, &urr_id);  
-    if (urr) {
-        urr->ul += uplink_bytes;
-        urr->dl += downlink_bytes;
-        upf_printk("upf: urr:%u uplink:%u downlink:%u", urr_id, urr->ul, urr->dl);    
+    if (!urr_id)
+        return;
+
+    struct urr_info *urr = bpf_map_lookup_elem(&urr_map, &urr_id);
+    struct urr_limits *limits = bpf_map_lookup_elem(&urr_limit_map, &urr_id);
+    if (urr && limits) {
+        /* Packets of the same URR are counted on several CPUs */
+        __sync_fetch_and_add(&urr->ul, uplink_bytes);
+        __sync_fetch_and_add(&urr->dl, downlink_bytes);
+        upf_printk("upf: urr:%u uplink:%u downlink:%u", urr_id, urr->ul, urr->dl);
+
+        /* New limits rearm the events */
+        if (urr->generation != limits->generation) {
+            urr->status = 0;
+            urr->generation = limits->generation;
+        }
+
+        __u32 status = check_urr_limits(urr, limits) & ~urr->status;
+        if (status) {
+            urr->status |= status;
+            struct urr_event event = {
+                .urr_id = urr_id,
+                .status = status,
+            };
+            bpf_ringbuf_output(&urr_events, &event, sizeof(event), 0);
+            upf_printk("upf: urr:%u status:%u", urr_id, status);
+        }
     }
 }
@@ -138,6 +138,36 @@ static __always_inline long remove_gtp_header(struct packet_context *ctx) {
     return context_reinit(ctx, data, data_end);
 }
 
+/* Removes the 802.1Q tag of a GTP-U packet, which is forwarded untagged as the packets encapsulated on N6 */
+static __always_inline long remove_vlan_header(struct packet_context *ctx) {
+    char *data = (char *)(long)ctx->xdp_ctx->data;
+    const char *data_end = (const char *)(long)ctx->xdp_ctx->data_end;
+    struct ethhdr *eth = (struct ethhdr *)data;
+    struct vlanhdr *vlan = (struct vlanhdr *)(eth + 1);
+    if ((const char *)(vlan + 1) > data_end) {
+        upf_printk("upf: remove_vlan_header: can't parse vlan");
+        return -1;
+    }
+
+    /* The ethernet header takes the place of the tag */
+    struct ethhdr orig_eth;
+    __builtin_memcpy(&orig_eth, eth, sizeof(orig_eth));
+    orig_eth.h_proto = vlan->encapsulated_proto;
+    struct ethhdr *new_eth = (struct ethhdr *)(data + sizeof(*vlan));
+    __builtin_memcpy(new_eth, &orig_eth, sizeof(*new_eth));
+
+    long result = bpf_xdp_adjust_head(ctx->xdp_ctx, sizeof(*vlan));
+    if (result)
+        return result;
+
+    /* Update packet pointers up to the GTP header */
+    data = (char *)(long)ctx->xdp_ctx->data;
+    data_end = (const char *)(long)ctx->xdp_ctx->data_end;
+    if (context_reinit(ctx, data, data_end) || -1 == parse_udp(ctx) || (__u32)-1 == parse_gtp(ctx))
+        return -1;
+    return 0;
+}
+
 static __always_inline void fill_ip_header(struct iphdr *ip, int saddr, int daddr, __u8 tos, int tot_len) {
     ip->version = 4;
     ip->ihl = 5; /* No options */
@@ -197,14 +227,16 @@ static __always_inline __u32 add_gtp_over_ip4_headers(struct packet_context *ctx
     else
         return -1;
 
-    int result = bpf_xdp_adjust_head(ctx->xdp_ctx, (__s32)-gtp_encap_size);
+    /* The VLAN tag is dropped, the outer ethernet header takes its place */
+    const size_t vlan_size = ctx->vlan ? sizeof(struct vlanhdr) : 0;
+    int result = bpf_xdp_adjust_head(ctx->xdp_ctx, (__s32)vlan_size - (__s32)gtp_encap_size);
     if (result)
         return -1;
 
     char *data = (char *)(long)ctx->xdp_ctx->data;
     const char *data_end = (const char *)(long)ctx->xdp_ctx->data_end;
 
-    struct ethhdr *orig_eth = (struct ethhdr *)(data + gtp_encap_size);
+    struct ethhdr *orig_eth = (struct ethhdr *)(data + gtp_encap_size - vlan_size);
     if ((const char *)(orig_eth + 1) > data_end)
         return -1;
 
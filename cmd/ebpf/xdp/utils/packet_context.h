@@ -24,6 +24,14 @@
 #include <linux/tcp.h>
 #include "xdp/utils/gtpu.h"
 
+#define VLAN_VID_MASK 0x0fff
+
+/* 802.1Q tag following the ethernet addresses */
+struct vlanhdr {
+    __be16 tci;
+    __be16 encapsulated_proto;
+};
+
 /* Header cursor to keep track of current parsing position */
 struct packet_context {
     char *data;
@@ -32,6 +40,7 @@ struct packet_context {
     struct n3_n6_counters *n3_n6_counter;
     struct xdp_md *xdp_ctx;
     struct ethhdr *eth;
+    struct vlanhdr *vlan;
     struct iphdr *ip4;
     struct ipv6hdr *ip6;
     struct udphdr *udp;
@@ -35,11 +35,19 @@ static __always_inline int parse_ethernet(struct packet_context *ctx) {
     if ((const char *)(eth + 1) > ctx->data_end)
         return -1;
 
-    /* TODO: Add vlan support */
-
     ctx->data += sizeof(*eth);
     ctx->eth = eth;
-    return bpf_ntohs(eth->h_proto);
+    if (eth->h_proto != bpf_htons(ETH_P_8021Q))
+        return bpf_ntohs(eth->h_proto);
+
+    /* Single 802.1Q tag is supported */
+    struct vlanhdr *vlan = (struct vlanhdr *)ctx->data;
+    if ((const char *)(vlan + 1) > ctx->data_end)
+        return -1;
+
+    ctx->data += sizeof(*vlan);
+    ctx->vlan = vlan;
+    return bpf_ntohs(vlan->encapsulated_proto);
 }
 
 /* 0x3FFF mask to check for fragment offset field */
@@ -136,6 +144,7 @@ static __always_inline void context_set_ip4(struct packet_context *ctx, char *da
     ctx->data = data;
     ctx->data_end = data_end;
     ctx->eth = eth;
+    ctx->vlan = 0;
     ctx->ip4 = ip4;
     ctx->ip6 = 0;
     ctx->udp = udp;
@@ -146,6 +155,7 @@ static __always_inline void context_reset(struct packet_context *ctx, char *data
     ctx->data = data;
     ctx->data_end = data_end;
     ctx->eth = 0;
+    ctx->vlan = 0;
     ctx->ip4 = 0;
     ctx->ip6 = 0;
     ctx->udp = 0;
@@ -46,6 +46,70 @@ struct
     __uint(max_entries, 1);
 } upf_route_stat SEC(".maps");
 
+#define NETWORK_INSTANCE_MAP_SIZE 64
+
+/* BPF_FIB_LOOKUP_TBID of Linux 6.8+: BPF_FIB_LOOKUP_DIRECT lookup in the table of fib_params.tbid */
+#define FIB_LOOKUP_TBID (1U << 3)
+
+struct network_instance {
+    __u32 table_id; // 0 - table of the egress interface
+    __u32 ifindex;  // 0 - ingress interface
+};
+
+/* network instance id -> routing table and egress interface. Id 0 is the default routing table */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, struct network_instance);
+    __uint(max_entries, NETWORK_INSTANCE_MAP_SIZE);
+} network_instance_map SEC(".maps");
+
+struct n6_ingress {
+    __u32 ifindex; // 0 - any interface
+    __u32 vlan_id; // 0 - untagged packets
+};
+
+/* N6 ingress interface and VLAN -> network instance id */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct n6_ingress);
+    __type(value, __u32);
+    __uint(max_entries, NETWORK_INSTANCE_MAP_SIZE);
+} n6_ingress_map SEC(".maps");
+
+/* Network instance of the packet received on N6, 0 - default network instance */
+static __always_inline __u32 get_n6_network_instance(__u32 ifindex, __u16 vlan_id) {
+    struct n6_ingress ingress = {.ifindex = ifindex, .vlan_id = vlan_id};
+    const __u32 *network_instance = bpf_map_lookup_elem(&n6_ingress_map, &ingress);
+    if (network_instance)
+        return *network_instance;
+
+    ingress.ifindex = 0;
+    network_instance = bpf_map_lookup_elem(&n6_ingress_map, &ingress);
+    return network_instance ? *network_instance : 0;
+}
+
+/* Directs FIB lookup to the routing table of the network instance, returns bpf_fib_lookup flags */
+static __always_inline __u32 set_fib_network_instance(struct xdp_md *ctx, struct bpf_fib_lookup *fib_params, __u32 network_instance) {
+    fib_params->ifindex = ctx->ingress_ifindex;
+    if (!network_instance)
+        return 0;
+
+    const struct network_instance *instance = bpf_map_lookup_elem(&network_instance_map, &network_instance);
+    if (!instance)
+        return 0;
+
+    if (instance->ifindex)
+        fib_params->ifindex = instance->ifindex;
+    if (instance->table_id) {
+        fib_params->tbid = instance->table_id;
+        return BPF_FIB_LOOKUP_DIRECT | FIB_LOOKUP_TBID;
+    }
+    return 0;
+}
+
 #ifdef ENABLE_ROUTE_CACHE
 
 #warning "Routing cache enabled"
@@ -97,7 +161,7 @@ static __always_inline enum xdp_action do_route_ipv4(struct xdp_md *ctx, struct
     return bpf_redirect(ifindex, 0);
 }
 
-static __always_inline enum xdp_action route_ipv4(struct xdp_md *ctx, struct ethhdr *eth, const struct iphdr *ip4) {
+static __always_inline enum xdp_action route_ipv4(struct xdp_md *ctx, struct ethhdr *eth, const struct iphdr *ip4, __u32 network_instance) {
     const __u32 key = 0;
     struct route_stat *statistic = bpf_map_lookup_elem(&upf_route_stat, &key);
     if (!statistic) {
@@ -105,7 +169,8 @@ static __always_inline enum xdp_action route_ipv4(struct xdp_md *ctx, struct eth
     }
 
 #ifdef ENABLE_ROUTE_CACHE
-    struct route_record *cache = bpf_map_lookup_elem(&upf_route_cache_ip4, &ip4->daddr);
+    // Routes are cached for the default routing table only
+    struct route_record *cache = network_instance ? NULL : bpf_map_lookup_elem(&upf_route_cache_ip4, &ip4->daddr);
     if (cache) {
         upf_printk("upf: bpf_fib_lookup %pI4 -> %pI4: cached ifindex: %d", &ip4->saddr, &ip4->daddr, cache->ifindex);
         statistic->fib_lookup_ip4_cache += 1;
@@ -122,16 +187,17 @@ static __always_inline enum xdp_action route_ipv4(struct xdp_md *ctx, struct eth
     fib_params.tot_len = bpf_ntohs(ip4->tot_len);
     fib_params.ipv4_src = ip4->saddr;
     fib_params.ipv4_dst = ip4->daddr;
-    fib_params.ifindex = ctx->ingress_ifindex;
+    __u32 flags = set_fib_network_instance(ctx, &fib_params, network_instance);
 
-    int rc = bpf_fib_lookup(ctx, &fib_params, sizeof(fib_params), 0 /*BPF_FIB_LOOKUP_OUTPUT*/);
+    int rc = bpf_fib_lookup(ctx, &fib_params, sizeof(fib_params), flags);
     switch (rc) {
         case BPF_FIB_LKUP_RET_SUCCESS:
             upf_printk("upf: bpf_fib_lookup %pI4 -> %pI4: nexthop: %pI4", &ip4->saddr, &ip4->daddr, &fib_params.ipv4_dst);
             statistic->fib_lookup_ip4_ok += 1;
 
 #ifdef ENABLE_ROUTE_CACHE
-            update_route_cache_ipv4(&fib_params, ip4->daddr);
+            if (!network_instance)
+                update_route_cache_ipv4(&fib_params, ip4->daddr);
 #endif
             return do_route_ipv4(ctx, eth, fib_params.ifindex, &fib_params.smac, &fib_params.dmac);
 
@@ -153,7 +219,7 @@ static __always_inline enum xdp_action route_ipv4(struct xdp_md *ctx, struct eth
     }
 }
 
-static __always_inline enum xdp_action route_ipv6(struct xdp_md *ctx, struct ethhdr *eth, const struct ipv6hdr *ip6) {
+static __always_inline enum xdp_action route_ipv6(struct xdp_md *ctx, struct ethhdr *eth, const struct ipv6hdr *ip6, __u32 network_instance) {
     const __u32 key = 0;
     struct route_stat *statistic = bpf_map_lookup_elem(&upf_route_stat, &key);
     if (!statistic) {
@@ -161,7 +227,7 @@ static __always_inline enum xdp_action route_ipv6(struct xdp_md *ctx, struct eth
     }
 
     struct bpf_fib_lookup fib_params = {};
-    fib_params.family = AF_INET;
+    fib_params.family = AF_INET6;
     // fib_params.tos = ip6->flow_lbl;
     fib_params.l4_protocol = ip6->nexthdr;
     fib_params.sport = 0;
@@ -169,9 +235,9 @@ static __always_inline enum xdp_action route_ipv6(struct xdp_md *ctx, struct eth
     fib_params.tot_len = bpf_ntohs(ip6->payload_len);
     __builtin_memcpy(fib_params.ipv6_src, &ip6->saddr, sizeof(ip6->saddr));
     __builtin_memcpy(fib_params.ipv6_dst, &ip6->daddr, sizeof(ip6->daddr));
-    fib_params.ifindex = ctx->ingress_ifindex;
+    __u32 flags = set_fib_network_instance(ctx, &fib_params, network_instance);
 
-    int rc = bpf_fib_lookup(ctx, &fib_params, sizeof(fib_params), 0 /*BPF_FIB_LOOKUP_OUTPUT*/);
+    int rc = bpf_fib_lookup(ctx, &fib_params, sizeof(fib_params), flags);
     switch (rc) {
         case BPF_FIB_LKUP_RET_SUCCESS:
             upf_printk("upf: bpf_fib_lookup %pI6c -> %pI6c: nexthop: %pI4", &ip6->saddr, &ip6->daddr, &fib_params.ipv4_dst);
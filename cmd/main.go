@@ -58,6 +58,48 @@ func main() {
 		log.Fatal().Err(err).Msgf("can't set dataplane global config")
 	}
 
+	for _, instance := range config.Conf.NetworkInstances {
+		if instance.Table == 0 {
+			continue
+		}
+		// Without the table lookup the packets would silently be routed in the main table
+		if err := ebpf.ProbeFibLookupTbid(); err != nil {
+			log.Fatal().Msgf("Can't route network instance %q in table %d: %s", instance.Name, instance.Table, err.Error())
+		}
+		break
+	}
+
+	for _, instance := range config.Conf.NetworkInstances {
+		ifindex := 0
+		if instance.Interface != "" {
+			iface, err := net.InterfaceByName(instance.Interface)
+			if err != nil {
+				log.Fatal().Msgf("Lookup network iface %q of network instance %q: %s", instance.Interface, instance.Name, err.Error())
+			}
+			ifindex = iface.Index
+		}
+		if err := bpfObjects.PutNetworkInstance(core.NetworkInstanceID(instance.Name), instance.Table, uint32(ifindex)); err != nil {
+			log.Fatal().Msgf("Can't put network instance %q: %s", instance.Name, err.Error())
+		}
+		log.Info().Msgf("Network instance %q is routed in table %d, iface %q", instance.Name, instance.Table, instance.Interface)
+
+		if instance.IngressInterface == "" && instance.Vlan == 0 {
+			continue
+		}
+		ingressIfindex := 0
+		if instance.IngressInterface != "" {
+			iface, err := net.InterfaceByName(instance.IngressInterface)
+			if err != nil {
+				log.Fatal().Msgf("Lookup network iface %q of network instance %q: %s", instance.IngressInterface, instance.Name, err.Error())
+			}
+			ingressIfindex = iface.Index
+		}
+		if err := bpfObjects.PutN6Ingress(uint32(ingressIfindex), instance.Vlan, core.NetworkInstanceID(instance.Name)); err != nil {
+			log.Fatal().Msgf("Can't put N6 ingress of network instance %q: %s", instance.Name, err.Error())
+		}
+		log.Info().Msgf("Network instance %q is received on N6 through iface %q, vlan %d", instance.Name, instance.IngressInterface, instance.Vlan)
+	}
+
 	defer bpfObjects.Close()
 
 	for _, ifaceName := range config.Conf.InterfaceName {
@@ -100,6 +142,17 @@ func main() {
 		remoteNodes = append(remoteNodes, core.NewDefaultAssociationConnector(remoteNode))
 	}
 	pfcpConn.SetRemoteNodes(remoteNodes)
+	if err := bpfObjects.ListenUrrEvents(pfcpConn.UrrEvents()); err != nil {
+		log.Fatal().Msgf("Could not listen URR events: %s", err.Error())
+	}
+	if err := bpfObjects.ListenBufferedPackets(pfcpConn.BufferedPackets()); err != nil {
+		log.Fatal().Msgf("Could not listen buffered packets: %s", err.Error())
+	}
+	// Without live frames the buffered packets would fail to be forwarded one by one once their FARs forward them
+	if err := ebpf.ProbeXdpLiveFrames(); err != nil {
+		log.Warn().Msgf("Downlink packets of FARs with the BUFF apply action are dropped instead of buffered: %s", err.Error())
+		pfcpConn.DisableDownlinkBuffer()
+	}
 	go pfcpConn.Run()
 	defer pfcpConn.Close()
 
@@ -129,7 +182,8 @@ func main() {
 		}
 	}()
 
-	gtpPathManager := core.NewGtpPathManager(config.Conf.N3Address+":2152", time.Duration(config.Conf.GtpEchoInterval)*time.Second)
+	gtpPathManager := core.NewGtpPathManager(config.Conf.N3Address+":2152", time.Duration(config.Conf.GtpEchoInterval)*time.Second,
+		config.Conf.GtpEchoRetries, pfcpConn.GtpPathEvents())
 	for _, peer := range config.Conf.GtpPeer {
 		gtpPathManager.AddGtpPath(peer)
 	}
@@ -151,6 +205,9 @@ func main() {
 			// log.Printf("Pipeline map contents:\n%s", s)
 		case <-stopper:
 			log.Info().Msgf("Received signal, exiting program..")
+			if config.Conf.GracefulReleaseTimeout != 0 {
+				pfcpConn.ReleaseAssociations(time.Duration(config.Conf.GracefulReleaseTimeout) * time.Second)
+			}
 			return
 		}
 	}